@@ -0,0 +1,209 @@
+package communication
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"internal"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Request body size limit, the largest request is a pushed text.
+const maxAdminRequestSize = 16 * 1024 * 1024
+
+type adminTextJson struct {
+	Text    string
+	Formats []internal.TextFormat `json:",omitempty"`
+}
+
+// Serves admin API until the process exits. Every call which touches a group runs on its event loop.
+func (s *Server) serveAdmin(address string) {
+	var listener net.Listener
+	var err error
+	if path, isUnix := strings.CutPrefix(address, internal.AdminUnixPrefix); isUnix {
+		// Socket of the previous run is left if the server was killed, anything else at the path is
+		// kept and listening fails.
+		if stat, err := os.Lstat(path); err == nil && stat.Mode()&os.ModeSocket != 0 {
+			os.Remove(path)
+		}
+		if listener, err = net.Listen("unix", path); err == nil {
+			err = os.Chmod(path, 0600)
+		}
+	} else {
+		listener, err = net.Listen("tcp", address)
+	}
+	if err != nil {
+		slog.Error("Unable to start admin API", "address", address, internal.LogKeyError, err)
+		return
+	}
+
+	slog.Info("Admin API is served", "address", address)
+	if err = http.Serve(listener, s.adminHandler()); err != nil {
+		slog.Error("Admin API has stopped", internal.LogKeyError, err)
+	}
+}
+
+func (s *Server) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /groups", s.handleAdminGroups)
+	mux.HandleFunc("GET /groups/{group}/clients/{client}/history", s.handleAdminHistory)
+	mux.HandleFunc("POST /groups/{group}/clients/{client}/disconnect", s.handleAdminDisconnect)
+	mux.HandleFunc("POST /groups/{group}/clients/{client}/text", s.handleAdminPushText)
+	mux.HandleFunc("POST /config/reload", s.handleAdminReload)
+	return s.authorizeAdmin(mux)
+}
+
+// Token is taken from the current config, so it may be changed without restart.
+func (s *Server) authorizeAdmin(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		token, _ := strings.CutPrefix(request.Header.Get("Authorization"), "Bearer ")
+		s.mutex.Lock()
+		adminConfig := s.config.Admin
+		s.mutex.Unlock()
+		if adminConfig == nil || !internal.CheckAdminToken(s.serverKey, adminConfig, token) {
+			s.recordAudit(internal.AuditRecord{Event: internal.AuditAuthFailed, Address: request.RemoteAddr,
+				Details: "admin API: " + request.Method + " " + request.URL.Path})
+			writeAdminError(writer, http.StatusUnauthorized, errors.New("wrong admin token"))
+			return
+		}
+		handler.ServeHTTP(writer, request)
+	})
+}
+
+func (s *Server) handleAdminGroups(writer http.ResponseWriter, request *http.Request) {
+	// Config of the group is changed on reload, so names are copied under the mutex.
+	s.mutex.Lock()
+	groups := make([]internal.ClientGroup, len(s.groups))
+	names := make([]string, len(s.groups))
+	for index, group := range s.groups {
+		groups[index] = group.group
+		names[index] = group.config.Name
+		if len(names[index]) == 0 {
+			names[index] = strconv.Itoa(index)
+		}
+	}
+	s.mutex.Unlock()
+
+	result := []internal.AdminGroup{}
+	for index, group := range groups {
+		deliveryStats, err := group.GetDeliveryStats()
+		if err != nil {
+			// Group was removed by config reload.
+			continue
+		}
+		groupJson := internal.AdminGroup{Name: names[index], Clients: []internal.AdminClient{}}
+		for _, stats := range deliveryStats {
+			groupJson.Clients = append(groupJson.Clients, internal.AdminClient{
+				Id:          stats.ClientId,
+				Name:        stats.Name,
+				Connected:   stats.Connections > 0,
+				Connections: stats.Connections,
+				Sessions:    stats.Sessions,
+			})
+		}
+		result = append(result, groupJson)
+	}
+	writeAdminResponse(writer, result)
+}
+
+func (s *Server) handleAdminHistory(writer http.ResponseWriter, request *http.Request) {
+	group, id, err := s.findAdminClient(request)
+	if err != nil {
+		writeAdminError(writer, http.StatusNotFound, err)
+		return
+	}
+	entries, err := group.group.GetHistory(id)
+	if err != nil {
+		writeAdminError(writer, http.StatusNotFound, err)
+		return
+	}
+	result := make([]adminTextJson, len(entries))
+	for index, entry := range entries {
+		result[index] = adminTextJson{Text: entry.Text, Formats: entry.Formats}
+	}
+	writeAdminResponse(writer, result)
+}
+
+func (s *Server) handleAdminDisconnect(writer http.ResponseWriter, request *http.Request) {
+	group, id, err := s.findAdminClient(request)
+	if err != nil {
+		writeAdminError(writer, http.StatusNotFound, err)
+		return
+	}
+	group.group.DisconnectClient(id)
+	s.recordAdminAction(request, group, id, "disconnect")
+	writeAdminResponse(writer, struct{}{})
+}
+
+func (s *Server) handleAdminPushText(writer http.ResponseWriter, request *http.Request) {
+	group, id, err := s.findAdminClient(request)
+	if err != nil {
+		writeAdminError(writer, http.StatusNotFound, err)
+		return
+	}
+	var text adminTextJson
+	decoder := json.NewDecoder(http.MaxBytesReader(writer, request.Body, maxAdminRequestSize))
+	if err = decoder.Decode(&text); err != nil {
+		writeAdminError(writer, http.StatusBadRequest, fmt.Errorf("unable to parse text: %w", err))
+		return
+	}
+	if err = group.group.PushText(id, internal.TextEntry{Text: text.Text, Formats: text.Formats}); err != nil {
+		writeAdminError(writer, http.StatusBadRequest, err)
+		return
+	}
+	s.recordAdminAction(request, group, id, "push text")
+	writeAdminResponse(writer, struct{}{})
+}
+
+func (s *Server) handleAdminReload(writer http.ResponseWriter, request *http.Request) {
+	if err := s.reloadConfigLogged("admin API request"); err != nil {
+		writeAdminError(writer, http.StatusInternalServerError, err)
+		return
+	}
+	s.reloadCertificateLogged()
+	writeAdminResponse(writer, struct{}{})
+}
+
+// Group is matched by its name or index in the config, as in the commands, client by public ID.
+func (s *Server) findAdminClient(request *http.Request) (*serverGroup, uint64, error) {
+	id, err := strconv.ParseUint(request.PathValue("client"), 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("wrong client ID '%s'", request.PathValue("client"))
+	}
+	nameOrIndex := request.PathValue("group")
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, group := range s.groups {
+		if group.config.Name == nameOrIndex {
+			return group, id, nil
+		}
+	}
+	index, err := strconv.Atoi(nameOrIndex)
+	if err == nil && index >= 0 && index < len(s.groups) {
+		return s.groups[index], id, nil
+	}
+	return nil, 0, fmt.Errorf("unknown group '%s'", nameOrIndex)
+}
+
+func (s *Server) recordAdminAction(request *http.Request, group *serverGroup, id uint64, action string) {
+	s.recordAudit(internal.AuditRecord{Event: internal.AuditAdminCommand, Group: group.name, ClientId: id,
+		Address: request.RemoteAddr, Details: "admin API: " + action})
+}
+
+func writeAdminResponse(writer http.ResponseWriter, response any) {
+	writer.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(writer).Encode(response); err != nil {
+		slog.Warn("Unable to write admin API response", internal.LogKeyError, err)
+	}
+}
+
+func writeAdminError(writer http.ResponseWriter, status int, err error) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	json.NewEncoder(writer).Encode(internal.AdminError{Error: err.Error()})
+}
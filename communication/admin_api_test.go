@@ -0,0 +1,94 @@
+package communication
+
+import (
+	"encoding/json"
+	"internal"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAdminApi(t *testing.T) {
+	server := createTestServer(t)
+	token := makeTestSecret(9)
+	secret, _ := internal.DecodeSecret(token)
+	err := server.applyConfig(&internal.Config{
+		Admin: &internal.AdminConfig{TokenHash: internal.EncodeSecretHash(internal.HashSecret(server.serverKey, secret))},
+		Groups: []internal.GroupConfig{
+			{Name: "home", Clients: []internal.ClientConfig{
+				{Secret: makeTestSecret(1), PublicId: 1, Name: "laptop"},
+				{Secret: makeTestSecret(2), PublicId: 2, Name: "phone"},
+			}},
+			{Clients: []internal.ClientConfig{{Secret: makeTestSecret(3), PublicId: 3, Name: "desktop"}}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unable to apply config: %s", err.Error())
+	}
+	api := httptest.NewServer(server.adminHandler())
+	defer api.Close()
+
+	call := func(method, path, body, token string) (int, string) {
+		request, _ := http.NewRequest(method, api.URL+path, strings.NewReader(body))
+		request.Header.Set("Authorization", "Bearer "+token)
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatalf("Admin API request has failed: %s", err.Error())
+		}
+		defer response.Body.Close()
+		result, _ := io.ReadAll(response.Body)
+		return response.StatusCode, string(result)
+	}
+
+	if status, _ := call("GET", "/groups", "", makeTestSecret(8)); status != http.StatusUnauthorized {
+		t.Errorf("Wrong token was accepted, status %d", status)
+	}
+	status, body := call("GET", "/groups", "", token)
+	var groups []internal.AdminGroup
+	if err = json.Unmarshal([]byte(body), &groups); status != http.StatusOK || err != nil {
+		t.Fatalf("Unable to list groups, status %d: %s", status, body)
+	}
+	if len(groups) != 2 || groups[0].Name != "home" || len(groups[0].Clients) != 2 || groups[0].Clients[0].Connected ||
+		groups[1].Name != "1" {
+		t.Errorf("Wrong groups were listed: %s", body)
+	}
+
+	if status, body = call("POST", "/groups/home/clients/1/text", `{"Text":"pushed"}`, token); status != http.StatusOK {
+		t.Fatalf("Unable to push text, status %d: %s", status, body)
+	}
+	status, body = call("GET", "/groups/home/clients/1/history", "", token)
+	var history []adminTextJson
+	if err = json.Unmarshal([]byte(body), &history); status != http.StatusOK || err != nil {
+		t.Fatalf("Unable to read history, status %d: %s", status, body)
+	}
+	if len(history) != 1 || history[0].Text != "pushed" {
+		t.Errorf("Pushed text is not in history: %s", body)
+	}
+
+	if status, _ = call("GET", "/groups/home/clients/3/history", "", token); status != http.StatusNotFound {
+		t.Errorf("History of unknown client was returned, status %d", status)
+	}
+	if status, body = call("GET", "/groups/1/clients/3/history", "", token); status != http.StatusOK {
+		t.Errorf("Unnamed group was not found by its index, status %d: %s", status, body)
+	}
+	if status, _ = call("POST", "/groups/work/clients/1/disconnect", "", token); status != http.StatusNotFound {
+		t.Errorf("Client of unknown group was disconnected, status %d", status)
+	}
+}
+
+func TestAdminSocketKeepsOtherFiles(t *testing.T) {
+	server := createTestServer(t)
+	path := filepath.Join(t.TempDir(), "admin.sock")
+	if err := os.WriteFile(path, []byte("data"), 0600); err != nil {
+		t.Fatalf("Unable to write file: %s", err.Error())
+	}
+	// Listening fails, so the call returns right away.
+	server.serveAdmin(internal.AdminUnixPrefix + path)
+	if data, err := os.ReadFile(path); err != nil || string(data) != "data" {
+		t.Errorf("File at the socket path was removed: %v", err)
+	}
+}
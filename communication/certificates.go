@@ -0,0 +1,131 @@
+package communication
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"internal"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Keeps the current server certificate, it is swapped in place when certificate files are changed,
+// so new TLS handshakes use the new certificate and established connections are kept.
+type certificateHolder struct {
+	certificate atomic.Pointer[tls.Certificate]
+	certFile    string
+	keyFile     string
+
+	// Guards reload, it may be started by the renewal timer and by SIGHUP.
+	mutex   sync.Mutex
+	modTime time.Time
+}
+
+func loadCertificateHolder(certFile, keyFile string) (*certificateHolder, error) {
+	holder := &certificateHolder{certFile: certFile, keyFile: keyFile}
+	if err := holder.load(); err != nil {
+		return nil, err
+	}
+	return holder, nil
+}
+
+func (h *certificateHolder) load() error {
+	stat, err := os.Stat(h.certFile)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(h.certFile, h.keyFile)
+	if err != nil {
+		return err
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return err
+		}
+	}
+	h.certificate.Store(&cert)
+	h.modTime = stat.ModTime()
+	return nil
+}
+
+// Loads certificate again if its file was changed since the last load.
+func (h *certificateHolder) reloadIfChanged() (bool, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	stat, err := os.Stat(h.certFile)
+	if err != nil {
+		return false, err
+	}
+	if stat.ModTime().Equal(h.modTime) {
+		return false, nil
+	}
+	return true, h.load()
+}
+
+// Loads certificate regardless of its modification time, which may be unchanged if the file was
+// rewritten within the timestamp granularity.
+func (h *certificateHolder) reload() error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.load()
+}
+
+func (h *certificateHolder) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return h.certificate.Load(), nil
+}
+
+func (h *certificateHolder) leaf() *x509.Certificate {
+	return h.certificate.Load().Leaf
+}
+
+// Periodically renews the certificate in the application data directory when it is about to
+// expire. Certificate is also picked up if it was replaced by someone else.
+func (s *Server) ManageCertificate(interval time.Duration) {
+	go func() {
+		for {
+			s.renewCertificateIfNeeded()
+			time.Sleep(interval)
+		}
+	}()
+}
+
+func (s *Server) renewCertificateIfNeeded() {
+	s.reloadCertificateLogged()
+	if time.Until(s.certificates.leaf().NotAfter) > internal.CertRenewBefore {
+		return
+	}
+
+	slog.Info("Server certificate is about to expire, renewing it", "expires", s.certificates.leaf().NotAfter)
+	if err := internal.RenewCertificate(s.appDataDir, internal.DefaultCertValidity); errors.Is(err, internal.ErrCertNotGenerated) {
+		slog.Warn("Server certificate was not renewed", internal.LogKeyError, err)
+		return
+	} else if err != nil {
+		slog.Error("Unable to renew certificate", internal.LogKeyError, err)
+		return
+	}
+	if err := s.certificates.reload(); err != nil {
+		slog.Error("Renewed certificate was not loaded", internal.LogKeyError, err)
+		return
+	}
+	slog.Info("Certificate was reloaded")
+	logCertificateFingerprint(s.certificates.leaf())
+}
+
+func (s *Server) reloadCertificateLogged() {
+	changed, err := s.certificates.reloadIfChanged()
+	if err != nil {
+		slog.Error("Certificate was not reloaded", internal.LogKeyError, err)
+		return
+	}
+	if changed {
+		slog.Info("Certificate was reloaded")
+		logCertificateFingerprint(s.certificates.leaf())
+	}
+}
+
+func logCertificateFingerprint(cert *x509.Certificate) {
+	slog.Info("Server certificate", "expires", cert.NotAfter, "sha256", internal.PublicKeyFingerprint(cert))
+}
@@ -0,0 +1,110 @@
+package communication
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"internal"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCertificateRenewal(t *testing.T) {
+	server := createTestServer(t)
+	if err := internal.GenerateCertificate(server.appDataDir, []string{"localhost"}, time.Hour); err != nil {
+		t.Fatalf("Unable to generate certificate: %s", err.Error())
+	}
+	var err error
+	server.certificates, err = loadCertificateHolder(
+		internal.CertFilePath(server.appDataDir), internal.KeyFilePath(server.appDataDir))
+	if err != nil {
+		t.Fatalf("Unable to load certificate: %s", err.Error())
+	}
+	config := certToConfig(server.certificates, nil, tls.NoClientCert)
+	oldCert, _ := config.GetCertificate(nil)
+
+	server.renewCertificateIfNeeded()
+	newCert, _ := config.GetCertificate(nil)
+	if newCert == oldCert || !newCert.Leaf.NotAfter.After(oldCert.Leaf.NotAfter) {
+		t.Fatal("Expiring certificate was not renewed")
+	}
+
+	server.renewCertificateIfNeeded()
+	if current, _ := config.GetCertificate(nil); current != newCert {
+		t.Error("Valid certificate was renewed")
+	}
+}
+
+func TestClientCertificateAuthentication(t *testing.T) {
+	server := createTestServer(t)
+	server.clientAuth = internal.ClientAuthCertificate
+	dir := server.appDataDir
+	if err := internal.GenerateCertificate(dir, []string{"localhost"}, time.Hour); err != nil {
+		t.Fatalf("Unable to generate certificate: %s", err.Error())
+	}
+	certificates, err := loadCertificateHolder(internal.CertFilePath(dir), internal.KeyFilePath(dir))
+	if err != nil {
+		t.Fatalf("Unable to load certificate: %s", err.Error())
+	}
+	caCert, _, err := internal.OpenCertificateAuthority(dir)
+	if err != nil {
+		t.Fatalf("Unable to create CA: %s", err.Error())
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(caCert)
+	serverConfig := certToConfig(certificates, clientCAs, tls.RequireAndVerifyClientCert)
+
+	certPem, keyPem, err := internal.IssueClientCertificate(dir, "laptop", time.Hour)
+	if err != nil {
+		t.Fatalf("Unable to issue client certificate: %s", err.Error())
+	}
+	clientCert, err := tls.X509KeyPair(certPem, keyPem)
+	if err != nil {
+		t.Fatalf("Unable to load client certificate: %s", err.Error())
+	}
+	err = server.applyConfig(&internal.Config{ClientAuth: internal.ClientAuthCertificate,
+		Groups: []internal.GroupConfig{{Clients: []internal.ClientConfig{
+			{CertFingerprint: internal.CertificateFingerprint(clientCert.Leaf), PublicId: 1, Name: "laptop"},
+		}}}})
+	if err != nil {
+		t.Fatalf("Unable to apply config: %s", err.Error())
+	}
+
+	// Loopback socket is used instead of pipe, because TLS peers write concurrently during handshake.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err.Error())
+	}
+	defer listener.Close()
+	connect := func(clientCertificates []tls.Certificate) (clientMapping, error) {
+		go func() {
+			clientConn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{
+				Certificates: clientCertificates, InsecureSkipVerify: true})
+			if err == nil {
+				io.Copy(io.Discard, clientConn)
+				clientConn.Close()
+			}
+		}()
+
+		serverConn, err := listener.Accept()
+		if err != nil {
+			return clientMapping{}, err
+		}
+		defer serverConn.Close()
+		tlsConn := tls.Server(serverConn, serverConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			return clientMapping{}, err
+		}
+		connection := createClientConnection(tlsConn)
+		return server.authenticate(&connection, nil)
+	}
+
+	mapping, err := connect([]tls.Certificate{clientCert})
+	if err != nil || mapping.publicId != 1 {
+		t.Errorf("Client with certificate was not authenticated: %v", err)
+	}
+	if _, err = connect(nil); err == nil {
+		t.Error("Client without certificate was authenticated")
+	}
+}
@@ -1,12 +1,14 @@
 package communication
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"internal"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"sync/atomic"
 	"time"
@@ -14,12 +16,20 @@ import (
 
 const messageHeaderSize = 24
 const minHeaderLen = 16
-const writeQueueSize = 100
+
+// Connection which was taken over is closed after this time even if its queue was not sent.
+const drainTimeout = 5 * time.Second
+
+// Introduction and enrollment are small, the limit prevents unauthenticated peer from making
+// server allocate a lot of memory.
+const maxFirstMessageSize = 64 * 1024
 
 type networkMessage struct {
 	id      uint64
 	msgType uint16
 	data    []byte
+	// Host which the notification is about, it is not sent and is used only for coalescing.
+	hostId uint64
 }
 
 // TODO: Add better client error notification.
@@ -27,22 +37,32 @@ type clientConnectionImpl struct {
 	connection net.Conn
 	delegate   internal.ClientConnectionDelegate
 	taskRunner internal.EventLoop
-	stopped    atomic.Bool
+	protocol   internal.ProtocolInfo
+	// Zero interval means that heartbeats are disabled.
+	heartbeat internal.HeartbeatSettings
+	stopped   atomic.Bool
+	// New messages are not accepted, connection is closed when the queue is sent.
+	draining atomic.Bool
+
+	writeQueue *sendQueue
 
-	writeQueue chan networkMessage
+	messagesReceived atomic.Uint64
+	messagesSent     atomic.Uint64
+	// Unix time in nanoseconds.
+	lastActivity atomic.Int64
 }
 
 func CreateClientConnectionForTesting(conn net.Conn) internal.ClientConnection {
-	return &clientConnectionImpl{
-		connection: conn,
-		writeQueue: make(chan networkMessage, writeQueueSize),
-	}
+	connection := createClientConnection(conn)
+	return &connection
 }
 
 func createClientConnection(conn net.Conn) clientConnectionImpl {
+	writeQueue := createSendQueue(internal.ResolveWriteQueueSettings(nil))
+	writeQueue.name = conn.RemoteAddr().String()
 	return clientConnectionImpl{
 		connection: conn,
-		writeQueue: make(chan networkMessage, writeQueueSize),
+		writeQueue: writeQueue,
 	}
 }
 
@@ -50,29 +70,81 @@ func (conn *clientConnectionImpl) GetAdressString() string {
 	return conn.connection.RemoteAddr().String()
 }
 
+func (conn *clientConnectionImpl) GetStats() internal.ConnectionStats {
+	result := internal.ConnectionStats{
+		QueueDepth:       conn.writeQueue.depth(),
+		MessagesReceived: conn.messagesReceived.Load(),
+		MessagesSent:     conn.messagesSent.Load(),
+	}
+	if lastActivity := conn.lastActivity.Load(); lastActivity != 0 {
+		result.LastActivity = time.Unix(0, lastActivity)
+	}
+	return result
+}
+
+// Returns certificate the client has presented during TLS handshake, or nil.
+func (conn *clientConnectionImpl) peerCertificate() *x509.Certificate {
+	tlsConn, ok := conn.connection.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	peerCertificates := tlsConn.ConnectionState().PeerCertificates
+	if len(peerCertificates) == 0 {
+		return nil
+	}
+	return peerCertificates[0]
+}
+
 func (conn *clientConnectionImpl) ReadIntroduction() ([]byte, error) {
+	msg, err := conn.readFirstMessage()
+	if err != nil {
+		return nil, err
+	}
+	if msg.msgType != uint16(internal.ClientIntroduction) {
+		return nil, fmt.Errorf("got wrong message type instead of introduction: %d", msg.msgType)
+	}
+	return msg.data, nil
+}
+
+func (conn *clientConnectionImpl) GetProtocol() internal.ProtocolInfo {
+	return conn.protocol
+}
+
+// Reads the first message of the connection, before message handling is started.
+func (conn *clientConnectionImpl) readFirstMessage() (networkMessage, error) {
 	conn.connection.SetDeadline(time.Now().Add(time.Second * 15))
 	defer conn.connection.SetDeadline(time.Time{})
 
 	lenBuf, err := readNBytes(conn.connection, 8)
 	if err != nil {
-		return nil, err
+		return networkMessage{}, err
 	}
 	msgLen := binary.BigEndian.Uint64(lenBuf)
+	if msgLen > maxFirstMessageSize {
+		return networkMessage{}, fmt.Errorf("first message is too long: %d", msgLen)
+	}
 
 	msgBuf, err := readNBytes(conn.connection, msgLen)
 	if err != nil {
-		return nil, err
+		return networkMessage{}, err
 	}
+	internal.GetMetrics().BytesReceived(len(lenBuf) + len(msgBuf))
 	msg, err := parseNetworkMessage(msgBuf)
-	if err != nil {
-		return nil, err
-	}
-	if msg.msgType != uint16(internal.ClientIntroduction) {
-		return nil, fmt.Errorf("got wrong message type instead of introduction: %d", msg.msgType)
+	if err == nil {
+		internal.GetMetrics().MessageReceived(internal.ClientMessageType(msg.msgType))
+		conn.messagesReceived.Add(1)
+		conn.lastActivity.Store(time.Now().UnixNano())
 	}
+	return msg, err
+}
 
-	return msg.data, nil
+// Writes message directly to the socket, it is used before message handling is started.
+func (conn *clientConnectionImpl) writeMessageSync(msg networkMessage) error {
+	conn.connection.SetWriteDeadline(time.Now().Add(time.Second * 15))
+	defer conn.connection.SetWriteDeadline(time.Time{})
+	internal.GetMetrics().MessageSent(internal.ServerMessageType(msg.msgType))
+	conn.messagesSent.Add(1)
+	return writeNetworkMessage(countingWriter{conn.connection}, msg, frameOptions{})
 }
 
 func (conn *clientConnectionImpl) SetUp(
@@ -86,77 +158,103 @@ func (conn *clientConnectionImpl) StartHandlingAsync() {
 	conn.stopped.Store(false)
 	go conn.readerFunc()
 	go conn.writerFunc()
+	if conn.heartbeat.Interval > 0 {
+		go conn.heartbeatFunc()
+	}
 }
 
 func (conn *clientConnectionImpl) DisconnectAndStop() {
 	conn.stopped.Store(true)
 	conn.connection.Close()
-	// We have to add some message in case there is no messages in send queue.
-	select {
-	case conn.writeQueue <- networkMessage{id: 0, msgType: 0, data: nil}:
-	default:
-	}
+	conn.writeQueue.close(false)
+}
+
+func (conn *clientConnectionImpl) DrainAndStop() {
+	conn.draining.Store(true)
+	conn.writeQueue.close(true)
+	// Stale peer may not read anything, so writer could be blocked forever.
+	time.AfterFunc(drainTimeout, conn.DisconnectAndStop)
 }
 
 func (conn *clientConnectionImpl) SendMessage(
 	id uint64, msgType internal.ServerMessageType, data []byte) {
-	if conn.stopped.Load() {
+	if conn.stopped.Load() || conn.draining.Load() {
 		return
 	}
 
-	select {
-	case conn.writeQueue <- networkMessage{id: id, msgType: uint16(msgType), data: data}:
-	default:
-		log.Printf("Connection %s write queue is full, it will be disconnected.",
-			conn.GetAdressString())
+	conn.queueMessage(networkMessage{id: id, msgType: uint16(msgType), data: data})
+}
+
+func (conn *clientConnectionImpl) SendNotification(
+	id uint64, msgType internal.ServerMessageType, hostId uint64, data []byte) {
+	if conn.stopped.Load() || conn.draining.Load() {
+		return
+	}
+	conn.queueMessage(networkMessage{id: id, msgType: uint16(msgType), data: data, hostId: hostId})
+}
+
+func (conn *clientConnectionImpl) queueMessage(msg networkMessage) {
+	if !conn.writeQueue.push(msg) {
+		slog.Warn("Connection will be disconnected", internal.LogKeyAddress, conn.GetAdressString())
 		conn.connection.Close()
 	}
+	// Messages may be queued on the event loop, so the task is posted from another goroutine to not
+	// wait for the loop itself.
+	if dropped := conn.writeQueue.takeDropped(); len(dropped) != 0 {
+		go conn.taskRunner.PostTask(func() {
+			conn.delegate.OnMessagesDropped(dropped)
+		})
+	}
 }
 
 func (conn *clientConnectionImpl) writerFunc() {
-	var prefixBuffer [messageHeaderSize]byte
+	options := frameOptionsFromProtocol(&conn.protocol)
 	for !conn.stopped.Load() {
-		msg := <-conn.writeQueue
-		if msg.data == nil {
+		msg, ok := conn.writeQueue.pop()
+		if !ok {
 			break
 		}
-		len := uint64(16 + len(msg.data))
-		binary.BigEndian.PutUint64(prefixBuffer[:], len)
-		binary.BigEndian.PutUint64(prefixBuffer[8:], msg.id)
-		binary.BigEndian.PutUint16(prefixBuffer[16:18], msg.msgType)
-		// Warning: bytes from 18 to 24 is reserver for future use.
-
-		_, err1 := conn.connection.Write(prefixBuffer[:])
-		if err1 != nil {
-			conn.stopped.Store(true)
-			break
-		}
-
-		_, err2 := conn.connection.Write(msg.data)
-		if err2 != nil {
+		internal.GetMetrics().MessageSent(internal.ServerMessageType(msg.msgType))
+		conn.messagesSent.Add(1)
+		if err := writeNetworkMessage(countingWriter{conn.connection}, msg, options); err != nil {
 			conn.stopped.Store(true)
 			break
 		}
 	}
+	if conn.draining.Load() {
+		conn.DisconnectAndStop()
+	}
 
 	// Trying to prevent some annecessary log messages about full queue upon disconnection.
-	popAllMessages(&conn.writeQueue)
+	conn.writeQueue.close(false)
 }
 
 func (conn *clientConnectionImpl) readerFunc() {
 	reassembler := createMessageReassembler()
+	if options := frameOptionsFromProtocol(&conn.protocol); options.isEnabled() {
+		reassembler.EnableFrameFlags()
+	}
 	buf := make([]byte, 4096)
 	for !conn.stopped.Load() {
+		if conn.heartbeat.Interval > 0 {
+			conn.connection.SetReadDeadline(time.Now().Add(conn.heartbeat.Timeout()))
+		}
 		size, err := conn.connection.Read(buf)
 		if err != nil {
-			if err != io.EOF {
-				log.Printf("Client network error: %v", err)
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				slog.Info("Client has not responded, it will be disconnected", internal.LogKeyAddress,
+					conn.GetAdressString(), "timeout", conn.heartbeat.Timeout())
+			} else if err != io.EOF {
+				slog.Info("Client network error", internal.LogKeyAddress, conn.GetAdressString(), internal.LogKeyError, err)
 			}
 			break
 		}
 
+		internal.GetMetrics().BytesReceived(size)
 		reassembler.ProcessChunk(buf[:size])
 		if reassembler.IsBroken() {
+			internal.GetMetrics().MessageBroken()
 			conn.connection.Close()
 			conn.stopped.Store(true)
 			break
@@ -165,17 +263,64 @@ func (conn *clientConnectionImpl) readerFunc() {
 		for reassembler.HasMessage() {
 			msg, err := parseNetworkMessage(reassembler.PopMessage())
 			if err == nil {
+				internal.GetMetrics().MessageReceived(internal.ClientMessageType(msg.msgType))
+				conn.messagesReceived.Add(1)
+			}
+			if err == nil && conn.heartbeat.Interval > 0 && conn.processHeartbeat(msg) {
+				continue
+			}
+			if err == nil {
+				conn.lastActivity.Store(time.Now().UnixNano())
 				conn.taskRunner.PostTask(func() {
 					conn.delegate.ProcessMessage(msg.id, internal.ClientMessageType(msg.msgType), msg.data)
 				})
 			} else {
-				log.Printf("Error parsing network header: %s", err.Error())
+				slog.Warn("Error parsing network header", internal.LogKeyAddress, conn.GetAdressString(),
+					internal.LogKeyError, err)
 			}
 		}
 	}
+	// Writer and heartbeats are stopped as well, so dead connection doesn't keep them running.
+	conn.DisconnectAndStop()
 	conn.taskRunner.PostTask(conn.delegate.OnDisconnected)
 }
 
+// Pings the client, any received message resets the read deadline, so pongs don't have to be
+// matched with pings.
+func (conn *clientConnectionImpl) heartbeatFunc() {
+	ticker := time.NewTicker(conn.heartbeat.Interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if conn.stopped.Load() {
+			return
+		}
+		conn.SendMessage(0, internal.ServerPing, []byte{})
+	}
+}
+
+// Returns true if message was a heartbeat message, they are not passed to the delegate.
+func (conn *clientConnectionImpl) processHeartbeat(msg networkMessage) bool {
+	switch internal.ClientMessageType(msg.msgType) {
+	case internal.ClientPing:
+		conn.SendMessage(msg.id, internal.ServerPong, []byte{})
+		return true
+	case internal.ClientPong:
+		return true
+	}
+	return false
+}
+
+// Counts bytes written to the socket.
+type countingWriter struct {
+	writer io.Writer
+}
+
+func (w countingWriter) Write(data []byte) (int, error) {
+	size, err := w.writer.Write(data)
+	internal.GetMetrics().BytesSent(size)
+	return size, err
+}
+
 func parseNetworkMessage(data []byte) (networkMessage, error) {
 	var result networkMessage
 	if len(data) < minHeaderLen {
@@ -183,7 +328,7 @@ func parseNetworkMessage(data []byte) (networkMessage, error) {
 	}
 	result.id = binary.BigEndian.Uint64(data[:8])
 	result.msgType = binary.BigEndian.Uint16(data[8:10])
-	// Warning: bytes from 10 to 16 is reserver for future use.
+	// Bytes from 10 to 16 contain frame flags and checksum, they are processed by reassembler.
 	result.data = data[16:]
 	return result, nil
 }
@@ -205,13 +350,3 @@ func readNBytes(conn net.Conn, n uint64) ([]byte, error) {
 
 	return buffer, nil
 }
-
-func popAllMessages(channel *chan networkMessage) {
-	for {
-		select {
-		case <-*channel:
-		default:
-			return
-		}
-	}
-}
@@ -0,0 +1,97 @@
+package communication
+
+import (
+	"encoding/binary"
+	"internal"
+	"net"
+	"testing"
+	"time"
+)
+
+type heartbeatTestDelegate struct {
+	messages     chan internal.ClientMessageType
+	disconnected chan bool
+}
+
+func (d *heartbeatTestDelegate) OnDisconnected() {
+	d.disconnected <- true
+}
+
+func (d *heartbeatTestDelegate) ProcessMessage(id uint64, msgType internal.ClientMessageType, data []byte) {
+	d.messages <- msgType
+}
+
+func (d *heartbeatTestDelegate) OnMessagesDropped(ids []uint64) {}
+
+func readTestMessage(t *testing.T, conn net.Conn) networkMessage {
+	lenBuf, err := readNBytes(conn, 8)
+	if err != nil {
+		t.Fatalf("Unable to read message length: %s", err.Error())
+	}
+	msgBuf, err := readNBytes(conn, binary.BigEndian.Uint64(lenBuf))
+	if err != nil {
+		t.Fatalf("Unable to read message: %s", err.Error())
+	}
+	msg, err := parseNetworkMessage(msgBuf)
+	if err != nil {
+		t.Fatalf("Unable to parse message: %s", err.Error())
+	}
+	return msg
+}
+
+func TestHeartbeat(t *testing.T) {
+	serverSide, clientSide := net.Pipe()
+	defer clientSide.Close()
+
+	connection := createClientConnection(serverSide)
+	connection.heartbeat = internal.HeartbeatSettings{Interval: 20 * time.Millisecond, MissedBeats: 5}
+	delegate := &heartbeatTestDelegate{
+		messages:     make(chan internal.ClientMessageType, 10),
+		disconnected: make(chan bool, 1),
+	}
+	eventLoop := internal.CreateEventLoop(10)
+	connection.SetUp(delegate, eventLoop)
+	go eventLoop.Run()
+	defer eventLoop.Quit()
+	connection.StartHandlingAsync()
+
+	if msg := readTestMessage(t, clientSide); msg.msgType != uint16(internal.ServerPing) {
+		t.Fatalf("Expected ping, got message type %d", msg.msgType)
+	}
+	for _, msgType := range []internal.ClientMessageType{internal.ClientPong, internal.ClientPing} {
+		err := writeNetworkMessage(clientSide, networkMessage{id: 7, msgType: uint16(msgType), data: []byte{}},
+			frameOptions{})
+		if err != nil {
+			t.Fatalf("Unable to write message: %s", err.Error())
+		}
+	}
+	for {
+		msg := readTestMessage(t, clientSide)
+		if msg.msgType == uint16(internal.ServerPong) {
+			if msg.id != 7 {
+				t.Errorf("Pong has wrong id: %d", msg.id)
+			}
+			break
+		}
+	}
+	select {
+	case msgType := <-delegate.messages:
+		t.Errorf("Heartbeat message %d was passed to the delegate", msgType)
+	default:
+	}
+
+	// Client stops responding, but keeps reading, so server writes are not blocked.
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			if _, err := clientSide.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	select {
+	case <-delegate.disconnected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Silent client was not disconnected")
+	}
+}
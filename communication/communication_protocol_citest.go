@@ -52,6 +52,8 @@ func (test *TestConnectionDelegate) OnDisconnected() {
 	test.eventLoop.Quit()
 }
 
+func (test *TestConnectionDelegate) OnMessagesDropped(ids []uint64) {}
+
 func (test *TestConnectionDelegate) ProcessMessage(
 	id uint64, msgType internal.ClientMessageType, data []byte) {
 	if msgType != test.clientMsgType {
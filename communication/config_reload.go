@@ -0,0 +1,368 @@
+package communication
+
+import (
+	"fmt"
+	"internal"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Reads config.json again and applies it to the running server.
+func (s *Server) ReloadConfig() error {
+	config, err := internal.ReadServerConfig(s.appDataDir)
+	if err != nil {
+		return err
+	}
+	return s.applyConfig(config)
+}
+
+// Periodically checks config.json modification time and reloads config if it was changed.
+func (s *Server) WatchConfigFile(interval time.Duration) {
+	configPath := filepath.Join(s.appDataDir, internal.ConfigFileName)
+	lastModified := time.Time{}
+	if stat, err := os.Stat(configPath); err == nil {
+		lastModified = stat.ModTime()
+	}
+
+	go func() {
+		for {
+			time.Sleep(interval)
+			stat, err := os.Stat(configPath)
+			if err != nil || stat.ModTime().Equal(lastModified) {
+				continue
+			}
+			lastModified = stat.ModTime()
+			s.reloadConfigLogged("config file change")
+		}
+	}()
+}
+
+func (s *Server) reloadConfigLogged(reason string) error {
+	slog.Info("Reloading config", "reason", reason)
+	if err := s.ReloadConfig(); err != nil {
+		slog.Error("Config was not reloaded", internal.LogKeyError, err)
+		s.recordAudit(internal.AuditRecord{Event: internal.AuditConfigReloaded,
+			Details: fmt.Sprintf("on %s, failed: %s", reason, err.Error())})
+		return err
+	}
+	slog.Info("Config was reloaded")
+	s.recordAudit(internal.AuditRecord{Event: internal.AuditConfigReloaded, Details: "on " + reason})
+	return nil
+}
+
+// Applies config to the server, only the difference with the running config is applied, so
+// sessions of unaffected clients are kept. Config is either applied completely or not at all.
+func (s *Server) applyConfig(newConfig *internal.Config) error {
+	credentials, err := decodeConfigCredentials(s.serverKey, newConfig)
+	if err != nil {
+		return err
+	}
+
+	s.reloadMutex.Lock()
+	defer s.reloadMutex.Unlock()
+
+	// Match running groups first and create the new ones, nothing is changed if this fails.
+	matched := make(map[*serverGroup]bool)
+	resultGroups := make([]*serverGroup, len(newConfig.Groups))
+	for index := range newConfig.Groups {
+		resultGroups[index] = s.findGroup(&newConfig.Groups[index], credentials[index], matched)
+		if resultGroups[index] != nil {
+			matched[resultGroups[index]] = true
+		}
+	}
+
+	var createdGroups []*serverGroup
+	for index := range newConfig.Groups {
+		if resultGroups[index] != nil {
+			continue
+		}
+		group, err := s.createGroup(newConfig, index)
+		if err != nil {
+			for _, created := range createdGroups {
+				created.group.Shutdown()
+			}
+			return err
+		}
+		resultGroups[index] = group
+		createdGroups = append(createdGroups, group)
+	}
+
+	var removedGroups []*serverGroup
+	for _, group := range s.groups {
+		if !matched[group] {
+			removedGroups = append(removedGroups, group)
+		}
+	}
+	var updates []func()
+	for index, group := range resultGroups {
+		if matched[group] {
+			updates = append(updates, s.planGroupUpdate(group, newConfig, &newConfig.Groups[index]))
+		}
+	}
+
+	secretMapping := make(map[internal.SecretDigest]clientMapping)
+	certMapping := make(map[internal.CertDigest]clientMapping)
+	for groupIndex, group := range resultGroups {
+		groupConfig := &newConfig.Groups[groupIndex]
+		for clientIndex, clientConfig := range groupConfig.Clients {
+			mapping := clientMapping{group: group.group, publicId: clientConfig.PublicId,
+				name: clientConfig.Name, groupName: group.name}
+			clientCredentials := credentials[groupIndex][clientIndex]
+			if clientCredentials.hasSecret {
+				secretMapping[clientCredentials.secret] = mapping
+			}
+			if clientCredentials.hasCert {
+				certMapping[clientCredentials.cert] = mapping
+			}
+		}
+	}
+	if clientAuth := internal.GetClientAuth(newConfig); clientAuth != s.clientAuth {
+		slog.Warn("Client authentication mode will be changed after server restart", "mode", clientAuth)
+	}
+
+	// New credentials are used by connections authenticated after this point, the groups get
+	// the changes after connections which were authenticated before, see handleNewConnection.
+	s.mutex.Lock()
+	for index, group := range resultGroups {
+		group.config = newConfig.Groups[index]
+	}
+	s.secretMapping = secretMapping
+	s.certMapping = certMapping
+	s.groups = resultGroups
+	s.config = newConfig
+	if s.running {
+		for _, group := range createdGroups {
+			group.group.RunAsync()
+		}
+	}
+	s.mutex.Unlock()
+
+	for _, group := range removedGroups {
+		slog.Info("Group was removed", internal.LogKeyGroup, group.name)
+		group.group.Shutdown()
+	}
+	for _, update := range updates {
+		update()
+	}
+	return nil
+}
+
+// Group is matched by name if it has one, otherwise by any common client credentials.
+func (s *Server) findGroup(groupConfig *internal.GroupConfig,
+	credentials []clientCredentials, matched map[*serverGroup]bool) *serverGroup {
+	for _, group := range s.groups {
+		if matched[group] {
+			continue
+		}
+		if len(groupConfig.Name) != 0 || len(group.config.Name) != 0 {
+			if group.config.Name == groupConfig.Name {
+				return group
+			}
+			continue
+		}
+		for _, clientConfig := range group.config.Clients {
+			oldCredentials, _ := decodeClientCredentials(s.serverKey, &clientConfig)
+			for _, newCredentials := range credentials {
+				if oldCredentials.intersects(&newCredentials) {
+					return group
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Server) createGroup(config *internal.Config, index int) (*serverGroup, error) {
+	groupConfig := &config.Groups[index]
+	fileSpool, err := internal.CreateFileSpool(
+		filepath.Join(s.spoolDir(), fmt.Sprintf("group%d", s.groupsCounter)), groupConfig.FileQuota)
+	if err != nil {
+		return nil, err
+	}
+	name := groupConfig.Name
+	// Unnamed groups are stored by their index, as they are addressed in the commands.
+	storageKey := name
+	if len(name) == 0 {
+		name = fmt.Sprintf("group%d", s.groupsCounter)
+		storageKey = fmt.Sprintf("#%d", index)
+	}
+	s.groupsCounter++
+
+	newGroup := internal.CreateClientGroup(internal.GroupSettings{
+		Name:          name,
+		Storage:       s.storage,
+		StorageKey:    storageKey,
+		FileSpool:     fileSpool,
+		SessionPolicy: internal.GetSessionPolicy(config),
+		Audit:         s.audit,
+		Outbox:        internal.ResolveOutboxSettings(config.Outbox),
+	})
+	for index := range groupConfig.Clients {
+		clientConfig := &groupConfig.Clients[index]
+		limits := internal.ResolveClientLimits(config.Limits, groupConfig.Limits, clientConfig.Limits)
+		if err := newGroup.AddClient(internal.CreateClient(newGroup, clientConfig.PublicId, clientConfig.Name, limits)); err != nil {
+			newGroup.Shutdown()
+			return nil, err
+		}
+	}
+	return &serverGroup{group: newGroup, config: *groupConfig, name: name}, nil
+}
+
+// Finds changes of the running group, the returned function applies them to the group. It must
+// be called without the server mutex, as it waits for the group event loop.
+func (s *Server) planGroupUpdate(group *serverGroup, config *internal.Config,
+	groupConfig *internal.GroupConfig) func() {
+	var changes []func()
+	oldClients := make(map[uint64]*internal.ClientConfig)
+	for index := range group.config.Clients {
+		oldClients[group.config.Clients[index].PublicId] = &group.config.Clients[index]
+	}
+
+	for index := range groupConfig.Clients {
+		clientConfig := &groupConfig.Clients[index]
+		limits := internal.ResolveClientLimits(config.Limits, groupConfig.Limits, clientConfig.Limits)
+		oldClient, exists := oldClients[clientConfig.PublicId]
+		if !exists {
+			changes = append(changes, func() {
+				client := internal.CreateClient(group.group, clientConfig.PublicId, clientConfig.Name, limits)
+				if err := group.group.AddClient(client); err != nil {
+					slog.Error("Unable to add client", internal.LogKeyGroup, group.name,
+						internal.LogKeyClientId, clientConfig.PublicId, internal.LogKeyError, err)
+					return
+				}
+				slog.Info("Client was added", internal.LogKeyGroup, group.name,
+					internal.LogKeyClientId, clientConfig.PublicId, internal.LogKeyClient, clientConfig.Name)
+			})
+			continue
+		}
+		delete(oldClients, clientConfig.PublicId)
+
+		oldCredentials, _ := decodeClientCredentials(s.serverKey, oldClient)
+		newCredentials, _ := decodeClientCredentials(s.serverKey, clientConfig)
+		if oldCredentials.isRevokedBy(&newCredentials) {
+			changes = append(changes, func() {
+				slog.Info("Client credentials were changed, client will be disconnected", internal.LogKeyGroup, group.name,
+					internal.LogKeyClientId, clientConfig.PublicId, internal.LogKeyClient, clientConfig.Name)
+				group.group.DisconnectClient(clientConfig.PublicId)
+			})
+		}
+
+		oldLimits := internal.ResolveClientLimits(s.config.Limits, group.config.Limits, oldClient.Limits)
+		if oldClient.Name != clientConfig.Name || oldLimits != limits {
+			changes = append(changes, func() {
+				group.group.UpdateClient(clientConfig.PublicId, clientConfig.Name, limits)
+			})
+		}
+	}
+
+	for id := range oldClients {
+		changes = append(changes, func() { group.group.RemoveClient(id) })
+	}
+	if group.config.FileQuota != groupConfig.FileQuota {
+		changes = append(changes, func() { group.group.SetFileQuota(groupConfig.FileQuota) })
+	}
+	if policy := internal.GetSessionPolicy(config); internal.GetSessionPolicy(s.config) != policy {
+		changes = append(changes, func() { group.group.SetSessionPolicy(policy) })
+	}
+	oldOutbox := internal.ResolveOutboxSettings(s.config.Outbox)
+	if outbox := internal.ResolveOutboxSettings(config.Outbox); outbox != oldOutbox {
+		changes = append(changes, func() { group.group.SetOutboxSettings(outbox) })
+	}
+	return func() {
+		for _, change := range changes {
+			change()
+		}
+	}
+}
+
+func (s *Server) spoolDir() string {
+	return filepath.Join(s.appDataDir, "spool")
+}
+
+// Credentials the client may authenticate with.
+type clientCredentials struct {
+	hasSecret bool
+	secret    internal.SecretDigest
+	hasCert   bool
+	cert      internal.CertDigest
+}
+
+func (c *clientCredentials) intersects(other *clientCredentials) bool {
+	return (c.hasSecret && other.hasSecret && c.secret == other.secret) ||
+		(c.hasCert && other.hasCert && c.cert == other.cert)
+}
+
+// Credentials are revoked if any of them was changed or removed, added ones don't revoke anything.
+func (c *clientCredentials) isRevokedBy(newCredentials *clientCredentials) bool {
+	return (c.hasSecret && (!newCredentials.hasSecret || c.secret != newCredentials.secret)) ||
+		(c.hasCert && (!newCredentials.hasCert || c.cert != newCredentials.cert))
+}
+
+func decodeClientCredentials(serverKey []byte, clientConfig *internal.ClientConfig) (clientCredentials, error) {
+	var result clientCredentials
+	var err error
+	if len(clientConfig.Secret) != 0 || len(clientConfig.SecretHash) != 0 {
+		result.hasSecret = true
+		if result.secret, err = internal.ClientSecretDigest(serverKey, clientConfig); err != nil {
+			return result, err
+		}
+	}
+	if len(clientConfig.CertFingerprint) != 0 {
+		result.hasCert = true
+		if result.cert, err = internal.DecodeFingerprint(clientConfig.CertFingerprint); err != nil {
+			return result, err
+		}
+	}
+	if !result.hasSecret && !result.hasCert {
+		return result, fmt.Errorf("client '%s' has neither secret nor certificate", clientConfig.Name)
+	}
+	return result, nil
+}
+
+// Decodes credentials of all clients and checks that config may be applied.
+func decodeConfigCredentials(serverKey []byte, config *internal.Config) ([][]clientCredentials, error) {
+	result := make([][]clientCredentials, len(config.Groups))
+	knownSecrets := make(map[internal.SecretDigest]bool)
+	knownCerts := make(map[internal.CertDigest]bool)
+	if err := internal.ValidateLimitsConfig(config.Limits); err != nil {
+		return nil, err
+	}
+	for groupIndex, groupConfig := range config.Groups {
+		if err := internal.ValidateLimitsConfig(groupConfig.Limits); err != nil {
+			return nil, fmt.Errorf("limits of group %d are not valid: %w", groupIndex, err)
+		}
+		knownIds := make(map[uint64]bool)
+		for _, clientConfig := range groupConfig.Clients {
+			if err := internal.ValidateLimitsConfig(clientConfig.Limits); err != nil {
+				return nil, fmt.Errorf("limits of client '%s' are not valid: %w", clientConfig.Name, err)
+			}
+			credentials, err := decodeClientCredentials(serverKey, &clientConfig)
+			if err != nil {
+				return nil, err
+			}
+			if credentials.hasSecret && knownSecrets[credentials.secret] {
+				return nil, fmt.Errorf("initialization error, there was multiple clients " +
+					"with the same secret ID in the config")
+			}
+			if credentials.hasCert && knownCerts[credentials.cert] {
+				return nil, fmt.Errorf("initialization error, there was multiple clients " +
+					"with the same certificate in the config")
+			}
+			if knownIds[clientConfig.PublicId] {
+				return nil, fmt.Errorf("initialization error, there was multiple clients "+
+					"with the same public ID %d in the group", clientConfig.PublicId)
+			}
+			if credentials.hasSecret {
+				knownSecrets[credentials.secret] = true
+			}
+			if credentials.hasCert {
+				knownCerts[credentials.cert] = true
+			}
+			knownIds[clientConfig.PublicId] = true
+			result[groupIndex] = append(result[groupIndex], credentials)
+		}
+	}
+	return result, nil
+}
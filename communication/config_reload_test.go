@@ -0,0 +1,198 @@
+package communication
+
+import (
+	"encoding/base64"
+	"internal"
+	"testing"
+)
+
+func makeTestSecret(value byte) string {
+	var secret [64]byte
+	secret[0] = value
+	return base64.StdEncoding.EncodeToString(secret[:])
+}
+
+func createTestServer(t *testing.T) *Server {
+	return &Server{
+		appDataDir:    t.TempDir(),
+		serverKey:     []byte("test server key"),
+		secretMapping: make(map[internal.SecretDigest]clientMapping),
+		clientAuth:    internal.ClientAuthSecret,
+		config:        &internal.Config{},
+	}
+}
+
+func TestApplyConfig(t *testing.T) {
+	server := createTestServer(t)
+	err := server.applyConfig(&internal.Config{Groups: []internal.GroupConfig{
+		{Clients: []internal.ClientConfig{
+			{Secret: makeTestSecret(1), PublicId: 1, Name: "name1"},
+			{Secret: makeTestSecret(2), PublicId: 2, Name: "name2"},
+		}},
+	}})
+	if err != nil {
+		t.Fatalf("Unable to apply initial config: %s", err.Error())
+	}
+	group := server.groups[0].group
+
+	err = server.applyConfig(&internal.Config{Groups: []internal.GroupConfig{
+		{Clients: []internal.ClientConfig{
+			{Secret: makeTestSecret(1), PublicId: 1, Name: "renamed1"},
+			{Secret: makeTestSecret(3), PublicId: 3, Name: "name3"},
+		}},
+		{Name: "second", Clients: []internal.ClientConfig{
+			{Secret: makeTestSecret(4), PublicId: 4, Name: "name4"},
+		}},
+	}})
+	if err != nil {
+		t.Fatalf("Unable to apply new config: %s", err.Error())
+	}
+
+	if len(server.groups) != 2 || server.groups[0].group != group {
+		t.Fatal("Running group was not preserved")
+	}
+	if data := group.GetClientSyncData(1); data == nil || data.Name != "renamed1" {
+		t.Error("Client was not renamed")
+	}
+	if group.GetClientSyncData(2) != nil {
+		t.Error("Client was not removed")
+	}
+	if group.GetClientSyncData(3) == nil {
+		t.Error("Client was not added")
+	}
+
+	secret, _ := internal.DecodeSecret(makeTestSecret(2))
+	if _, exists := server.findSecretMapping(internal.HashSecret(server.serverKey, secret)); exists {
+		t.Error("Secret of removed client was not revoked")
+	}
+	secret, _ = internal.DecodeSecret(makeTestSecret(4))
+	if mapping, exists := server.findSecretMapping(internal.HashSecret(server.serverKey, secret)); !exists || mapping.group != server.groups[1].group {
+		t.Error("Secret of new group client was not added")
+	}
+}
+
+func TestApplyConfigDuplicatedSecret(t *testing.T) {
+	server := createTestServer(t)
+	err := server.applyConfig(&internal.Config{Groups: []internal.GroupConfig{
+		{Clients: []internal.ClientConfig{{Secret: makeTestSecret(1), PublicId: 1, Name: "name1"}}},
+	}})
+	if err != nil {
+		t.Fatalf("Unable to apply initial config: %s", err.Error())
+	}
+
+	err = server.applyConfig(&internal.Config{Groups: []internal.GroupConfig{
+		{Clients: []internal.ClientConfig{
+			{Secret: makeTestSecret(1), PublicId: 1, Name: "name1"},
+			{Secret: makeTestSecret(1), PublicId: 2, Name: "name2"},
+		}},
+	}})
+	if err == nil {
+		t.Fatal("Config with duplicated secrets was applied")
+	}
+	if len(server.config.Groups[0].Clients) != 1 {
+		t.Error("Running config was changed by invalid config")
+	}
+}
+
+func TestApplyConfigPublicIdInTwoGroups(t *testing.T) {
+	server := createTestServer(t)
+	storage, err := internal.OpenJournalStorage(t.TempDir())
+	if err != nil {
+		t.Fatalf("Unable to open storage: %s", err.Error())
+	}
+	defer storage.Close()
+	server.storage = storage
+	err = server.applyConfig(&internal.Config{Groups: []internal.GroupConfig{
+		{Clients: []internal.ClientConfig{{Secret: makeTestSecret(1), PublicId: 1, Name: "name1"}}},
+		{Name: "second", Clients: []internal.ClientConfig{{Secret: makeTestSecret(2), PublicId: 1, Name: "name2"}}},
+	}})
+	if err != nil {
+		t.Fatalf("Config with public ID used in two groups was not applied: %s", err.Error())
+	}
+
+	if err = server.groups[0].group.PushText(1, internal.TextEntry{Text: "text"}); err != nil {
+		t.Fatalf("Unable to push text: %s", err.Error())
+	}
+	if history := storage.GetHistory("#0", 1); len(history) != 1 || history[0].Text != "text" {
+		t.Errorf("Text was not stored for the unnamed group: %v", history)
+	}
+	if history := storage.GetHistory("second", 1); len(history) != 0 {
+		t.Errorf("Text was stored for the client of another group: %v", history)
+	}
+}
+
+func TestApplyConfigHashedSecrets(t *testing.T) {
+	server := createTestServer(t)
+	err := server.applyConfig(&internal.Config{Groups: []internal.GroupConfig{
+		{Clients: []internal.ClientConfig{{Secret: makeTestSecret(1), PublicId: 1, Name: "name1"}}},
+	}})
+	if err != nil {
+		t.Fatalf("Unable to apply initial config: %s", err.Error())
+	}
+	group := server.groups[0].group
+
+	hashedClient := internal.ClientConfig{PublicId: 1, Name: "name1"}
+	internal.SetClientSecret(server.serverKey, &hashedClient, makeTestSecret(1))
+	err = server.applyConfig(&internal.Config{Groups: []internal.GroupConfig{
+		{Clients: []internal.ClientConfig{hashedClient}},
+	}})
+	if err != nil {
+		t.Fatalf("Unable to apply hashed config: %s", err.Error())
+	}
+	if server.groups[0].group != group {
+		t.Error("Group was not preserved after secrets were hashed")
+	}
+
+	secret, _ := internal.DecodeSecret(makeTestSecret(1))
+	if _, exists := server.findSecretMapping(internal.HashSecret(server.serverKey, secret)); !exists {
+		t.Error("Client is not able to authenticate with hashed secret")
+	}
+	secret, _ = internal.DecodeSecret(makeTestSecret(2))
+	if _, exists := server.findSecretMapping(internal.HashSecret(server.serverKey, secret)); exists {
+		t.Error("Client with wrong secret was authenticated")
+	}
+}
+
+// Reports whether the server mutex was held while the client was added.
+type lockCheckingGroup struct {
+	internal.ClientGroup
+	server *Server
+	locked bool
+}
+
+func (g *lockCheckingGroup) AddClient(client internal.Client) error {
+	if g.server.mutex.TryLock() {
+		g.server.mutex.Unlock()
+	} else {
+		g.locked = true
+	}
+	return g.ClientGroup.AddClient(client)
+}
+
+func TestApplyConfigChangesGroupsWithoutMutex(t *testing.T) {
+	server := createTestServer(t)
+	config := &internal.Config{Groups: []internal.GroupConfig{
+		{Clients: []internal.ClientConfig{{Secret: makeTestSecret(1), PublicId: 1, Name: "name1"}}},
+	}}
+	if err := server.applyConfig(config); err != nil {
+		t.Fatalf("Unable to apply initial config: %s", err.Error())
+	}
+	group := &lockCheckingGroup{ClientGroup: server.groups[0].group, server: server}
+	server.groups[0].group = group
+
+	err := server.applyConfig(&internal.Config{Groups: []internal.GroupConfig{
+		{Clients: []internal.ClientConfig{
+			{Secret: makeTestSecret(1), PublicId: 1, Name: "name1"},
+			{Secret: makeTestSecret(2), PublicId: 2, Name: "name2"},
+		}},
+	}})
+	if err != nil {
+		t.Fatalf("Unable to apply new config: %s", err.Error())
+	}
+	if group.GetClientSyncData(2) == nil {
+		t.Fatal("Client was not added")
+	}
+	if group.locked {
+		t.Error("Client was added under the server mutex")
+	}
+}
@@ -0,0 +1,123 @@
+package communication
+
+import (
+	"errors"
+	"internal"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+const enrollmentRateWindow = time.Minute
+const maxEnrollmentsPerAddress = 5
+const maxEnrollmentsTotal = 20
+
+var errTooManyEnrollments = errors.New("too many enrollment attempts")
+
+// Limits enrollment attempts per remote address and in total, so short codes can't be guessed.
+type enrollmentLimiter struct {
+	mutex       sync.Mutex
+	attempts    map[string][]time.Time
+	allAttempts []time.Time
+}
+
+func (l *enrollmentLimiter) allow(address string, now time.Time) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.attempts == nil {
+		l.attempts = make(map[string][]time.Time)
+	}
+
+	for key, times := range l.attempts {
+		if times = dropOldAttempts(times, now); len(times) == 0 {
+			delete(l.attempts, key)
+		} else {
+			l.attempts[key] = times
+		}
+	}
+	l.allAttempts = dropOldAttempts(l.allAttempts, now)
+	if len(l.allAttempts) >= maxEnrollmentsTotal || len(l.attempts[address]) >= maxEnrollmentsPerAddress {
+		return false
+	}
+	l.attempts[address] = append(l.attempts[address], now)
+	l.allAttempts = append(l.allAttempts, now)
+	return true
+}
+
+func dropOldAttempts(times []time.Time, now time.Time) []time.Time {
+	for len(times) != 0 && now.Sub(times[0]) >= enrollmentRateWindow {
+		times = times[1:]
+	}
+	return times
+}
+
+// Enrolled client receives its public ID and secret, then it has to reconnect with introduction.
+func (s *Server) handleEnrollment(connection *clientConnectionImpl, msg networkMessage) {
+	defer connection.DisconnectAndStop()
+
+	var response []byte
+	publicId, secret, err := s.enroll(connection.GetAdressString(), msg.data)
+	record := internal.AuditRecord{Event: internal.AuditEnrollment, ClientId: publicId,
+		Address: connection.GetAdressString(), Details: "enrolled"}
+	if err != nil {
+		record.Details = err.Error()
+	}
+	s.recordAudit(record)
+	switch {
+	case err == nil:
+		slog.Info("Client was enrolled", internal.LogKeyAddress, connection.GetAdressString(),
+			internal.LogKeyClientId, publicId)
+		response = internal.SerializeEnrollmentResult(publicId, secret)
+	case errors.Is(err, errTooManyEnrollments):
+		slog.Warn("Enrollment was rejected", internal.LogKeyAddress, connection.GetAdressString(),
+			internal.LogKeyError, err)
+		response = internal.SerializeError("Too many enrollment attempts, try again later.")
+	case errors.Is(err, internal.ErrEnrollmentDisabled):
+		slog.Warn("Enrollment was rejected", internal.LogKeyAddress, connection.GetAdressString(),
+			internal.LogKeyError, err)
+		response = internal.SerializeError("Enrollment is disabled, client certificate is required.")
+	case errors.Is(err, internal.ErrUnknownEnrollmentCode):
+		slog.Warn("Enrollment was rejected", internal.LogKeyAddress, connection.GetAdressString(),
+			internal.LogKeyError, err)
+		response = internal.SerializeError("Enrollment code is wrong or expired.")
+	default:
+		slog.Error("Enrollment failed", internal.LogKeyAddress, connection.GetAdressString(), internal.LogKeyError, err)
+		response = internal.SerializeError("Enrollment failed.")
+	}
+
+	err = connection.writeMessageSync(
+		networkMessage{id: msg.id, msgType: uint16(internal.ServerResponse), data: response})
+	if err != nil {
+		slog.Warn("Unable to send enrollment response", internal.LogKeyAddress, connection.GetAdressString(),
+			internal.LogKeyError, err)
+	}
+}
+
+func (s *Server) enroll(address string, data []byte) (uint64, string, error) {
+	if len(s.appDataDir) == 0 {
+		return 0, "", errors.New("enrollment is not supported by this server")
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	if !s.enrollmentLimiter.allow(host, time.Now()) {
+		return 0, "", errTooManyEnrollments
+	}
+	code, name, err := internal.DeserializeEnrollment(data)
+	if err != nil {
+		return 0, "", err
+	}
+
+	s.enrollmentMutex.Lock()
+	defer s.enrollmentMutex.Unlock()
+	config, publicId, secret, err := internal.EnrollClient(s.appDataDir, s.serverKey, code, name)
+	if err != nil {
+		return 0, "", err
+	}
+	if err = s.applyConfig(config); err != nil {
+		return 0, "", err
+	}
+	return publicId, secret, nil
+}
@@ -0,0 +1,64 @@
+package communication
+
+import (
+	"encoding/json"
+	"errors"
+	"internal"
+	"testing"
+	"time"
+)
+
+func TestEnrollment(t *testing.T) {
+	server := createTestServer(t)
+	config := &internal.Config{Groups: []internal.GroupConfig{{Name: "home"}}}
+	if err := internal.WriteServerConfig(server.appDataDir, config); err != nil {
+		t.Fatalf("Unable to write config: %s", err.Error())
+	}
+	if err := server.applyConfig(config); err != nil {
+		t.Fatalf("Unable to apply config: %s", err.Error())
+	}
+	code, err := internal.CreateEnrollmentCode(server.appDataDir, server.serverKey, "home", time.Minute)
+	if err != nil {
+		t.Fatalf("Unable to create enrollment code: %s", err.Error())
+	}
+
+	request, _ := json.Marshal(map[string]string{"Code": code, "Name": "laptop"})
+	publicId, secret, err := server.enroll("10.0.0.1:1000", request)
+	if err != nil {
+		t.Fatalf("Client was not enrolled: %s", err.Error())
+	}
+	if data := server.groups[0].group.GetClientSyncData(publicId); data == nil || data.Name != "laptop" {
+		t.Error("Enrolled client was not added to the running group")
+	}
+	decoded, _ := internal.DecodeSecret(secret)
+	if mapping, exists := server.findSecretMapping(internal.HashSecret(server.serverKey, decoded)); !exists ||
+		mapping.publicId != publicId {
+		t.Error("Enrolled client is not able to authenticate")
+	}
+
+	for attempt := 0; attempt < maxEnrollmentsPerAddress; attempt++ {
+		server.enroll("10.0.0.2:1000", request)
+	}
+	if _, _, err = server.enroll("10.0.0.2:2000", request); err != errTooManyEnrollments {
+		t.Errorf("Enrollment attempts were not limited: %v", err)
+	}
+	if _, _, err = server.enroll("10.0.0.3:1000", request); !errors.Is(err, internal.ErrUnknownEnrollmentCode) {
+		t.Errorf("Used code was not rejected as unknown: %v", err)
+	}
+}
+
+func TestEnrollmentInCertificateMode(t *testing.T) {
+	server := createTestServer(t)
+	config := &internal.Config{ClientAuth: internal.ClientAuthCertificate, Groups: []internal.GroupConfig{{Name: "home"}}}
+	if err := internal.WriteServerConfig(server.appDataDir, config); err != nil {
+		t.Fatalf("Unable to write config: %s", err.Error())
+	}
+	code, err := internal.CreateEnrollmentCode(server.appDataDir, server.serverKey, "home", time.Minute)
+	if err != nil {
+		t.Fatalf("Unable to create enrollment code: %s", err.Error())
+	}
+	request, _ := json.Marshal(map[string]string{"Code": code, "Name": "laptop"})
+	if _, _, err = server.enroll("10.0.0.1:1000", request); !errors.Is(err, internal.ErrEnrollmentDisabled) {
+		t.Errorf("Client was enrolled with secret in certificate mode: %v", err)
+	}
+}
@@ -0,0 +1,166 @@
+package communication
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"internal"
+	"io"
+)
+
+// Flags are stored in header bytes 18-20 (10-12 after the length), CRC32C of the frame payload
+// is stored in bytes 20-24 (12-16 after the length). Flags are used only if corresponding
+// capabilities were negotiated, otherwise these bytes are zero.
+const (
+	// Payload is compressed with deflate, for chunked message the flag is set on every frame and
+	// applies to the concatenated payload.
+	frameFlagCompressed uint16 = 1 << 0
+	// Header contains CRC32C of the frame payload.
+	frameFlagChecksum uint16 = 1 << 1
+	// Message continues in the next frame, frames of one message are never interleaved with others.
+	frameFlagContinuation uint16 = 1 << 2
+)
+
+const frameChunkSize = 1024 * 1024
+
+// Smaller payloads are not worth compressing.
+const minCompressedSize = 1024
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+type frameOptions struct {
+	compression bool
+	checksum    bool
+	chunking    bool
+}
+
+func frameOptionsFromProtocol(protocol *internal.ProtocolInfo) frameOptions {
+	return frameOptions{
+		compression: protocol.HasCapability(internal.CapabilityCompression),
+		checksum:    protocol.HasCapability(internal.CapabilityChecksum),
+		chunking:    protocol.HasCapability(internal.CapabilityChunking),
+	}
+}
+
+func (o *frameOptions) isEnabled() bool {
+	return o.compression || o.checksum || o.chunking
+}
+
+func writeNetworkMessage(connection io.Writer, msg networkMessage, options frameOptions) error {
+	payload := msg.data
+	var flags uint16
+	if options.compression && len(payload) >= minCompressedSize {
+		if compressed, err := compressPayload(payload); err == nil && len(compressed) < len(payload) {
+			payload = compressed
+			flags |= frameFlagCompressed
+		}
+	}
+
+	for {
+		chunk := payload
+		frameFlags := flags
+		if options.chunking && len(chunk) > frameChunkSize {
+			chunk = payload[:frameChunkSize]
+			frameFlags |= frameFlagContinuation
+		}
+		payload = payload[len(chunk):]
+
+		var prefixBuffer [messageHeaderSize]byte
+		binary.BigEndian.PutUint64(prefixBuffer[:], uint64(16+len(chunk)))
+		binary.BigEndian.PutUint64(prefixBuffer[8:], msg.id)
+		binary.BigEndian.PutUint16(prefixBuffer[16:18], msg.msgType)
+		if options.checksum {
+			frameFlags |= frameFlagChecksum
+			binary.BigEndian.PutUint32(prefixBuffer[20:24], crc32.Checksum(chunk, crc32cTable))
+		}
+		binary.BigEndian.PutUint16(prefixBuffer[18:20], frameFlags)
+
+		if _, err := connection.Write(prefixBuffer[:]); err != nil {
+			return err
+		}
+		if _, err := connection.Write(chunk); err != nil {
+			return err
+		}
+		if frameFlags&frameFlagContinuation == 0 {
+			return nil
+		}
+	}
+}
+
+func compressPayload(payload []byte) ([]byte, error) {
+	var buffer bytes.Buffer
+	writer, err := flate.NewWriter(&buffer, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = writer.Write(payload); err != nil {
+		return nil, err
+	}
+	if err = writer.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func decompressPayload(payload []byte) ([]byte, error) {
+	reader := flate.NewReader(bytes.NewReader(payload))
+	defer reader.Close()
+	result, err := io.ReadAll(io.LimitReader(reader, maxMessageLen+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(result) > maxMessageLen {
+		return nil, errors.New("decompressed message is too long")
+	}
+	return result, nil
+}
+
+// Collects frames of a message, checks and decompresses their payload. Frame is the message data
+// after the length, result has the same layout with flags and checksum cleared.
+type frameDecoder struct {
+	partial []byte
+}
+
+// Returns nil message if frame is not the last one of the message.
+func (d *frameDecoder) processFrame(frame []byte) ([]byte, error) {
+	if len(frame) < minHeaderLen {
+		// Message is passed as is, parsing will report it.
+		return frame, nil
+	}
+	flags := binary.BigEndian.Uint16(frame[10:12])
+	payload := frame[minHeaderLen:]
+	if flags&frameFlagChecksum != 0 &&
+		crc32.Checksum(payload, crc32cTable) != binary.BigEndian.Uint32(frame[12:16]) {
+		return nil, fmt.Errorf("checksum mismatch for message %d", binary.BigEndian.Uint64(frame[:8]))
+	}
+
+	if d.partial != nil {
+		if !bytes.Equal(d.partial[:10], frame[:10]) {
+			return nil, errors.New("frames of different messages were interleaved")
+		}
+		if len(d.partial)+len(payload) > maxMessageLen {
+			return nil, errors.New("chunked message is too long")
+		}
+		d.partial = append(d.partial, payload...)
+	} else {
+		d.partial = append([]byte{}, frame...)
+	}
+	if flags&frameFlagContinuation != 0 {
+		return nil, nil
+	}
+
+	message := d.partial
+	d.partial = nil
+	clear(message[10:minHeaderLen])
+	if flags&frameFlagCompressed != 0 {
+		decompressed, err := decompressPayload(message[minHeaderLen:])
+		if err != nil {
+			return nil, fmt.Errorf("unable to decompress message: %w", err)
+		}
+		message = append(message[:minHeaderLen], decompressed...)
+	}
+	return message, nil
+}
@@ -4,7 +4,8 @@ import (
 	"bytes"
 	"container/list"
 	"encoding/binary"
-	"fmt"
+	"internal"
+	"log/slog"
 )
 
 const maxMessageLen = 1 * 1024 * 1024 * 1024
@@ -15,6 +16,8 @@ type messageReassembler struct {
 	nextMessageSize uint64
 	readingLen      bool
 	isBroken        bool
+	// Set if frame flags were negotiated for the connection.
+	frames *frameDecoder
 }
 
 func createMessageReassembler() messageReassembler {
@@ -26,6 +29,11 @@ func createMessageReassembler() messageReassembler {
 	}
 }
 
+// Enables processing of the flags in the frame header: checksums, compression and chunking.
+func (a *messageReassembler) EnableFrameFlags() {
+	a.frames = &frameDecoder{}
+}
+
 func (a *messageReassembler) ProcessChunk(data []byte) {
 	if a.isBroken {
 		panic("Trying to process chunk after reassembler is broken")
@@ -45,7 +53,7 @@ func (a *messageReassembler) ProcessChunk(data []byte) {
 		// Buffer leftover length is constrained by message lendgth, which is constrained by
 		// maxMessageLen, so this situation must not happen.
 		a.isBroken = true
-		fmt.Printf("buffer leftover length was too long '%d'", a.buffer.Len())
+		slog.Warn("Buffer leftover is too long", "length", a.buffer.Len())
 	}
 }
 
@@ -93,6 +101,17 @@ func (a *messageReassembler) tryReadMessage() bool {
 	}
 	a.nextMessageSize = 0
 	a.readingLen = true
+	if a.frames != nil {
+		msgData, err = a.frames.processFrame(msgData)
+		if err != nil {
+			slog.Warn("Broken message frame", internal.LogKeyError, err)
+			a.isBroken = true
+			return false
+		}
+		if msgData == nil {
+			return true
+		}
+	}
 	a.messages.PushBack(msgData)
 	return true
 }
@@ -2,6 +2,7 @@ package communication
 
 import (
 	"bytes"
+	"crypto/rand"
 	"encoding/binary"
 	"testing"
 )
@@ -77,3 +78,47 @@ func createTestBuffer(desired_data_len uint64) TestData {
 	}
 	return result
 }
+
+func TestFrameFlags(t *testing.T) {
+	options := frameOptions{compression: true, checksum: true, chunking: true}
+	compressible := bytes.Repeat([]byte("clipboard text "), 10000)
+	incompressible := make([]byte, 2*frameChunkSize+100)
+	rand.Read(incompressible)
+
+	var stream bytes.Buffer
+	writeNetworkMessage(&stream, networkMessage{id: 1, msgType: 260, data: compressible}, options)
+	if stream.Len() >= len(compressible) {
+		t.Error("Message was not compressed")
+	}
+	writeNetworkMessage(&stream, networkMessage{id: 2, msgType: 256, data: incompressible}, options)
+	writeNetworkMessage(&stream, networkMessage{id: 3, msgType: 256, data: []byte{}}, options)
+
+	assembler := createMessageReassembler()
+	assembler.EnableFrameFlags()
+	assembler.ProcessChunk(stream.Bytes())
+	for _, expected := range []networkMessage{
+		{id: 1, msgType: 260, data: compressible},
+		{id: 2, msgType: 256, data: incompressible},
+		{id: 3, msgType: 256, data: []byte{}},
+	} {
+		if !assembler.HasMessage() {
+			t.Fatalf("Message %d was not reassembled", expected.id)
+		}
+		msg, err := parseNetworkMessage(assembler.PopMessage())
+		if err != nil || msg.id != expected.id || msg.msgType != expected.msgType ||
+			!bytes.Equal(msg.data, expected.data) {
+			t.Fatalf("Message %d was reassembled incorrectly", expected.id)
+		}
+	}
+
+	stream.Reset()
+	writeNetworkMessage(&stream, networkMessage{id: 4, msgType: 260, data: []byte("some text")}, options)
+	corrupted := stream.Bytes()
+	corrupted[len(corrupted)-1]++
+	assembler = createMessageReassembler()
+	assembler.EnableFrameFlags()
+	assembler.ProcessChunk(corrupted)
+	if !assembler.IsBroken() || assembler.HasMessage() {
+		t.Error("Corrupted message was accepted")
+	}
+}
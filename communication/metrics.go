@@ -0,0 +1,39 @@
+package communication
+
+import (
+	"fmt"
+	"internal"
+	"log/slog"
+	"net/http"
+)
+
+// Serves metrics in Prometheus text format until the process exits.
+func (s *Server) serveMetrics(address string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if err := internal.GetMetrics().WritePrometheus(writer, s.getGroupMetrics()); err != nil {
+			slog.Warn("Unable to write metrics", internal.LogKeyError, err)
+		}
+	})
+	slog.Info("Metrics are exported", "url", fmt.Sprintf("http://%s/metrics", address))
+	if err := http.ListenAndServe(address, mux); err != nil {
+		slog.Error("Metrics listener has stopped", internal.LogKeyError, err)
+	}
+}
+
+func (s *Server) getGroupMetrics() []internal.GroupMetrics {
+	s.mutex.Lock()
+	groups := make([]*serverGroup, len(s.groups))
+	copy(groups, s.groups)
+	s.mutex.Unlock()
+
+	// Counts are taken without waiting for event loops, so a busy group doesn't stall scraping.
+	var result []internal.GroupMetrics
+	for _, group := range groups {
+		metrics := internal.GroupMetrics{Name: group.name}
+		metrics.Clients, metrics.ConnectedClients = group.group.GetClientCounts()
+		result = append(result, metrics)
+	}
+	return result
+}
@@ -0,0 +1,181 @@
+package communication
+
+import (
+	"internal"
+	"log/slog"
+	"slices"
+	"sync"
+)
+
+// Queue depth is logged when it crosses these fractions of the queue size, in both directions.
+var queueDepthThresholds = []float64{0.5, 1}
+
+// Messages waiting to be written to the socket. Overflow policy is applied when the queue is full.
+type sendQueue struct {
+	mutex    sync.Mutex
+	messages []networkMessage
+	bytes    uint64
+	closed   bool
+	// Signalled when messages are added or the queue is closed.
+	wakeup   chan struct{}
+	settings internal.WriteQueueSettings
+	name     string
+
+	// Statistics, they are logged when queue depth crosses thresholds.
+	level     int
+	maxDepth  int
+	coalesced uint64
+	spilled   uint64
+	// IDs of coalesced messages which were not taken yet.
+	dropped []uint64
+}
+
+func createSendQueue(settings internal.WriteQueueSettings) *sendQueue {
+	return &sendQueue{
+		wakeup:   make(chan struct{}, 1),
+		settings: settings,
+	}
+}
+
+// Returns false if the message doesn't fit into the queue, so connection must be closed.
+func (q *sendQueue) push(msg networkMessage) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.closed {
+		return true
+	}
+
+	if len(q.messages) >= q.settings.Size && !q.makeRoom(msg) {
+		slog.Warn("Write queue is full", internal.LogKeyAddress, q.name, "messages", len(q.messages),
+			"bytes", q.bytes, "policy", q.settings.OverflowPolicy)
+		return false
+	}
+	q.messages = append(q.messages, msg)
+	q.bytes += uint64(len(msg.data))
+	internal.GetMetrics().WriteQueueChanged(1)
+	q.maxDepth = max(q.maxDepth, len(q.messages))
+	q.logDepthChange()
+
+	select {
+	case q.wakeup <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// Waits for the next message. Returns false when the queue is closed and has no messages.
+func (q *sendQueue) pop() (networkMessage, bool) {
+	for {
+		q.mutex.Lock()
+		if len(q.messages) != 0 {
+			msg := q.messages[0]
+			q.messages[0] = networkMessage{}
+			q.messages = q.messages[1:]
+			q.bytes -= uint64(len(msg.data))
+			internal.GetMetrics().WriteQueueChanged(-1)
+			q.logDepthChange()
+			q.mutex.Unlock()
+			return msg, true
+		}
+		closed := q.closed
+		q.mutex.Unlock()
+		if closed {
+			return networkMessage{}, false
+		}
+		<-q.wakeup
+	}
+}
+
+func (q *sendQueue) takeDropped() []uint64 {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	dropped := q.dropped
+	q.dropped = nil
+	return dropped
+}
+
+func (q *sendQueue) depth() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.messages)
+}
+
+// Queued messages are still returned by pop if flush is set, otherwise they are dropped.
+func (q *sendQueue) close(flush bool) {
+	q.mutex.Lock()
+	q.closed = true
+	if !flush {
+		internal.GetMetrics().WriteQueueChanged(-len(q.messages))
+		q.messages = nil
+		q.bytes = 0
+	}
+	q.mutex.Unlock()
+	select {
+	case q.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// Applies overflow policy, returns true if the message may be added.
+func (q *sendQueue) makeRoom(msg networkMessage) bool {
+	switch q.settings.OverflowPolicy {
+	case internal.OverflowCoalesce:
+		return q.coalesce(msg)
+	case internal.OverflowSpill:
+		if q.bytes+uint64(len(msg.data)) > q.settings.SpillBytes {
+			return false
+		}
+		q.spilled++
+		return true
+	}
+	return false
+}
+
+// Host sync carries the whole host data, so queued text updates and syncs of the same host which
+// precede it (or the message being added) are not needed.
+func (q *sendQueue) coalesce(msg networkMessage) bool {
+	lastSync := make(map[uint64]int)
+	for index, queued := range q.messages {
+		if queued.msgType == uint16(internal.HostSynced) {
+			lastSync[queued.hostId] = index
+		}
+	}
+	if msg.msgType == uint16(internal.HostSynced) {
+		lastSync[msg.hostId] = len(q.messages)
+	}
+
+	index := 0
+	length := len(q.messages)
+	q.messages = slices.DeleteFunc(q.messages, func(queued networkMessage) bool {
+		defer func() { index++ }()
+		if queued.msgType != uint16(internal.TextUpdate) && queued.msgType != uint16(internal.HostSynced) {
+			return false
+		}
+		syncIndex, exists := lastSync[queued.hostId]
+		if !exists || index >= syncIndex {
+			return false
+		}
+		q.bytes -= uint64(len(queued.data))
+		q.dropped = append(q.dropped, queued.id)
+		return true
+	})
+	q.coalesced += uint64(length - len(q.messages))
+	internal.GetMetrics().WriteQueueChanged(len(q.messages) - length)
+	return len(q.messages) < q.settings.Size
+}
+
+func (q *sendQueue) logDepthChange() {
+	level := 0
+	for _, threshold := range queueDepthThresholds {
+		if float64(len(q.messages)) >= threshold*float64(q.settings.Size) {
+			level++
+		}
+	}
+	if level == q.level {
+		return
+	}
+	q.level = level
+	slog.Info("Write queue depth has changed", internal.LogKeyAddress, q.name, "messages", len(q.messages),
+		"size", q.settings.Size, "bytes", q.bytes, "max_depth", q.maxDepth, "coalesced", q.coalesced,
+		"spilled", q.spilled)
+}
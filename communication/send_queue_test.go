@@ -0,0 +1,103 @@
+package communication
+
+import (
+	"internal"
+	"testing"
+)
+
+func textUpdateMessage(id uint64, hostId uint64, text string) networkMessage {
+	return networkMessage{id: id, msgType: uint16(internal.TextUpdate),
+		data: internal.SerializeTextUpdate(hostId, internal.TextEntry{Text: text}, 0), hostId: hostId}
+}
+
+func hostSyncedMessage(id uint64, hostId uint64) networkMessage {
+	return networkMessage{id: id, msgType: uint16(internal.HostSynced),
+		data: internal.SerializeHostSynced(&internal.ClientData{Id: hostId, Name: "host"}, 0), hostId: hostId}
+}
+
+func queuedIds(queue *sendQueue) []uint64 {
+	var result []uint64
+	for _, msg := range queue.messages {
+		result = append(result, msg.id)
+	}
+	return result
+}
+
+func TestSendQueueDisconnect(t *testing.T) {
+	queue := createSendQueue(internal.WriteQueueSettings{Size: 2, OverflowPolicy: internal.OverflowDisconnect})
+	for id := uint64(1); id <= 2; id++ {
+		if !queue.push(hostSyncedMessage(id, 1)) {
+			t.Fatalf("Message %d was not queued", id)
+		}
+	}
+	if queue.push(hostSyncedMessage(3, 1)) {
+		t.Error("Full queue has accepted a message")
+	}
+}
+
+func TestSendQueueCoalesce(t *testing.T) {
+	queue := createSendQueue(internal.WriteQueueSettings{Size: 4, OverflowPolicy: internal.OverflowCoalesce})
+	queue.push(textUpdateMessage(1, 1, "first"))
+	queue.push(textUpdateMessage(2, 2, "second"))
+	queue.push(networkMessage{id: 3, msgType: uint16(internal.HostConnected), data: []byte("{}")})
+	queue.push(textUpdateMessage(4, 2, "fourth"))
+
+	// No host was synced later, so nothing can be dropped for the text update.
+	if queue.push(textUpdateMessage(5, 1, "third")) {
+		t.Fatal("Queue has accepted a message which doesn't supersede anything")
+	}
+	if !queue.push(hostSyncedMessage(6, 1)) {
+		t.Fatal("Host sync was not queued")
+	}
+	ids := queuedIds(queue)
+	expected := []uint64{2, 3, 4, 6}
+	if len(ids) != len(expected) {
+		t.Fatalf("Unexpected queued messages: %v", ids)
+	}
+	for index := range expected {
+		if ids[index] != expected[index] {
+			t.Fatalf("Unexpected queued messages: %v", ids)
+		}
+	}
+	if queue.coalesced != 1 {
+		t.Errorf("Wrong number of coalesced messages: %d", queue.coalesced)
+	}
+	if dropped := queue.takeDropped(); len(dropped) != 1 || dropped[0] != 1 || queue.takeDropped() != nil {
+		t.Errorf("Wrong dropped messages: %v", dropped)
+	}
+
+	// Sync of host 2 supersedes both of its updates.
+	if !queue.push(hostSyncedMessage(7, 2)) {
+		t.Fatal("Host sync was not queued")
+	}
+	if ids := queuedIds(queue); len(ids) != 3 || ids[0] != 3 || ids[1] != 6 || ids[2] != 7 {
+		t.Errorf("Unexpected queued messages: %v", ids)
+	}
+}
+
+func TestSendQueueSpill(t *testing.T) {
+	queue := createSendQueue(internal.WriteQueueSettings{Size: 1, OverflowPolicy: internal.OverflowSpill,
+		SpillBytes: 12})
+	for id := uint64(1); id <= 3; id++ {
+		if !queue.push(networkMessage{id: id, msgType: uint16(internal.ImageUpdate), data: []byte("abcd")}) {
+			t.Fatalf("Message %d was not queued", id)
+		}
+	}
+	if queue.push(networkMessage{id: 4, msgType: uint16(internal.ImageUpdate), data: []byte("abcd")}) {
+		t.Error("Queue has grown above the spill limit")
+	}
+
+	msg, ok := queue.pop()
+	if !ok || msg.id != 1 {
+		t.Fatalf("Wrong message was popped: %d", msg.id)
+	}
+	queue.close(true)
+	for id := uint64(2); id <= 3; id++ {
+		if msg, ok := queue.pop(); !ok || msg.id != id {
+			t.Fatalf("Queued message %d was not flushed", id)
+		}
+	}
+	if _, ok := queue.pop(); ok {
+		t.Error("Closed queue has returned a message")
+	}
+}
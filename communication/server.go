@@ -1,66 +1,124 @@
 package communication
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
 	"crypto/tls"
-	"encoding/base64"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"internal"
-	"log"
+	"log/slog"
+	"net"
 	"os"
 	"path/filepath"
+	"sync"
 )
 
-type secretMapping struct {
+type clientMapping struct {
 	group    internal.ClientGroup
 	publicId uint64
+	// Client and group names for the audit log.
+	name      string
+	groupName string
+}
+
+type serverGroup struct {
+	group internal.ClientGroup
+	// Config the group is running with, it is used to find changes on config reload.
+	config internal.GroupConfig
+	// Name from the config, or generated one for unnamed groups, it is used in logs and metrics.
+	name string
 }
 
 type Server struct {
-	tlsConfig     *tls.Config
-	clientGroups  []internal.ClientGroup
-	secretMapping map[[64]byte]secretMapping
-	port          uint16
+	tlsConfig    *tls.Config
+	certificates *certificateHolder
+	appDataDir   string
+	serverKey    []byte
+	storage      internal.Storage
+	// Nil if the server runs without application data directory.
+	audit *internal.AuditWriter
+	port  uint16
+	// Client authentication mode the server was started with.
+	clientAuth string
+
+	enrollmentLimiter enrollmentLimiter
+	// Serializes enrollments, so they don't overwrite each other's config changes.
+	enrollmentMutex sync.Mutex
+
+	// Serializes config reloads, so groups may be changed after the mutex below is released, as
+	// the group calls wait for the group event loop. Fields below are changed only while it is held.
+	reloadMutex sync.Mutex
+	// Guards fields below, they are changed on config reload.
+	mutex         sync.Mutex
+	config        *internal.Config
+	groups        []*serverGroup
+	secretMapping map[internal.SecretDigest]clientMapping
+	certMapping   map[internal.CertDigest]clientMapping
+	groupsCounter int
+	running       bool
 }
 
 func CreateServer(appDataDir string, port uint16, appConfig *internal.Config) (*Server, error) {
 	result := &Server{
-		secretMapping: make(map[[64]byte]secretMapping),
+		appDataDir:    appDataDir,
+		secretMapping: make(map[internal.SecretDigest]clientMapping),
+		config:        &internal.Config{},
 		port:          port,
 	}
 
 	var err error
-	result.tlsConfig, err = loadTlsConfig(appDataDir)
+	result.certificates, err = loadCertificateHolder(
+		internal.CertFilePath(appDataDir), internal.KeyFilePath(appDataDir))
 	if err != nil {
 		return nil, fmt.Errorf("unable to load TLS config: %v", err)
 	}
+	logCertificateFingerprint(result.certificates.leaf())
 
-	for _, groupConfig := range appConfig.Groups {
-		newGroup := internal.CreateClientGroup()
-		for _, clientConfig := range groupConfig.Clients {
-			decodedSecret, err := getSecret(clientConfig.Secret)
-			if err != nil {
-				return nil, err
-			}
-
-			client := internal.CreateClient(newGroup, clientConfig.PublicId, clientConfig.Name)
-			if _, exists := result.secretMapping[decodedSecret]; exists {
-				return nil, fmt.Errorf("initialization error, there was multiple clients " +
-					"with the same secret ID in the config")
-			}
-
-			result.secretMapping[decodedSecret] = secretMapping{
-				group: newGroup, publicId: clientConfig.PublicId}
-			newGroup.AddClient(client)
-			result.clientGroups = append(result.clientGroups, newGroup)
+	result.clientAuth = internal.GetClientAuth(appConfig)
+	clientAuthType, err := getClientAuthType(result.clientAuth)
+	if err != nil {
+		return nil, err
+	}
+	var clientCAs *x509.CertPool
+	if clientAuthType != tls.NoClientCert {
+		caCert, _, err := internal.OpenCertificateAuthority(appDataDir)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open client certificate authority: %v", err)
 		}
+		clientCAs = x509.NewCertPool()
+		clientCAs.AddCert(caCert)
+	}
+	result.tlsConfig = certToConfig(result.certificates, clientCAs, clientAuthType)
+
+	result.serverKey, err = internal.OpenServerKey(appDataDir, appConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	result.audit = internal.CreateAuditWriter(internal.OpenAuditLog(appDataDir, result.serverKey))
+	result.storage, err = internal.OpenJournalStorage(appDataDir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open clipboard history storage: %v", err)
+	}
+
+	if err = os.RemoveAll(result.spoolDir()); err != nil {
+		return nil, fmt.Errorf("unable to clean file spool: %v", err)
 	}
 
+	if err = result.applyConfig(appConfig); err != nil {
+		return nil, err
+	}
 	return result, nil
 }
 
 func CreateServerForTesting(port uint16, clients_count int) (*Server, error) {
 	result := &Server{
-		secretMapping: make(map[[64]byte]secretMapping),
+		secretMapping: make(map[internal.SecretDigest]clientMapping),
+		config:        &internal.Config{},
+		clientAuth:    internal.ClientAuthSecret,
 		port:          port,
 	}
 
@@ -70,80 +128,200 @@ func CreateServerForTesting(port uint16, clients_count int) (*Server, error) {
 		return nil, fmt.Errorf("unable to load TLS config: %v", err)
 	}
 
-	new_group := internal.CreateClientGroup()
+	result.serverKey = make([]byte, 32)
+	if _, err = rand.Read(result.serverKey); err != nil {
+		return nil, err
+	}
+
+	new_group := internal.CreateClientGroup(internal.GroupSettings{})
 	for i := 1; i <= clients_count; i++ {
 		id := uint64(i)
 		var secret [64]byte
 		secret[0] = byte(i)
 		name := fmt.Sprintf("name%d", i)
 
-		client := internal.CreateClient(new_group, id, name)
-		new_group.AddClient(client)
-		result.secretMapping[secret] = secretMapping{group: new_group, publicId: id}
+		client := internal.CreateClient(new_group, id, name, internal.DefaultClientLimits())
+		if err = new_group.AddClient(client); err != nil {
+			return nil, err
+		}
+		result.secretMapping[internal.HashSecret(result.serverKey, secret)] = clientMapping{
+			group: new_group, publicId: id, name: name, groupName: "group0"}
 	}
-	result.clientGroups = append(result.clientGroups, new_group)
+	result.groups = append(result.groups, &serverGroup{group: new_group, name: "group0"})
 
 	return result, nil
 }
 
 func (s *Server) Run() {
-	for _, group := range s.clientGroups {
-		group.RunAsync()
+	s.mutex.Lock()
+	s.running = true
+	for _, group := range s.groups {
+		group.group.RunAsync()
+	}
+	metricsAddress := s.config.MetricsAddress
+	adminConfig := s.config.Admin
+	// Keepalive is set for every connection, heartbeat config changes apply to it after restart.
+	heartbeat := internal.ResolveHeartbeatSettings(s.config.Heartbeat)
+	s.mutex.Unlock()
+
+	if len(metricsAddress) != 0 {
+		go s.serveMetrics(metricsAddress)
+	}
+	if adminConfig != nil {
+		go s.serveAdmin(internal.GetAdminAddress(adminConfig))
+	}
+
+	if len(s.appDataDir) != 0 {
+		go s.handleSignals()
 	}
 
-	listener, err := tls.Listen("tcp", fmt.Sprintf(":%d", s.port), s.tlsConfig)
+	listenConfig := net.ListenConfig{KeepAliveConfig: heartbeat.KeepAliveConfig()}
+	tcpListener, err := listenConfig.Listen(context.Background(), "tcp", fmt.Sprintf(":%d", s.port))
 	if err != nil {
-		log.Fatal("Error initializing server socket: " + err.Error())
+		slog.Error("Error initializing server socket", internal.LogKeyError, err)
+		os.Exit(1)
 	}
+	listener := tls.NewListener(tcpListener, s.tlsConfig)
 
 	defer listener.Close()
-	log.Printf("Server up and listening on port %d\n", s.port)
+	slog.Info("Server up and listening", "port", s.port)
 	for {
 		conn, err := listener.Accept()
-		log.Printf("Client %v connected.", conn.RemoteAddr())
 		if err != nil {
-			log.Println(err)
+			slog.Warn("Unable to accept connection", internal.LogKeyError, err)
 			continue
 		}
+		slog.Info("Client connected", internal.LogKeyAddress, conn.RemoteAddr().String())
 		new_conn := createClientConnection(conn)
 		go s.handleNewConnection(&new_conn)
 	}
 }
 
 func (s *Server) handleNewConnection(connection *clientConnectionImpl) {
-	secretBuf, err := connection.ReadIntroduction()
+	msg, err := connection.readFirstMessage()
+	if err == nil && msg.msgType == uint16(internal.ClientEnrollment) {
+		s.handleEnrollment(connection, msg)
+		return
+	}
+	if err == nil && msg.msgType != uint16(internal.ClientIntroduction) {
+		err = fmt.Errorf("got wrong message type instead of introduction: %d", msg.msgType)
+	}
 	if err != nil {
-		log.Printf("Disconnecting client: %s. Error: %s", connection.GetAdressString(), err.Error())
+		connection.DisconnectAndStop()
+		slog.Info("Disconnecting client", internal.LogKeyAddress, connection.GetAdressString(), internal.LogKeyError, err)
 		return
 	}
-
-	if len(secretBuf) != 64 {
+	secret, protocol, err := internal.ParseClientIntroduction(msg.data)
+	if errors.Is(err, internal.ErrIncompatibleProtocol) {
+		s.rejectConnection(connection, msg.id, fmt.Sprintf("Unsupported protocol version, server supports "+
+			"versions %d-%d.", internal.MinProtocolVersion, internal.ProtocolVersion))
+	}
+	if err != nil {
 		connection.DisconnectAndStop()
-		log.Printf("Disconnecting client: %s. Wrong secret format received",
-			connection.GetAdressString())
+		slog.Info("Disconnecting client", internal.LogKeyAddress, connection.GetAdressString(), internal.LogKeyError, err)
 		return
 	}
+	connection.protocol = protocol
 
-	var secret [64]byte
-	copy(secret[:], secretBuf)
-	mapping, mappingExists := s.secretMapping[secret]
-	if !mappingExists {
+	s.mutex.Lock()
+	mapping, err := s.authenticate(connection, secret)
+	if err != nil {
+		s.mutex.Unlock()
+		internal.GetMetrics().AuthenticationFailed()
+		s.recordAudit(internal.AuditRecord{Event: internal.AuditAuthFailed,
+			Address: connection.GetAdressString(), Details: err.Error()})
 		connection.DisconnectAndStop()
-		log.Printf("Disconnecting unknown client: %s", connection.GetAdressString())
+		slog.Warn("Authentication failed", internal.LogKeyAddress, connection.GetAdressString(), internal.LogKeyError, err)
 		return
 	}
+	s.recordAudit(internal.AuditRecord{Event: internal.AuditAuthSucceeded, Group: mapping.groupName,
+		ClientId: mapping.publicId, Client: mapping.name, Address: connection.GetAdressString()})
+	if protocol.HasCapability(internal.CapabilityHeartbeat) {
+		connection.heartbeat = internal.ResolveHeartbeatSettings(s.config.Heartbeat)
+		connection.protocol.HeartbeatInterval = connection.heartbeat.Interval
+	}
+	connection.writeQueue.settings = internal.ResolveWriteQueueSettings(s.config.WriteQueue)
+	s.mutex.Unlock()
 
 	mapping.group.HandleConnection(mapping.publicId, connection)
+
+	// Config reload may revoke the credentials before the group gets the connection, then the group
+	// could process the revocation first. Reload changes the groups only after it has replaced the
+	// mappings, so the connection is closed here if they are not valid anymore.
+	s.mutex.Lock()
+	current, err := s.authenticate(connection, secret)
+	s.mutex.Unlock()
+	if err != nil || current.group != mapping.group || current.publicId != mapping.publicId {
+		slog.Info("Client credentials were changed during authentication, disconnecting client",
+			internal.LogKeyGroup, mapping.groupName, internal.LogKeyClientId, mapping.publicId)
+		connection.DisconnectAndStop()
+	}
 }
 
-func loadTlsConfig(certDir string) (*tls.Config, error) {
-	certFile := certDir + "/cert.pem"
-	keyFile := certDir + "/key.pem"
-	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+// Sends error to the client which is not able to proceed, so it could show the reason to the user.
+func (s *Server) rejectConnection(connection *clientConnectionImpl, id uint64, errorText string) {
+	err := connection.writeMessageSync(networkMessage{
+		id: id, msgType: uint16(internal.ServerResponse), data: internal.SerializeError(errorText)})
 	if err != nil {
-		return nil, err
+		slog.Warn("Unable to send error", internal.LogKeyAddress, connection.GetAdressString(),
+			internal.LogKeyMessageId, id, internal.LogKeyError, err)
 	}
-	return certToConfig(&cert), nil
+}
+
+// Client is authenticated by its certificate if it has presented one, otherwise by the secret
+// from the introduction. Must be called under the mutex.
+func (s *Server) authenticate(connection *clientConnectionImpl, introduction []byte) (clientMapping, error) {
+	if cert := connection.peerCertificate(); cert != nil {
+		mapping, exists := s.certMapping[internal.CertificateDigest(cert)]
+		if !exists {
+			return mapping, errors.New("unknown client certificate")
+		}
+		return mapping, nil
+	}
+	if s.clientAuth == internal.ClientAuthCertificate {
+		return clientMapping{}, errors.New("client certificate is required")
+	}
+
+	if len(introduction) != internal.SecretSize {
+		return clientMapping{}, errors.New("wrong secret format received")
+	}
+	var secret [internal.SecretSize]byte
+	copy(secret[:], introduction)
+	mapping, exists := s.findSecretMapping(internal.HashSecret(s.serverKey, secret))
+	if !exists {
+		return mapping, errors.New("unknown client")
+	}
+	return mapping, nil
+}
+
+// Record is written in the background, so it is safe to call under the server mutex.
+func (s *Server) recordAudit(record internal.AuditRecord) {
+	s.audit.Record(record)
+}
+
+// Digest is compared with every known one in constant time, so the lookup time doesn't depend on
+// how much of the digest matches.
+func (s *Server) findSecretMapping(digest internal.SecretDigest) (clientMapping, bool) {
+	var result clientMapping
+	found := false
+	for knownDigest, mapping := range s.secretMapping {
+		if subtle.ConstantTimeCompare(knownDigest[:], digest[:]) == 1 {
+			result, found = mapping, true
+		}
+	}
+	return result, found
+}
+
+func getClientAuthType(clientAuth string) (tls.ClientAuthType, error) {
+	switch clientAuth {
+	case internal.ClientAuthSecret:
+		return tls.NoClientCert, nil
+	case internal.ClientAuthCertificate:
+		return tls.RequireAndVerifyClientCert, nil
+	case internal.ClientAuthAny:
+		return tls.VerifyClientCertIfGiven, nil
+	}
+	return tls.NoClientCert, fmt.Errorf("unknown client authentication mode '%s'", clientAuth)
 }
 
 func LoadTestTlsConfig() (*tls.Config, error) {
@@ -155,18 +333,21 @@ func LoadTestTlsConfig() (*tls.Config, error) {
 	test_data_dir := filepath.Dir(bin_path) + "/../resources/test_data"
 	certFile := test_data_dir + "/cert.pem"
 	keyFile := test_data_dir + "/key.pem"
-	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	certificates, err := loadCertificateHolder(certFile, keyFile)
 	if err != nil {
 		return nil, err
 	}
 
-	return certToConfig(&cert), nil
+	return certToConfig(certificates, nil, tls.NoClientCert), nil
 }
 
-func certToConfig(cert *tls.Certificate) *tls.Config {
+func certToConfig(
+	certificates *certificateHolder, clientCAs *x509.CertPool, clientAuth tls.ClientAuthType) *tls.Config {
 	config := &tls.Config{
-		Certificates: []tls.Certificate{*cert},
-		MinVersion:   tls.VersionTLS12,
+		GetCertificate: certificates.getCertificate,
+		ClientCAs:      clientCAs,
+		ClientAuth:     clientAuth,
+		MinVersion:     tls.VersionTLS12,
 		CipherSuites: []uint16{
 			tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256,
 		},
@@ -174,12 +355,29 @@ func certToConfig(cert *tls.Certificate) *tls.Config {
 	return config
 }
 
-func getSecret(secretStr string) ([64]byte, error) {
-	var result [64]byte
-	decodedSecret, err := base64.StdEncoding.DecodeString(secretStr)
-	if err != nil {
-		return result, fmt.Errorf("unable to decode secret: %s", secretStr)
+// Returns delivery state of all clients, it waits for every group event loop.
+func (s *Server) GetDeliveryStats() []internal.DeliveryStats {
+	s.mutex.Lock()
+	groups := make([]internal.ClientGroup, 0, len(s.groups))
+	for _, group := range s.groups {
+		groups = append(groups, group.group)
+	}
+	s.mutex.Unlock()
+
+	var result []internal.DeliveryStats
+	for _, group := range groups {
+		// Group which was removed by config reload has no clients anymore.
+		if stats, err := group.GetDeliveryStats(); err == nil {
+			result = append(result, stats...)
+		}
+	}
+	return result
+}
+
+func (s *Server) logDeliveryStats() {
+	for _, stats := range s.GetDeliveryStats() {
+		slog.Info("Client delivery state", internal.LogKeyClientId, stats.ClientId, internal.LogKeyClient, stats.Name,
+			"connections", stats.Connections, "unacknowledged", stats.Unacked, "lag", stats.Lag,
+			"last_ack_latency", stats.LastAckLatency)
 	}
-	copy(result[:], decodedSecret)
-	return result, nil
 }
@@ -0,0 +1,19 @@
+//go:build !unix
+
+package communication
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// There is no SIGUSR1 on these platforms, delivery state is available through the admin API.
+func (s *Server) handleSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		s.reloadConfigLogged("SIGHUP")
+		s.reloadCertificateLogged()
+	}
+}
@@ -0,0 +1,23 @@
+//go:build unix
+
+package communication
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// SIGHUP reloads config and certificate, SIGUSR1 logs delivery state of the clients.
+func (s *Server) handleSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGUSR1)
+	for received := range signals {
+		if received == syscall.SIGUSR1 {
+			s.logDeliveryStats()
+			continue
+		}
+		s.reloadConfigLogged("SIGHUP")
+		s.reloadCertificateLogged()
+	}
+}
@@ -0,0 +1,79 @@
+package internal
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const DefaultAdminAddress = "127.0.0.1:41287"
+
+// Prefix of the admin address which means Unix socket path.
+const AdminUnixPrefix = "unix:"
+
+var ErrUnknownClient = errors.New("unknown client")
+
+// Admin API is served only if the config has this section and the token was set.
+type AdminConfig struct {
+	// Loopback TCP address, or Unix socket path with "unix:" prefix.
+	Address string `json:",omitempty"`
+	// Base64 HMAC-SHA256 of the admin token with the server key, it is set by 'admin token' command.
+	TokenHash string
+}
+
+// Admin API responses, they are shared by the server and the status command.
+type AdminGroup struct {
+	Name    string
+	Clients []AdminClient
+}
+
+type AdminClient struct {
+	Id          uint64
+	Name        string
+	Connected   bool
+	Connections int
+	Sessions    []SessionStats
+}
+
+type AdminError struct {
+	Error string
+}
+
+func GetAdminAddress(config *AdminConfig) string {
+	if len(config.Address) == 0 {
+		return DefaultAdminAddress
+	}
+	return config.Address
+}
+
+func validateAdminConfig(config *AdminConfig) error {
+	if config == nil {
+		return nil
+	}
+	if _, err := DecodeSecretHash(config.TokenHash); err != nil {
+		return fmt.Errorf("wrong admin token hash, set it with 'admin token' command")
+	}
+	address := GetAdminAddress(config)
+	if strings.HasPrefix(address, AdminUnixPrefix) {
+		if len(address) == len(AdminUnixPrefix) {
+			return fmt.Errorf("admin socket path is empty")
+		}
+		return nil
+	}
+	return checkLoopbackAddress("admin", address)
+}
+
+// Token is compared by its digest in constant time.
+func CheckAdminToken(serverKey []byte, config *AdminConfig, token string) bool {
+	expected, err := DecodeSecretHash(config.TokenHash)
+	if err != nil || len(token) == 0 {
+		return false
+	}
+	secret, err := DecodeSecret(token)
+	if err != nil {
+		return false
+	}
+	digest := HashSecret(serverKey, secret)
+	return subtle.ConstantTimeCompare(expected[:], digest[:]) == 1
+}
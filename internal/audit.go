@@ -0,0 +1,318 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const AuditLogFileName = "audit.log"
+
+const (
+	// Records waiting to be written, records are dropped when it is full.
+	kAuditQueueSize = 1024
+	// Only the first authentication failure from an address is written right away, the rest are
+	// counted and written as a single record at the end of the window.
+	kAuditFailureWindow = time.Minute
+)
+
+// Audit event types.
+const (
+	AuditAuthSucceeded  = "auth-succeeded"
+	AuditAuthFailed     = "auth-failed"
+	AuditSessionStarted = "session-started"
+	AuditSessionRefused = "session-refused"
+	AuditSessionEnded   = "session-ended"
+	AuditConfigReloaded = "config-reloaded"
+	AuditSecretRotated  = "secret-rotated"
+	AuditEnrollment     = "enrollment"
+	AuditAdminCommand   = "admin-command"
+)
+
+// Security-relevant event. Every record contains HMAC of itself and of the previous record hash,
+// keyed with the server key, so changed or removed records break the chain.
+type AuditRecord struct {
+	Time     time.Time
+	Event    string
+	Group    string `json:",omitempty"`
+	ClientId uint64 `json:",omitempty"`
+	Client   string `json:",omitempty"`
+	Address  string `json:",omitempty"`
+	Details  string `json:",omitempty"`
+	Hash     string `json:",omitempty"`
+}
+
+// Records which match all of the set fields.
+type AuditFilter struct {
+	Since time.Time
+	Until time.Time
+	// Client name or public ID.
+	Client string
+}
+
+// Part of the log which was verified before the end of the log or the first broken record.
+type AuditVerification struct {
+	Records  int
+	LastHash string
+}
+
+// Append-only log in the application data directory, nil log drops records. It is shared by the
+// server and administrative commands, so appends are serialized with a file lock.
+type AuditLog struct {
+	path string
+	key  []byte
+}
+
+// Writes records of the running server in the background, so callers don't wait for the disk.
+// Nil writer drops records.
+type AuditWriter struct {
+	log     *AuditLog
+	records chan AuditRecord
+
+	mutex sync.Mutex
+	// Authentication failures in the current window by remote host.
+	failures map[string]*auditFailures
+}
+
+type auditFailures struct {
+	// Failures which were not written, the last one is written with their count.
+	count int
+	last  AuditRecord
+}
+
+// Records are chained with the server key, so the log can't be rewritten without it.
+func OpenAuditLog(appDataDir string, serverKey []byte) *AuditLog {
+	return &AuditLog{path: filepath.Join(appDataDir, AuditLogFileName), key: serverKey}
+}
+
+// Records are written with a single sync.
+func (a *AuditLog) Append(records ...AuditRecord) error {
+	if a == nil || len(records) == 0 {
+		return nil
+	}
+	unlock, err := lockSharedFile(a.path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	file, err := os.OpenFile(a.path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to open audit log: %w", err)
+	}
+	defer file.Close()
+
+	previousHash, err := readLastAuditHash(file)
+	if err != nil {
+		return err
+	}
+	var lines []byte
+	for _, record := range records {
+		if record.Time.IsZero() {
+			record.Time = time.Now()
+		}
+		record.Time = record.Time.UTC()
+		record.Hash = hashAuditRecord(a.key, record, previousHash)
+		line, err := json.Marshal(record)
+		if err != nil {
+			return fmt.Errorf("unable to encode audit record: %w", err)
+		}
+		lines = append(append(lines, line...), '\n')
+		previousHash = record.Hash
+	}
+	if _, err = file.Write(lines); err != nil {
+		return fmt.Errorf("unable to write audit log: %w", err)
+	}
+	if err = file.Sync(); err != nil {
+		return fmt.Errorf("unable to sync audit log: %w", err)
+	}
+	return nil
+}
+
+// Returns records matching the filter. Whole log is verified, if the chain is broken, records
+// before the broken one are returned with the error.
+func ReadAuditLog(appDataDir string, serverKey []byte, filter AuditFilter) ([]AuditRecord, AuditVerification, error) {
+	var verification AuditVerification
+	file, err := os.Open(filepath.Join(appDataDir, AuditLogFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, verification, nil
+	}
+	if err != nil {
+		return nil, verification, fmt.Errorf("unable to open audit log: %w", err)
+	}
+	defer file.Close()
+
+	var result []AuditRecord
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1024*1024)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		var record AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return result, verification, fmt.Errorf("audit log record %d is damaged: %w", lineNumber, err)
+		}
+		if !hmac.Equal([]byte(record.Hash), []byte(hashAuditRecord(serverKey, record, verification.LastHash))) {
+			return result, verification, fmt.Errorf("audit log chain is broken at record %d", lineNumber)
+		}
+		verification.Records++
+		verification.LastHash = record.Hash
+		if filter.matches(&record) {
+			result = append(result, record)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return result, verification, fmt.Errorf("unable to read audit log: %w", err)
+	}
+	return result, verification, nil
+}
+
+// Starts the writer goroutine, it runs until the process exits.
+func CreateAuditWriter(log *AuditLog) *AuditWriter {
+	writer := &AuditWriter{
+		log:      log,
+		records:  make(chan AuditRecord, kAuditQueueSize),
+		failures: make(map[string]*auditFailures),
+	}
+	go writer.run()
+	return writer
+}
+
+// Doesn't block, record is dropped if the writer can't keep up.
+func (w *AuditWriter) Record(record AuditRecord) {
+	if w == nil {
+		return
+	}
+	if record.Time.IsZero() {
+		record.Time = time.Now()
+	}
+	if record.Event == AuditAuthFailed && len(record.Address) != 0 && !w.countFailure(record) {
+		return
+	}
+	select {
+	case w.records <- record:
+	default:
+		slog.Error("Audit log queue is full, record was dropped", "event", record.Event)
+	}
+}
+
+// Returns true if the failure is the first one from its host in the current window.
+func (w *AuditWriter) countFailure(record AuditRecord) bool {
+	host, _, err := net.SplitHostPort(record.Address)
+	if err != nil {
+		host = record.Address
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if failures, exists := w.failures[host]; exists {
+		failures.count++
+		failures.last = record
+		return false
+	}
+	w.failures[host] = &auditFailures{}
+	return true
+}
+
+// Records of the current window which were not written yet, the window is started again.
+func (w *AuditWriter) takeFailures() []AuditRecord {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	var result []AuditRecord
+	for _, failures := range w.failures {
+		if failures.count == 0 {
+			continue
+		}
+		record := failures.last
+		record.Details = fmt.Sprintf("%d more failures in %s, the last one: %s", failures.count,
+			kAuditFailureWindow, record.Details)
+		result = append(result, record)
+	}
+	clear(w.failures)
+	return result
+}
+
+// Records which are queued at the moment are written together.
+func (w *AuditWriter) run() {
+	ticker := time.NewTicker(kAuditFailureWindow)
+	defer ticker.Stop()
+	for {
+		var batch []AuditRecord
+		select {
+		case record := <-w.records:
+			batch = append(batch, record)
+			for len(batch) < kAuditQueueSize && len(w.records) != 0 {
+				batch = append(batch, <-w.records)
+			}
+		case <-ticker.C:
+			batch = w.takeFailures()
+		}
+		if err := w.log.Append(batch...); err != nil {
+			slog.Error("Unable to write audit log", "records", len(batch), LogKeyError, err)
+		}
+	}
+}
+
+func (f *AuditFilter) matches(record *AuditRecord) bool {
+	if !f.Since.IsZero() && record.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && record.Time.After(f.Until) {
+		return false
+	}
+	if len(f.Client) != 0 && f.Client != record.Client && f.Client != strconv.FormatUint(record.ClientId, 10) {
+		return false
+	}
+	return true
+}
+
+// Hash covers the previous hash and the record without its own hash.
+func hashAuditRecord(key []byte, record AuditRecord, previousHash string) string {
+	record.Hash = ""
+	data, err := json.Marshal(record)
+	if err != nil {
+		return ""
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(previousHash))
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Reads hash of the last record, it is empty if the log is empty.
+func readLastAuditHash(file *os.File) (string, error) {
+	stat, err := file.Stat()
+	if err != nil {
+		return "", fmt.Errorf("unable to read audit log: %w", err)
+	}
+	// Records are short, so the tail is read with growing window until it contains a whole line.
+	for window := int64(4096); ; window *= 2 {
+		offset := max(stat.Size()-window, 0)
+		tail := make([]byte, stat.Size()-offset)
+		if _, err := file.ReadAt(tail, offset); err != nil && err != io.EOF {
+			return "", fmt.Errorf("unable to read audit log: %w", err)
+		}
+		tail = bytes.TrimRight(tail, "\n")
+		start := bytes.LastIndexByte(tail, '\n')
+		if start < 0 && offset != 0 {
+			continue
+		}
+		if len(tail) == 0 {
+			return "", nil
+		}
+		var record AuditRecord
+		if err := json.Unmarshal(tail[start+1:], &record); err != nil {
+			return "", fmt.Errorf("last audit log record is damaged: %w", err)
+		}
+		return record.Hash, nil
+	}
+}
@@ -0,0 +1,134 @@
+package internal
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditLogChain(t *testing.T) {
+	dir := t.TempDir()
+	key := bytes.Repeat([]byte{1}, serverKeySize)
+	audit := OpenAuditLog(dir, key)
+	start := time.Date(2026, 1, 2, 10, 0, 0, 0, time.UTC)
+	records := []AuditRecord{
+		{Time: start, Event: AuditAuthSucceeded, ClientId: 1, Client: "laptop", Address: "10.0.0.2:5000"},
+		{Time: start.Add(time.Minute), Event: AuditAuthFailed, Address: "10.0.0.3:5000", Details: "unknown client"},
+		{Time: start.Add(time.Hour), Event: AuditSessionEnded, ClientId: 1, Client: "laptop"},
+		{Time: start.Add(2 * time.Hour), Event: AuditSecretRotated, Details: "client rotate-secret --name=phone"},
+	}
+	if err := audit.Append(records[0]); err != nil {
+		t.Fatalf("Unable to append audit record: %s", err.Error())
+	}
+	if err := audit.Append(records[1:]...); err != nil {
+		t.Fatalf("Unable to append audit records: %s", err.Error())
+	}
+
+	result, verification, err := ReadAuditLog(dir, key, AuditFilter{})
+	if err != nil || len(result) != len(records) || verification.Records != len(records) ||
+		verification.LastHash != result[len(result)-1].Hash {
+		t.Fatalf("Unable to read audit log: %d records, %v, %v", len(result), verification, err)
+	}
+	result, _, err = ReadAuditLog(dir, key, AuditFilter{Client: "laptop", Since: start.Add(time.Second)})
+	if err != nil || len(result) != 1 || result[0].Event != AuditSessionEnded {
+		t.Errorf("Wrong records were filtered by client and time: %v, %v", result, err)
+	}
+	result, _, err = ReadAuditLog(dir, key, AuditFilter{Client: "1", Until: start})
+	if err != nil || len(result) != 1 || result[0].Event != AuditAuthSucceeded {
+		t.Errorf("Wrong records were filtered by ID and time: %v, %v", result, err)
+	}
+	if _, verification, err = ReadAuditLog(dir, bytes.Repeat([]byte{2}, serverKeySize), AuditFilter{}); err == nil ||
+		verification.Records != 0 {
+		t.Error("Audit log was verified with another key")
+	}
+
+	path := filepath.Join(dir, AuditLogFileName)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Unable to read audit log: %s", err.Error())
+	}
+	tampered := bytes.Replace(data, []byte("10.0.0.3"), []byte("10.0.0.4"), 1)
+	if err = os.WriteFile(path, tampered, 0600); err != nil {
+		t.Fatalf("Unable to write audit log: %s", err.Error())
+	}
+	result, verification, err = ReadAuditLog(dir, key, AuditFilter{})
+	if err == nil || len(result) != 1 || verification.Records != 1 || verification.LastHash != result[0].Hash {
+		t.Errorf("Changed record was not detected: %d records, %v, %v", len(result), verification, err)
+	}
+
+	lines := strings.SplitAfter(string(data), "\n")
+	removed := strings.Join(append(lines[:1:1], lines[2:]...), "")
+	if err = os.WriteFile(path, []byte(removed), 0600); err != nil {
+		t.Fatalf("Unable to write audit log: %s", err.Error())
+	}
+	if _, _, err = ReadAuditLog(dir, key, AuditFilter{}); err == nil {
+		t.Error("Removed record was not detected")
+	}
+}
+
+func TestAuditLogContinuesChain(t *testing.T) {
+	dir := t.TempDir()
+	key := bytes.Repeat([]byte{1}, serverKeySize)
+	for i := 0; i < 3; i++ {
+		// Every append opens the file, as the server and commands do.
+		if err := OpenAuditLog(dir, key).Append(AuditRecord{Event: AuditConfigReloaded}); err != nil {
+			t.Fatalf("Unable to append audit record: %s", err.Error())
+		}
+	}
+	var nilAudit *AuditLog
+	if err := nilAudit.Append(AuditRecord{Event: AuditConfigReloaded}); err != nil {
+		t.Errorf("Nil audit log has failed: %s", err.Error())
+	}
+	result, _, err := ReadAuditLog(dir, key, AuditFilter{})
+	if err != nil || len(result) != 3 {
+		t.Errorf("Audit log chain was not continued: %d records, %v", len(result), err)
+	}
+}
+
+func TestAuditWriterAggregatesFailures(t *testing.T) {
+	// Writer goroutine is not started, so queued records stay in the channel.
+	writer := &AuditWriter{records: make(chan AuditRecord, 10), failures: make(map[string]*auditFailures)}
+	for port := 5000; port < 5005; port++ {
+		writer.Record(AuditRecord{Event: AuditAuthFailed, Address: "10.0.0.3:" + strconv.Itoa(port),
+			Details: "unknown client"})
+	}
+	writer.Record(AuditRecord{Event: AuditAuthFailed, Address: "10.0.0.4:5000", Details: "unknown client"})
+	writer.Record(AuditRecord{Event: AuditAuthSucceeded, Address: "10.0.0.3:5006"})
+	if len(writer.records) != 3 {
+		t.Errorf("Repeated failures were queued: %d records", len(writer.records))
+	}
+
+	summary := writer.takeFailures()
+	if len(summary) != 1 || summary[0].Address != "10.0.0.3:5004" ||
+		!strings.HasPrefix(summary[0].Details, "4 more failures") {
+		t.Fatalf("Wrong failures summary: %v", summary)
+	}
+	writer.Record(AuditRecord{Event: AuditAuthFailed, Address: "10.0.0.3:5007"})
+	if len(writer.records) != 4 || len(writer.takeFailures()) != 0 {
+		t.Error("Failure of the new window was not queued")
+	}
+}
+
+func TestCommandsAreAudited(t *testing.T) {
+	dir := t.TempDir()
+	if err := RunCommand(dir, []string{"group", "add", "--name=home"}); err != nil {
+		t.Fatalf("Unable to add group: %s", err.Error())
+	}
+	if err := RunCommand(dir, []string{"group", "add", "--name=home"}); err == nil {
+		t.Fatal("Group was added twice")
+	}
+
+	serverKey, err := OpenServerKey(dir, nil)
+	if err != nil {
+		t.Fatalf("Unable to open server key: %s", err.Error())
+	}
+	records, _, err := ReadAuditLog(dir, serverKey, AuditFilter{})
+	if err != nil || len(records) != 2 || records[0].Details != "group add --name=home" ||
+		!strings.Contains(records[1].Details, "failed: group 'home' already exists") {
+		t.Errorf("Commands were not recorded: %v, %v", records, err)
+	}
+}
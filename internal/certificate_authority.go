@@ -0,0 +1,137 @@
+package internal
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Client authentication modes of the server.
+const (
+	// Client sends its secret in the introduction, this is the default.
+	ClientAuthSecret = "secret"
+	// Client must present certificate issued by the server CA.
+	ClientAuthCertificate = "certificate"
+	// Client either presents certificate or sends its secret.
+	ClientAuthAny = "any"
+)
+
+const caDirName = "ca"
+const caValidity = 10 * 365 * 24 * time.Hour
+
+type CertDigest [sha256.Size]byte
+
+func CertificateDigest(cert *x509.Certificate) CertDigest {
+	return sha256.Sum256(cert.Raw)
+}
+
+// Parses fingerprint in the format printed by the server, colons are optional.
+func DecodeFingerprint(fingerprint string) (CertDigest, error) {
+	var digest CertDigest
+	decoded, err := hex.DecodeString(strings.ReplaceAll(fingerprint, ":", ""))
+	if err != nil || len(decoded) != len(digest) {
+		return digest, fmt.Errorf("unable to decode certificate fingerprint: %s", fingerprint)
+	}
+	copy(digest[:], decoded)
+	return digest, nil
+}
+
+// Returns the effective client authentication mode of the config.
+func GetClientAuth(config *Config) string {
+	if len(config.ClientAuth) == 0 {
+		return ClientAuthSecret
+	}
+	return config.ClientAuth
+}
+
+func CACertFilePath(appDataDir string) string {
+	return filepath.Join(appDataDir, caDirName, CertFileName)
+}
+
+func caKeyFilePath(appDataDir string) string {
+	return filepath.Join(appDataDir, caDirName, KeyFileName)
+}
+
+// Loads CA which issues client certificates, it is created on the first use.
+func OpenCertificateAuthority(appDataDir string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	caCert, err := readCertificateFile(CACertFilePath(appDataDir))
+	if err == nil {
+		key, err := readPrivateKey(caKeyFilePath(appDataDir))
+		if err != nil {
+			return nil, nil, err
+		}
+		return caCert, key, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, nil, err
+	}
+
+	if err = os.MkdirAll(filepath.Join(appDataDir, caDirName), 0700); err != nil {
+		return nil, nil, fmt.Errorf("unable to create CA directory: %w", err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to generate key: %w", err)
+	}
+	template := &x509.Certificate{
+		Subject:  pkix.Name{CommonName: AppName + " client CA"},
+		IsCA:     true,
+		KeyUsage: x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	certPem, err := signCertificate(template, template, &key.PublicKey, key, caValidity)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPem, err := encodePrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = writeFileAtomic(caKeyFilePath(appDataDir), keyPem, 0600); err != nil {
+		return nil, nil, fmt.Errorf("unable to write CA key: %w", err)
+	}
+	if err = writeFileAtomic(CACertFilePath(appDataDir), certPem, 0644); err != nil {
+		return nil, nil, fmt.Errorf("unable to write CA certificate: %w", err)
+	}
+
+	caCert, err = readCertificateFile(CACertFilePath(appDataDir))
+	if err != nil {
+		return nil, nil, err
+	}
+	return caCert, key, nil
+}
+
+// Issues client certificate signed by the server CA, returns certificate and key in PEM format.
+func IssueClientCertificate(appDataDir string, name string, validity time.Duration) ([]byte, []byte, error) {
+	caCert, caKey, err := OpenCertificateAuthority(appDataDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to generate key: %w", err)
+	}
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: name},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	certPem, err := signCertificate(template, caCert, &key.PublicKey, caKey, validity)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPem, err := encodePrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return certPem, keyPem, nil
+}
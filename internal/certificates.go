@@ -0,0 +1,242 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const CertFileName = "cert.pem"
+const KeyFileName = "key.pem"
+const DefaultCertValidity = 365 * 24 * time.Hour
+
+// Certificate is renewed when it expires in less than this period.
+const CertRenewBefore = 30 * 24 * time.Hour
+
+var ErrCertNotGenerated = errors.New("certificate was not generated by the server, it must be renewed by its issuer")
+
+func CertFilePath(appDataDir string) string {
+	return filepath.Join(appDataDir, CertFileName)
+}
+
+func KeyFilePath(appDataDir string) string {
+	return filepath.Join(appDataDir, KeyFileName)
+}
+
+// Default SANs of generated certificate: host name and loopback addresses.
+func DefaultCertHosts() []string {
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	if hostname, err := os.Hostname(); err == nil && len(hostname) != 0 {
+		hosts = append([]string{hostname}, hosts...)
+	}
+	return hosts
+}
+
+func ParseCertHosts(hostsList string) []string {
+	var hosts []string
+	for _, host := range strings.Split(hostsList, ",") {
+		if host = strings.TrimSpace(host); len(host) != 0 {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// Generates new ECDSA P-384 key and self-signed certificate for it, hosts are written to SANs.
+func GenerateCertificate(appDataDir string, hosts []string, validity time.Duration) error {
+	if len(hosts) == 0 {
+		return fmt.Errorf("at least one certificate host is required")
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("unable to generate key: %w", err)
+	}
+
+	template := &x509.Certificate{Subject: pkix.Name{CommonName: hosts[0]}}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	return writeCertificate(appDataDir, template, key, validity)
+}
+
+// Generates certificate only if there is no certificate or key in the application data directory.
+func EnsureCertificate(appDataDir string, hosts []string) (bool, error) {
+	_, certErr := os.Stat(CertFilePath(appDataDir))
+	_, keyErr := os.Stat(KeyFilePath(appDataDir))
+	if certErr == nil && keyErr == nil {
+		return false, nil
+	}
+	if !errors.Is(certErr, os.ErrNotExist) && certErr != nil {
+		return false, certErr
+	}
+	if !errors.Is(keyErr, os.ErrNotExist) && keyErr != nil {
+		return false, keyErr
+	}
+	return true, GenerateCertificate(appDataDir, hosts, DefaultCertValidity)
+}
+
+// Issues new certificate with the same subject, SANs and key, so pinned public key stays valid.
+// Only self-signed certificates are renewed, certificates issued by a CA are never replaced.
+func RenewCertificate(appDataDir string, validity time.Duration) error {
+	cert, err := ReadCertificate(appDataDir)
+	if err != nil {
+		return err
+	}
+	if !isSelfSigned(cert) {
+		return ErrCertNotGenerated
+	}
+	key, err := readPrivateKey(KeyFilePath(appDataDir))
+	if err != nil {
+		return err
+	}
+
+	template := &x509.Certificate{
+		Subject:     cert.Subject,
+		DNSNames:    cert.DNSNames,
+		IPAddresses: cert.IPAddresses,
+	}
+	return writeCertificate(appDataDir, template, key, validity)
+}
+
+func isSelfSigned(cert *x509.Certificate) bool {
+	return bytes.Equal(cert.RawIssuer, cert.RawSubject) &&
+		cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature) == nil
+}
+
+func ReadCertificate(appDataDir string) (*x509.Certificate, error) {
+	return readCertificateFile(CertFilePath(appDataDir))
+}
+
+func readCertificateFile(path string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read certificate: %w", err)
+	}
+	return parseCertificatePem(data)
+}
+
+func parseCertificatePem(data []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("unable to decode certificate")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func certHosts(cert *x509.Certificate) []string {
+	hosts := append([]string{}, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		hosts = append(hosts, ip.String())
+	}
+	return hosts
+}
+
+// SHA-256 of the whole certificate, it changes on every renewal.
+func CertificateFingerprint(cert *x509.Certificate) string {
+	return formatFingerprint(sha256.Sum256(cert.Raw))
+}
+
+// SHA-256 of the certificate public key, it is kept on renewal, so clients should pin it.
+func PublicKeyFingerprint(cert *x509.Certificate) string {
+	return formatFingerprint(sha256.Sum256(cert.RawSubjectPublicKeyInfo))
+}
+
+func formatFingerprint(hash [sha256.Size]byte) string {
+	parts := make([]string, len(hash))
+	for index, value := range hash {
+		parts[index] = fmt.Sprintf("%02X", value)
+	}
+	return strings.Join(parts, ":")
+}
+
+// Files are replaced one by one, running server keeps the old pair until both files match.
+func writeCertificate(
+	appDataDir string, template *x509.Certificate, key *ecdsa.PrivateKey, validity time.Duration) error {
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	certPem, err := signCertificate(template, template, &key.PublicKey, key, validity)
+	if err != nil {
+		return err
+	}
+	keyPem, err := encodePrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err = writeFileAtomic(KeyFilePath(appDataDir), keyPem, 0600); err != nil {
+		return fmt.Errorf("unable to write key: %w", err)
+	}
+	if err = writeFileAtomic(CertFilePath(appDataDir), certPem, 0644); err != nil {
+		return fmt.Errorf("unable to write certificate: %w", err)
+	}
+	return nil
+}
+
+// Signs certificate with the parent key and returns it in PEM format, template is self-signed if
+// parent is the template itself.
+func signCertificate(template, parent *x509.Certificate, publicKey *ecdsa.PublicKey,
+	parentKey *ecdsa.PrivateKey, validity time.Duration) ([]byte, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("unable to generate serial number: %w", err)
+	}
+	now := time.Now()
+	template.SerialNumber = serial
+	template.NotBefore = now.Add(-time.Hour)
+	template.NotAfter = now.Add(validity)
+	template.BasicConstraintsValid = true
+
+	certDer, err := x509.CreateCertificate(rand.Reader, template, parent, publicKey, parentKey)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create certificate: %w", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDer}), nil
+}
+
+func encodePrivateKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("unable to serialize key: %w", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}), nil
+}
+
+func readPrivateKey(path string) (*ecdsa.PrivateKey, error) {
+	keyData, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read key: %w", err)
+	}
+	block, _ := pem.Decode(keyData)
+	if block == nil {
+		return nil, fmt.Errorf("unable to decode key")
+	}
+	parsedKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		parsedKey, err = x509.ParseECPrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse key: %w", err)
+	}
+	key, ok := parsedKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("only ECDSA keys are supported")
+	}
+	return key, nil
+}
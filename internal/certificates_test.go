@@ -0,0 +1,59 @@
+package internal
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestGenerateAndRenewCertificate(t *testing.T) {
+	dir := t.TempDir()
+	generated, err := EnsureCertificate(dir, []string{"reclip.local", "192.168.1.2"})
+	if err != nil || !generated {
+		t.Fatalf("Certificate was not generated: %v", err)
+	}
+	cert, err := ReadCertificate(dir)
+	if err != nil {
+		t.Fatalf("Unable to read generated certificate: %s", err.Error())
+	}
+	if len(cert.DNSNames) != 1 || cert.DNSNames[0] != "reclip.local" ||
+		len(cert.IPAddresses) != 1 || cert.IPAddresses[0].String() != "192.168.1.2" {
+		t.Errorf("Wrong certificate SANs: %v %v", cert.DNSNames, cert.IPAddresses)
+	}
+	if generated, _ = EnsureCertificate(dir, []string{"other"}); generated {
+		t.Error("Existing certificate was replaced")
+	}
+
+	if err = RenewCertificate(dir, 2*DefaultCertValidity); err != nil {
+		t.Fatalf("Unable to renew certificate: %s", err.Error())
+	}
+	renewed, err := ReadCertificate(dir)
+	if err != nil {
+		t.Fatalf("Unable to read renewed certificate: %s", err.Error())
+	}
+	if CertificateFingerprint(renewed) == CertificateFingerprint(cert) ||
+		PublicKeyFingerprint(renewed) != PublicKeyFingerprint(cert) {
+		t.Error("Renewed certificate must keep the key")
+	}
+	if time.Until(renewed.NotAfter) <= DefaultCertValidity {
+		t.Error("Renewed certificate has wrong expiry")
+	}
+}
+
+func TestIssuedCertificateIsNotRenewed(t *testing.T) {
+	dir := t.TempDir()
+	certPem, keyPem, err := IssueClientCertificate(dir, "server", time.Hour)
+	if err != nil {
+		t.Fatalf("Unable to issue certificate: %s", err.Error())
+	}
+	if err = os.WriteFile(CertFilePath(dir), certPem, 0644); err != nil {
+		t.Fatalf("Unable to write certificate: %s", err.Error())
+	}
+	if err = os.WriteFile(KeyFilePath(dir), keyPem, 0600); err != nil {
+		t.Fatalf("Unable to write key: %s", err.Error())
+	}
+	if err = RenewCertificate(dir, DefaultCertValidity); !errors.Is(err, ErrCertNotGenerated) {
+		t.Errorf("Certificate issued by CA was renewed: %v", err)
+	}
+}
@@ -2,196 +2,775 @@ package internal
 
 import (
 	"fmt"
-	"log"
+	"log/slog"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/gammazero/deque"
 )
 
 type ClientDelegate interface {
 	GetTaskRunner() EventLoop
+	// Logger with the group context, client adds its own context to it.
+	GetLogger() *slog.Logger
+	// Group context is added to the record.
+	RecordAudit(record AuditRecord)
 	OnClientDisconnected(client Client)
 	GetFullSyncData(syncExcluded Client) []ClientData
 	GetClientSyncData(id uint64) *ClientData
-	OnTextAdded(client Client, text string)
+	// Changes of all hosts, including the requesting one, after the given sequence number.
+	GetChanges(epoch uint64, since uint64) ChangeSet
+	OnTextAdded(client Client, entry TextEntry)
+	OnImageAdded(client Client, image *ImageData)
 	OnClientSynced(client Client)
+	GetFileSpool() *FileSpool
+	OnFileOffered(client Client, transfer *FileTransfer)
+	OnFileUploaded(client Client, transfer *FileTransfer)
+	// Notifications which were not acknowledged by the client before its last connection was closed.
+	OnNotificationsUndelivered(client Client, events []OutboxEvent)
 }
 
 type Client interface {
 	IsConnected() bool
 	GetClientData() *ClientData
+	GetLimits() ClientLimits
+	// Adds connection to the client, connection of the session it presents the token of is closed.
 	HandleConnection(connection ClientConnection)
+	// Closes all connections of the client and adds the new one.
+	TakeOver(connection ClientConnection)
+	// Checks whether session token was issued for one of the current connections.
+	OwnsSession(token []byte) bool
+	Update(name string, limits ClientLimits)
+	Disconnect()
 
 	NotifyClientConnected(id uint64)
 	NotifyClientDisconnected(id uint64)
-	NotifyTextAdded(id uint64, text string)
-	NotifyClientSynced(data *ClientData)
-}
+	// Sequence is the number of the clipboard change, it is zero if it is unknown.
+	NotifyTextAdded(id uint64, entry TextEntry, sequence uint64)
+	NotifyImageAdded(id uint64, image *ImageData, sequence uint64)
+	NotifyClientSynced(data *ClientData, sequence uint64)
+	NotifyFileOffered(transfer *FileTransfer)
+	NotifyFileReady(transfer *FileTransfer)
 
-const kMaxTextEntries = 10
+	GetDeliveryStats() DeliveryStats
+}
 
 type clientImpl struct {
+	// Connections of the client, the client is connected while there is at least one.
+	sessions []*clientSession
+	delegate ClientDelegate
+	data     ClientData
+	limits   ClientLimits
+}
+
+// Single connection of the client, it receives connection events and keeps per-connection state.
+type clientSession struct {
+	client     *clientImpl
 	connection ClientConnection
-	delegate   ClientDelegate
-	data       ClientData
-	idCounter  uint64
+	// Counter of message IDs sent by the server, request IDs are unique only within a connection.
+	idCounter uint64
+	// Issued to this connection in the introduction.
+	sessionToken []byte
+	// Image which is being uploaded through this connection right now.
+	pendingImage *ImageData
+	// Notifications sent to the client which supports acks, by message ID.
+	unacked map[uint64]OutboxEvent
+	// Time between the last acknowledged notification was sent and acknowledged.
+	lastAckLatency time.Duration
+	started        time.Time
 }
 
 func CreateClient(
 	delegate ClientDelegate,
 	publicId uint64,
-	name string) Client {
+	name string,
+	limits ClientLimits) Client {
 	return &clientImpl{
 		delegate: delegate,
 		data: ClientData{
 			Id:   publicId,
 			Name: name,
 		},
-		idCounter: 0,
+		limits: limits,
 	}
 }
 
-// ClientConnectionDelegate implementations:
+// ClientConnectionDelegate implementations, events of closed or taken over connections are dropped:
 
-func (c *clientImpl) ProcessMessage(id uint64, msgType ClientMessageType, data []byte) {
+func (s *clientSession) ProcessMessage(id uint64, msgType ClientMessageType, data []byte) {
+	if slices.Contains(s.client.sessions, s) {
+		s.client.processMessage(s, id, msgType, data)
+	}
+}
+
+func (s *clientSession) OnDisconnected() {
+	c := s.client
+	index := slices.Index(c.sessions, s)
+	if index < 0 {
+		return
+	}
+	c.sessions = slices.Delete(c.sessions, index, index+1)
+	s.recordEnd("connection was closed")
+	if len(c.sessions) != 0 {
+		// Other connections have received the same notifications.
+		s.logger().Info("Connection has been closed")
+		return
+	}
+	if undelivered := s.takeUnacked(); len(undelivered) != 0 {
+		c.delegate.OnNotificationsUndelivered(c, undelivered)
+	}
+	c.delegate.OnClientDisconnected(c)
+	s.logger().Info("Client has been disconnected")
+}
+
+func (c *clientImpl) processMessage(session *clientSession, id uint64, msgType ClientMessageType, data []byte) {
 	switch msgType {
 	case ClientResponse:
-		// Not used right now.
+		session.processAck(id)
 	case FullSyncRequest:
-		c.processFullSyncRequest(id)
+		c.processFullSyncRequest(session, id)
 	case HostSyncRequest:
-		c.processHostSyncRequest(id, data)
+		c.processHostSyncRequest(session, id, data)
 	case HostTextUpdate:
-		c.processHostTextUpdate(data)
+		c.processHostTextUpdate(session, id, data)
 	case SyncThisHost:
-		c.processSyncClient(data)
+		c.processSyncClient(session, id, data)
+	case HostImageUpdate:
+		c.processHostImageUpdate(session, id, data)
+	case HostImageChunk:
+		c.processHostImageChunk(session, id, data)
+	case ImageRequest:
+		c.processImageRequest(session, id, data)
+	case HostFileOffer:
+		c.processHostFileOffer(session, id, data)
+	case HostFileChunk:
+		c.processHostFileChunk(session, id, data)
+	case FileAccept:
+		c.processFileAccept(session, id, data)
+	case ChangesRequest:
+		c.processChangesRequest(session, id, data)
 	}
 }
 
-func (c *clientImpl) OnDisconnected() {
-	c.delegate.OnClientDisconnected(c)
-	c.connection = nil
-	log.Printf("Client %s has been disconnected", c.data.Name)
-}
-
 // Client implementations:
 
 func (c *clientImpl) IsConnected() bool {
-	return c.connection != nil
+	return len(c.sessions) != 0
 }
 
 func (c *clientImpl) GetClientData() *ClientData {
 	return &c.data
 }
 
+func (c *clientImpl) GetLimits() ClientLimits {
+	return c.limits
+}
+
 func (c *clientImpl) HandleConnection(connection ClientConnection) {
-	if c.connection != nil {
-		panic("Resetting connection which was already set")
+	protocol := connection.GetProtocol()
+	var undelivered []OutboxEvent
+	if index := c.findSession(protocol.SessionToken); index >= 0 {
+		c.sessions[index].connection.DrainAndStop()
+		c.sessions[index].recordEnd("session was resumed by a new connection")
+		undelivered = c.sessions[index].takeUnacked()
+		c.sessions = slices.Delete(c.sessions, index, index+1)
+	}
+	c.addSession(connection, undelivered)
+}
+
+func (c *clientImpl) TakeOver(connection ClientConnection) {
+	var undelivered []OutboxEvent
+	for _, session := range c.sessions {
+		session.connection.DrainAndStop()
+		session.recordEnd("connection was replaced")
+		undelivered = append(undelivered, session.takeUnacked()...)
 	}
-	c.connection = connection
-	c.connection.SetUp(c, c.delegate.GetTaskRunner())
+	c.sessions = nil
+	c.addSession(connection, undelivered)
+}
+
+func (c *clientImpl) OwnsSession(token []byte) bool {
+	return c.findSession(token) >= 0
+}
+
+// Notifications which previous connections of the same device have not acknowledged are sent
+// to the new one.
+func (c *clientImpl) addSession(connection ClientConnection, undelivered []OutboxEvent) {
+	protocol := connection.GetProtocol()
+	session := &clientSession{client: c, connection: connection, unacked: make(map[uint64]OutboxEvent),
+		started: time.Now()}
+	c.sessions = append(c.sessions, session)
+	connection.SetUp(session, c.delegate.GetTaskRunner())
 
 	// Right away schedule introduction sending.
-	serialized := SerializeIntroduction(GetApplicationVersion())
-	c.connection.SendMessage(c.idCounter, ServerIntroduction, serialized)
-	c.idCounter++
+	session.sessionToken = generateSessionToken(&protocol)
+	session.sendMessage(ServerIntroduction,
+		SerializeIntroduction(GetApplicationVersion(), protocol, session.sessionToken))
+	for _, event := range undelivered {
+		c.sendEvent(session, event, nil)
+	}
 
 	// Start connection handling.
-	c.connection.StartHandlingAsync()
+	connection.StartHandlingAsync()
+}
+
+func (c *clientImpl) Update(name string, limits ClientLimits) {
+	if c.data.Name != name {
+		c.logger().Info("Client was renamed", "new_name", name)
+		c.data.Name = name
+	}
+	c.limits = limits
+	c.data.Data.ApplyLimits(limits)
+}
+
+// Connections are closed asynchronously, OnDisconnected is called after that.
+func (c *clientImpl) Disconnect() {
+	for _, session := range c.sessions {
+		session.connection.DisconnectAndStop()
+	}
 }
 
 func (c *clientImpl) NotifyClientConnected(id uint64) {
-	if c.connection == nil {
+	c.broadcastEvent(OutboxEvent{Type: HostConnected, HostId: id}, nil)
+}
+
+func (c *clientImpl) NotifyClientDisconnected(id uint64) {
+	c.broadcastEvent(OutboxEvent{Type: HostDisconnected, HostId: id}, nil)
+}
+
+func (c *clientImpl) NotifyTextAdded(id uint64, entry TextEntry, sequence uint64) {
+	c.broadcastEvent(OutboxEvent{Type: TextUpdate, HostId: id, Entry: &entry, Sequence: sequence}, nil)
+}
+
+func (c *clientImpl) NotifyImageAdded(id uint64, image *ImageData, sequence uint64) {
+	for _, session := range c.sessions {
+		if session.hasCapability(CapabilityImages) {
+			session.sendMessage(ImageUpdate, SerializeImageUpdate(id, image, session.filterSequence(sequence)))
+		}
+	}
+}
+
+func (c *clientImpl) NotifyClientSynced(data *ClientData, sequence uint64) {
+	c.broadcastEvent(OutboxEvent{Type: HostSynced, HostId: data.Id, Sequence: sequence}, data)
+}
+
+func (c *clientImpl) NotifyFileOffered(transfer *FileTransfer) {
+	serialized := SerializeFileTransfer(transfer)
+	for _, session := range c.sessions {
+		if session.hasCapability(CapabilityFiles) {
+			session.sendMessage(FileOffered, serialized)
+		}
+	}
+}
+
+func (c *clientImpl) NotifyFileReady(transfer *FileTransfer) {
+	serialized := SerializeFileTransfer(transfer)
+	for _, session := range c.sessions {
+		if session.hasCapability(CapabilityFiles) {
+			session.sendMessage(FileReady, serialized)
+		}
+	}
+}
+
+func (c *clientImpl) GetDeliveryStats() DeliveryStats {
+	result := DeliveryStats{ClientId: c.data.Id, Name: c.data.Name, Connections: len(c.sessions)}
+	now := time.Now()
+	for _, session := range c.sessions {
+		result.Unacked += len(session.unacked)
+		for _, event := range session.unacked {
+			result.Lag = max(result.Lag, now.Sub(event.Time))
+		}
+		result.LastAckLatency = max(result.LastAckLatency, session.lastAckLatency)
+		result.Sessions = append(result.Sessions, SessionStats{
+			Address:         session.connection.GetAdressString(),
+			Started:         session.started,
+			ConnectionStats: session.connection.GetStats(),
+		})
+	}
+	return result
+}
+
+func (c *clientImpl) broadcastEvent(event OutboxEvent, host *ClientData) {
+	event.Time = time.Now()
+	for _, session := range c.sessions {
+		c.sendEvent(session, event, host)
+	}
+}
+
+// Sends notification, which may be queued to outbox, to the connection. HostSynced is sent with
+// the current host data if host is not set.
+func (c *clientImpl) sendEvent(session *clientSession, event OutboxEvent, host *ClientData) {
+	var serialized []byte
+	sequence := session.filterSequence(event.Sequence)
+	switch event.Type {
+	case HostConnected, HostDisconnected:
+		serialized = SerializeClientId(event.HostId)
+	case TextUpdate:
+		entry := *event.Entry
+		if !session.hasCapability(CapabilityRichText) {
+			entry = TextEntry{Text: entry.Text}
+		}
+		serialized = SerializeTextUpdate(event.HostId, entry, sequence)
+	case HostSynced:
+		if host == nil {
+			host = c.delegate.GetClientSyncData(event.HostId)
+		}
+		if host == nil {
+			return
+		}
+		serialized = SerializeHostSynced(session.filterClientData(host), sequence)
+	default:
 		return
 	}
-	serialized := SerializeClientId(id)
-	c.connection.SendMessage(c.idCounter, HostConnected, serialized)
-	c.idCounter++
+
+	id := session.sendNotification(event.Type, event.HostId, serialized)
+	if session.hasCapability(CapabilityAcks) {
+		if len(session.unacked) >= kMaxUnackedNotifications {
+			session.logger().Warn("Client does not acknowledge notifications, the oldest one is dropped")
+			delete(session.unacked, slices.Min(slices.Collect(maps.Keys(session.unacked))))
+		}
+		session.unacked[id] = event
+	}
 }
 
-func (c *clientImpl) NotifyClientDisconnected(id uint64) {
-	if c.connection == nil {
+func (c *clientImpl) logger() *slog.Logger {
+	return c.delegate.GetLogger().With(LogKeyClientId, c.data.Id, LogKeyClient, c.data.Name)
+}
+
+func (s *clientSession) logger() *slog.Logger {
+	return s.client.logger().With(LogKeyAddress, s.connection.GetAdressString())
+}
+
+func (s *clientSession) recordEnd(reason string) {
+	s.client.delegate.RecordAudit(AuditRecord{
+		Event:    AuditSessionEnded,
+		ClientId: s.client.data.Id,
+		Client:   s.client.data.Name,
+		Address:  s.connection.GetAdressString(),
+		Details:  fmt.Sprintf("%s after %v", reason, time.Since(s.started).Round(time.Second)),
+	})
+}
+
+func (s *clientSession) requestLogger(id uint64) *slog.Logger {
+	return s.logger().With(LogKeyMessageId, id)
+}
+
+// Returns index of the session the token was issued to, or -1.
+func (c *clientImpl) findSession(token []byte) int {
+	return slices.IndexFunc(c.sessions, func(session *clientSession) bool {
+		return isSameSessionToken(session.sessionToken, token)
+	})
+}
+
+func (c *clientImpl) processFullSyncRequest(session *clientSession, id uint64) {
+	otherClientsData := c.delegate.GetFullSyncData(c)
+	for index := range otherClientsData {
+		otherClientsData[index] = *session.filterClientData(&otherClientsData[index])
+	}
+	serializedd := SerializeSync(*session.filterClientData(&c.data), otherClientsData)
+	session.connection.SendMessage(id, ServerResponse, serializedd)
+}
+
+func (c *clientImpl) processHostSyncRequest(session *clientSession, id uint64, data []byte) {
+	clientId, err := DeserializeClientId(data)
+	if err != nil {
+		session.requestLogger(id).Warn("Error parsing client ID", LogKeyError, err)
+		session.reportRequestError(id, "Wrong message sent. Server was unable to parse client ID.")
+		return
+	}
+
+	clientData := c.delegate.GetClientSyncData(clientId)
+	if clientData == nil {
+		session.requestLogger(id).Warn("Sync was requested for unknown host", "host_id", clientId)
+		session.reportRequestError(id, "Unknown host.")
 		return
 	}
-	serialized := SerializeClientId(id)
-	c.connection.SendMessage(c.idCounter, HostDisconnected, serialized)
-	c.idCounter++
+
+	serialized := SerializeClientData(session.filterClientData(clientData))
+	session.connection.SendMessage(id, ServerResponse, serialized)
 }
 
-func (c *clientImpl) NotifyTextAdded(id uint64, text string) {
-	if c.connection == nil {
+func (c *clientImpl) processHostTextUpdate(session *clientSession, id uint64, data []byte) {
+	entry, err := DeserializeText(data)
+	if err != nil {
+		session.requestLogger(id).Warn("Unable to parse host text update", LogKeyError, err)
+		return
+	}
+	session.requestLogger(id).Debug("Text received", LogKeyClipboard, entry.Text)
+	if err = validateTextFormats(entry.Formats); err != nil {
+		session.requestLogger(id).Info("Text was rejected", LogKeyError, err)
+		session.reportRequestError(id, fmt.Sprintf("Text was rejected: %s.", err.Error()))
 		return
 	}
-	serialized := SerializeTextUpdate(id, text)
-	c.connection.SendMessage(c.idCounter, TextUpdate, serialized)
-	c.idCounter++
+	if !c.limits.CheckEntrySize(entry.Size()) {
+		session.requestLogger(id).Info("Text was rejected, entry is too large", "size", entry.Size())
+		session.reportRequestError(id, "Text was rejected: entry is too large.")
+		return
+	}
+	c.data.Data.PushText(entry)
+	c.data.Data.ApplyLimits(c.limits)
+	c.delegate.OnTextAdded(c, entry)
 }
 
-func (c *clientImpl) NotifyClientSynced(data *ClientData) {
-	if c.connection == nil {
+func (c *clientImpl) processSyncClient(session *clientSession, id uint64, data []byte) {
+	clientData, epoch, sequence, err := DeserializeHostSync(data)
+	if err != nil {
+		session.requestLogger(id).Warn("Unable to parse host sync data", LogKeyError, err)
 		return
 	}
-	serialized := SerializeClientData(data)
-	c.connection.SendMessage(c.idCounter, HostSynced, serialized)
-	c.idCounter++
+	for i := 0; i < clientData.Data.Text.Len(); i++ {
+		entry := clientData.Data.GetTextEntry(i)
+		err = validateTextFormats(entry.Formats)
+		if err == nil && !c.limits.CheckEntrySize(entry.Size()) {
+			err = fmt.Errorf("entry is too large (%d bytes)", entry.Size())
+		}
+		if err != nil {
+			session.requestLogger(id).Info("Sync was rejected", LogKeyError, err)
+			session.reportRequestError(id, fmt.Sprintf("Sync was rejected: %s.", err.Error()))
+			return
+		}
+	}
+	// Host sync carries only images description, so content is taken from already uploaded
+	// images. Images which were not uploaded yet are dropped.
+	var images deque.Deque[ImageData]
+	for i := 0; i < clientData.Data.Images.Len(); i++ {
+		if known := c.data.Data.FindImage(clientData.Data.Images.At(i).Id); known != nil {
+			images.PushBack(*known)
+		}
+	}
+	clientData.Data.Images = images
+	if sequence != 0 {
+		c.keepNewerText(&clientData, epoch, sequence)
+	}
+	clientData.Data.ApplyLimits(c.limits)
+
+	c.data = clientData
+	c.delegate.OnClientSynced(c)
 }
 
-func (c *clientImpl) processFullSyncRequest(id uint64) {
-	if c.connection == nil {
-		panic("Connection is nil")
+// Host data is built from the changes the host has received up to the sequence number, so text
+// which was added after that (e.g. by another connection of the host) would be lost otherwise.
+// Newer texts which host data has are in the same order as changes, and every history entry
+// matches at most one change, so a text copied twice is kept twice.
+func (c *clientImpl) keepNewerText(clientData *ClientData, epoch uint64, sequence uint64) {
+	changes := c.delegate.GetChanges(epoch, sequence)
+	entries := clientData.Data.GetTextEntries()
+	var missing []TextEntry
+	position := 0
+	for index := len(changes.Changes) - 1; index >= 0; index-- {
+		change := &changes.Changes[index]
+		if change.HostId != c.data.Id || change.Type != TextUpdate {
+			continue
+		}
+		found := slices.IndexFunc(entries[position:], func(entry TextEntry) bool {
+			return IsEqualTextEntry(entry, *change.Entry)
+		})
+		if found < 0 {
+			missing = append(missing, *change.Entry)
+		} else {
+			position += found + 1
+		}
+	}
+	for index := len(missing) - 1; index >= 0; index-- {
+		clientData.Data.PushText(missing[index])
 	}
-	otherClientsData := c.delegate.GetFullSyncData(c)
-	serializedd := SerializeSync(c.data, otherClientsData)
-	c.connection.SendMessage(id, ServerResponse, serializedd)
 }
 
-func (c *clientImpl) processHostSyncRequest(id uint64, data []byte) {
-	if c.connection == nil {
-		panic("Connection is nil")
+func (c *clientImpl) processChangesRequest(session *clientSession, id uint64, data []byte) {
+	if !session.hasCapability(CapabilityDeltaSync) {
+		session.reportRequestError(id, "Delta sync was not negotiated.")
+		return
+	}
+	epoch, since, err := DeserializeChangesRequest(data)
+	if err != nil {
+		session.requestLogger(id).Warn("Error parsing changes request", LogKeyError, err)
+		session.reportRequestError(id, "Wrong message sent. Server was unable to parse changes request.")
+		return
 	}
 
-	clientId, err := DeserializeClientId(data)
+	changes := c.delegate.GetChanges(epoch, since)
+	if !changes.Complete {
+		otherClientsData := c.delegate.GetFullSyncData(c)
+		for index := range otherClientsData {
+			otherClientsData[index] = *session.filterClientData(&otherClientsData[index])
+		}
+		serialized := SerializeChanges(&changes, session.filterClientData(&c.data), otherClientsData)
+		session.connection.SendMessage(id, ServerResponse, serialized)
+		return
+	}
+
+	var filtered []ClipboardChange
+	for _, change := range changes.Changes {
+		switch change.Type {
+		case TextUpdate:
+			if !session.hasCapability(CapabilityRichText) {
+				change.Entry = &TextEntry{Text: change.Entry.Text}
+			}
+		case ImageUpdate:
+			if !session.hasCapability(CapabilityImages) {
+				continue
+			}
+		case HostSynced:
+			host := c.delegate.GetClientSyncData(change.HostId)
+			if host == nil {
+				// Host was removed from the group.
+				continue
+			}
+			change.Host = session.filterClientData(host)
+		}
+		filtered = append(filtered, change)
+	}
+	changes.Changes = filtered
+	session.connection.SendMessage(id, ServerResponse, SerializeChanges(&changes, nil, nil))
+}
+
+func (c *clientImpl) processHostImageUpdate(session *clientSession, id uint64, data []byte) {
+	image, err := DeserializeImageHeader(data)
 	if err != nil {
-		fmt.Printf("Error parsing client ID: %s", err.Error())
-		c.reportRequestError(id, "Wrong message sent. Server was unable to parse client ID.")
+		session.requestLogger(id).Warn("Unable to parse host image update", LogKeyError, err)
+		session.reportRequestError(id, "Wrong message sent. Server was unable to parse image description.")
+		return
+	}
+	if err = validateImageHeader(&image); err == nil && !c.limits.CheckEntrySize(image.Size) {
+		err = fmt.Errorf("image is too large (%d bytes)", image.Size)
+	}
+	if err != nil {
+		session.requestLogger(id).Info("Image was rejected", LogKeyError, err)
+		session.reportRequestError(id, fmt.Sprintf("Image was rejected: %s.", err.Error()))
+		return
+	}
+
+	image.Data = make([]byte, 0, image.Size)
+	session.pendingImage = &image
+}
+
+func (c *clientImpl) processHostImageChunk(session *clientSession, id uint64, data []byte) {
+	imageId, offset, chunk, err := DeserializeImageChunk(data)
+	if err != nil {
+		session.requestLogger(id).Warn("Unable to parse host image chunk", LogKeyError, err)
+		session.reportRequestError(id, "Wrong message sent. Server was unable to parse image chunk.")
+		return
+	}
+
+	image := session.pendingImage
+	if image == nil || image.Id != imageId {
+		session.reportRequestError(id, "Unknown image upload.")
+		return
+	}
+	if offset != uint64(len(image.Data)) || offset+uint64(len(chunk)) > image.Size {
+		session.pendingImage = nil
+		session.reportRequestError(id, "Unexpected image chunk, upload was aborted.")
+		return
+	}
+
+	image.Data = append(image.Data, chunk...)
+	if uint64(len(image.Data)) < image.Size {
+		return
+	}
+
+	session.pendingImage = nil
+	if err = validateImageContent(image); err != nil {
+		session.requestLogger(id).Info("Image was rejected", LogKeyError, err)
+		session.reportRequestError(id, fmt.Sprintf("Image was rejected: %s.", err.Error()))
+		return
+	}
+
+	c.data.Data.Images.PushFront(*image)
+	for c.data.Data.Images.Len() > kMaxImageEntries {
+		c.data.Data.Images.PopBack()
+	}
+	c.data.Data.ApplyLimits(c.limits)
+	c.delegate.OnImageAdded(c, image)
+}
+
+func (c *clientImpl) processImageRequest(session *clientSession, id uint64, data []byte) {
+	clientId, imageId, offset, err := DeserializeImageRequest(data)
+	if err != nil {
+		session.requestLogger(id).Warn("Error parsing image request", LogKeyError, err)
+		session.reportRequestError(id, "Wrong message sent. Server was unable to parse image request.")
 		return
 	}
 
 	clientData := c.delegate.GetClientSyncData(clientId)
 	if clientData == nil {
-		fmt.Printf("Sync was requested for unknown client %d", clientId)
-		c.reportRequestError(id, "Unknown host.")
+		session.reportRequestError(id, "Unknown host.")
+		return
+	}
+	image := clientData.Data.FindImage(imageId)
+	if image == nil {
+		session.reportRequestError(id, "Unknown image.")
+		return
+	}
+	if offset > image.Size {
+		session.reportRequestError(id, "Image offset is out of range.")
 		return
 	}
 
-	serialized := SerializeClientData(clientData)
-	c.connection.SendMessage(id, ServerResponse, serialized)
+	end := min(offset+kImageChunkSize, image.Size)
+	serialized := SerializeImageChunk(clientId, imageId, offset, image.Data[offset:end])
+	session.connection.SendMessage(id, ServerResponse, serialized)
 }
 
-func (c *clientImpl) processHostTextUpdate(data []byte) {
-	text, err := DeserializeText(data)
+func (c *clientImpl) processHostFileOffer(session *clientSession, id uint64, data []byte) {
+	spool := c.delegate.GetFileSpool()
+	if spool == nil {
+		session.reportRequestError(id, "File transfer is disabled.")
+		return
+	}
+
+	targetId, fileName, size, sha256, err := DeserializeFileOffer(data)
+	if err != nil {
+		session.requestLogger(id).Warn("Error parsing file offer", LogKeyError, err)
+		session.reportRequestError(id, "Wrong message sent. Server was unable to parse file offer.")
+		return
+	}
+	if targetId != 0 && (targetId == c.data.Id || c.delegate.GetClientSyncData(targetId) == nil) {
+		session.reportRequestError(id, "Unknown host.")
+		return
+	}
+
+	receivers := []uint64{targetId}
+	if targetId == 0 {
+		receivers = receivers[:0]
+		for _, host := range c.delegate.GetFullSyncData(c) {
+			receivers = append(receivers, host.Id)
+		}
+	}
+	transfer, created, err := spool.Offer(c.data.Id, targetId, fileName, size, sha256, receivers)
 	if err != nil {
-		fmt.Print("Unable to parse host text update")
+		session.requestLogger(id).Info("File offer was rejected", LogKeyError, err)
+		session.reportRequestError(id, fmt.Sprintf("File was rejected: %s.", err.Error()))
 		return
 	}
-	c.data.Data.Text.PushFront(text)
-	for c.data.Data.Text.Len() > kMaxTextEntries {
-		c.data.Data.Text.PopBack()
+
+	// Response contains offset from which upload must be started (or resumed).
+	serialized := SerializeFileOffset(transfer.Id, transfer.Uploaded)
+	session.connection.SendMessage(id, ServerResponse, serialized)
+	if created {
+		c.delegate.OnFileOffered(c, transfer)
 	}
-	c.delegate.OnTextAdded(c, text)
 }
 
-func (c *clientImpl) processSyncClient(data []byte) {
-	clientData, err := DeserializeClientData(data)
+func (c *clientImpl) processHostFileChunk(session *clientSession, id uint64, data []byte) {
+	spool := c.delegate.GetFileSpool()
+	if spool == nil {
+		session.reportRequestError(id, "File transfer is disabled.")
+		return
+	}
+
+	transferId, offset, chunk, err := DeserializeFileChunk(data)
 	if err != nil {
-		fmt.Print("Unable to parse host sync data")
+		session.requestLogger(id).Warn("Error parsing file chunk", LogKeyError, err)
+		session.reportRequestError(id, "Wrong message sent. Server was unable to parse file chunk.")
 		return
 	}
-	c.data = clientData
-	c.delegate.OnClientSynced(c)
+
+	complete, err := spool.WriteChunk(c.data.Id, transferId, offset, chunk)
+	if err != nil {
+		session.requestLogger(id).Info("File upload failed", LogKeyError, err)
+		session.reportRequestError(id, fmt.Sprintf("File upload failed: %s.", err.Error()))
+		return
+	}
+	if complete {
+		c.delegate.OnFileUploaded(c, spool.GetTransfer(transferId))
+	}
 }
 
-func (c *clientImpl) reportRequestError(id uint64, errorText string) {
-	if c.connection == nil {
-		panic("Connection is nil")
+func (c *clientImpl) processFileAccept(session *clientSession, id uint64, data []byte) {
+	spool := c.delegate.GetFileSpool()
+	if spool == nil {
+		session.reportRequestError(id, "File transfer is disabled.")
+		return
+	}
+
+	transferId, offset, err := DeserializeFileOffset(data)
+	if err != nil {
+		session.requestLogger(id).Warn("Error parsing file accept", LogKeyError, err)
+		session.reportRequestError(id, "Wrong message sent. Server was unable to parse file accept.")
+		return
+	}
+
+	chunk, err := spool.ReadChunk(c.data.Id, transferId, offset)
+	if err != nil {
+		session.reportRequestError(id, fmt.Sprintf("File download failed: %s.", err.Error()))
+		return
 	}
+	serialized := SerializeFileChunk(transferId, offset, chunk)
+	session.connection.SendMessage(id, ServerResponse, serialized)
+}
+
+func (s *clientSession) reportRequestError(id uint64, errorText string) {
 	serialized := SerializeError(errorText)
-	c.connection.SendMessage(id, ServerResponse, serialized)
+	s.connection.SendMessage(id, ServerResponse, serialized)
+}
+
+func (s *clientSession) sendMessage(msgType ServerMessageType, data []byte) {
+	s.connection.SendMessage(s.idCounter, msgType, data)
+	s.idCounter++
+}
+
+// Returns ID of the sent message.
+func (s *clientSession) sendNotification(msgType ServerMessageType, hostId uint64, data []byte) uint64 {
+	id := s.idCounter
+	s.connection.SendNotification(id, msgType, hostId, data)
+	s.idCounter++
+	return id
+}
+
+func (s *clientSession) OnMessagesDropped(ids []uint64) {
+	for _, id := range ids {
+		delete(s.unacked, id)
+	}
+}
+
+func (s *clientSession) processAck(id uint64) {
+	event, exists := s.unacked[id]
+	if !exists {
+		return
+	}
+	delete(s.unacked, id)
+	s.lastAckLatency = time.Since(event.Time)
+}
+
+// Removes unacknowledged notifications from the session and returns them in the order they were sent.
+func (s *clientSession) takeUnacked() []OutboxEvent {
+	ids := slices.Sorted(maps.Keys(s.unacked))
+	result := make([]OutboxEvent, 0, len(ids))
+	for _, id := range ids {
+		result = append(result, s.unacked[id])
+	}
+	clear(s.unacked)
+	return result
+}
+
+// Sequence numbers are sent only to clients which support delta sync.
+func (s *clientSession) filterSequence(sequence uint64) uint64 {
+	if !s.hasCapability(CapabilityDeltaSync) {
+		return 0
+	}
+	return sequence
+}
+
+func (s *clientSession) hasCapability(capability string) bool {
+	protocol := s.connection.GetProtocol()
+	return protocol.HasCapability(capability)
+}
+
+// Drops clipboard content which connected client doesn't support, data itself is not changed.
+func (s *clientSession) filterClientData(data *ClientData) *ClientData {
+	richText := s.hasCapability(CapabilityRichText)
+	images := s.hasCapability(CapabilityImages)
+	if richText && images {
+		return data
+	}
+	result := &ClientData{Id: data.Id, Name: data.Name}
+	result.Data.Text = data.Data.Text
+	if richText {
+		result.Data.TextFormats = data.Data.TextFormats
+	}
+	if images {
+		result.Data.Images = data.Data.Images
+	}
+	return result
 }
@@ -1,47 +1,265 @@
 package internal
 
 import (
+	"cmp"
+	"errors"
 	"fmt"
+	"log/slog"
+	"slices"
+	"sync/atomic"
+	"time"
 )
 
+// Returned by the calls which wait for the group event loop after the loop was stopped.
+var ErrGroupStopped = errors.New("group was stopped")
+
 type ClientGroup interface {
-	AddClient(client Client)
+	// Membership methods are safe to call after the group was started, in that case changes are
+	// applied asynchronously on the group event loop.
+	AddClient(client Client) error
+	RemoveClient(id uint64)
+	UpdateClient(id uint64, name string, limits ClientLimits)
+	DisconnectClient(id uint64)
+	SetFileQuota(quota uint64)
+	SetSessionPolicy(policy string)
+	SetOutboxSettings(settings OutboxSettings)
+	// Waits for the group event loop if the group is running.
+	GetDeliveryStats() ([]DeliveryStats, error)
+	// Returns numbers of clients and connected clients without waiting for the group event loop.
+	GetClientCounts() (int, int)
+	GetHistory(id uint64) ([]TextEntry, error)
+	// Adds text to the host clipboard as if the host has sent it, so all its connections and other
+	// hosts receive it.
+	PushText(id uint64, entry TextEntry) error
 	RunAsync()
+	Shutdown()
 	HandleConnection(id uint64, connection ClientConnection)
 
 	// ClientDelegate methods:
 	GetTaskRunner() EventLoop
+	GetLogger() *slog.Logger
+	RecordAudit(record AuditRecord)
 	OnClientDisconnected(client Client)
 	GetFullSyncData(syncExcluded Client) []ClientData
 	GetClientSyncData(id uint64) *ClientData
-	OnTextAdded(client Client, text string)
+	GetChanges(epoch uint64, since uint64) ChangeSet
+	OnNotificationsUndelivered(client Client, events []OutboxEvent)
+	OnTextAdded(client Client, entry TextEntry)
+	OnImageAdded(client Client, image *ImageData)
 	OnClientSynced(client Client)
+	GetFileSpool() *FileSpool
+	OnFileOffered(client Client, transfer *FileTransfer)
+	OnFileUploaded(client Client, transfer *FileTransfer)
+}
+
+type GroupSettings struct {
+	// Optional, it is added to log and audit records of the group.
+	Name string
+	// Optional, security-relevant events are not recorded if it is nil.
+	Audit *AuditWriter
+	// Optional, history is kept in memory only if it is nil.
+	Storage Storage
+	// Identifies clients of the group in the storage, it must be stable across server restarts.
+	StorageKey string
+	// Optional, file transfer is disabled if it is nil.
+	FileSpool *FileSpool
+	// One of SessionPolicy* values, SessionPolicyReject is used if it is empty.
+	SessionPolicy string
+	// Notifications missed by disconnected clients are dropped if it is not set.
+	Outbox OutboxSettings
 }
 
 type clientGroupImpl struct {
-	clients  map[uint64]Client
-	mainLoop EventLoop
-	started  bool
+	clients    map[uint64]Client
+	mainLoop   EventLoop
+	started    bool
+	stopped    bool
+	storage    Storage
+	storageKey string
+	fileSpool  *FileSpool
+	// What to do with the new connection of already connected client.
+	sessionPolicy string
+	outbox        OutboxSettings
+	// Events queued for disconnected clients, by client ID.
+	outboxes map[uint64][]OutboxEvent
+	// Every clipboard change gets the next sequence number, the latest changes are kept for delta sync.
+	syncEpoch uint64
+	sequence  uint64
+	changes   []ClipboardChange
+	logger    *slog.Logger
+	name      string
+	audit     *AuditWriter
+	// Copies of the client counts, they are read from other goroutines.
+	clientCount    atomic.Int64
+	connectedCount atomic.Int64
 }
 
-func CreateClientGroup() ClientGroup {
+func CreateClientGroup(settings GroupSettings) ClientGroup {
+	logger := slog.Default()
+	if len(settings.Name) != 0 {
+		logger = logger.With(LogKeyGroup, settings.Name)
+	}
 	return &clientGroupImpl{
-		clients:  make(map[uint64]Client),
-		mainLoop: CreateEventLoop(100),
-		started:  false,
+		logger:        logger,
+		name:          settings.Name,
+		audit:         settings.Audit,
+		clients:       make(map[uint64]Client),
+		mainLoop:      CreateEventLoop(100),
+		started:       false,
+		storage:       settings.Storage,
+		storageKey:    settings.StorageKey,
+		fileSpool:     settings.FileSpool,
+		sessionPolicy: settings.SessionPolicy,
+		outbox:        settings.Outbox,
+		outboxes:      make(map[uint64][]OutboxEvent),
+		syncEpoch:     generateSyncEpoch(),
 	}
 }
 
 // ClientGroup implementations:
 
-func (cg *clientGroupImpl) AddClient(client Client) {
-	if cg.started {
-		panic("Adding client when group run loop was already started")
+func (cg *clientGroupImpl) AddClient(client Client) error {
+	var result error
+	err := cg.runOnLoopSync(func() {
+		id := client.GetClientData().Id
+		if _, exists := cg.clients[id]; exists {
+			result = fmt.Errorf("client with ID %d already exists in the group", id)
+			return
+		}
+		cg.restoreHistory(client)
+		cg.clients[id] = client
+		cg.updateClientCounts()
+	})
+	if err != nil {
+		return err
+	}
+	return result
+}
+
+func (cg *clientGroupImpl) RemoveClient(id uint64) {
+	cg.runOnLoop(func() {
+		client, exists := cg.clients[id]
+		if !exists {
+			return
+		}
+		// Other hosts are notified when the connection is actually closed.
+		delete(cg.clients, id)
+		cg.updateClientCounts()
+		if _, exists := cg.outboxes[id]; exists {
+			delete(cg.outboxes, id)
+			cg.persistOutbox(id, nil, nil)
+		}
+		client.Disconnect()
+		cg.clientLogger(client).Info("Client was removed from the group")
+	})
+}
+
+func (cg *clientGroupImpl) UpdateClient(id uint64, name string, limits ClientLimits) {
+	cg.runOnLoop(func() {
+		client, exists := cg.clients[id]
+		if !exists {
+			return
+		}
+		renamed := client.GetClientData().Name != name
+		client.Update(name, limits)
+		if renamed {
+			// Host sync carries host name, so other hosts learn the new one.
+			sequence := cg.recordChange(ClipboardChange{HostId: id, Type: HostSynced})
+			cg.notifyClientSynced(client.GetClientData(), sequence)
+		}
+	})
+}
+
+func (cg *clientGroupImpl) DisconnectClient(id uint64) {
+	cg.runOnLoop(func() {
+		if client, exists := cg.clients[id]; exists {
+			client.Disconnect()
+		}
+	})
+}
+
+func (cg *clientGroupImpl) SetFileQuota(quota uint64) {
+	cg.runOnLoop(func() {
+		if cg.fileSpool != nil {
+			cg.fileSpool.SetQuota(quota)
+		}
+	})
+}
+
+func (cg *clientGroupImpl) SetSessionPolicy(policy string) {
+	cg.runOnLoop(func() {
+		cg.sessionPolicy = policy
+	})
+}
+
+func (cg *clientGroupImpl) SetOutboxSettings(settings OutboxSettings) {
+	cg.runOnLoop(func() {
+		cg.outbox = settings
+	})
+}
+
+func (cg *clientGroupImpl) GetDeliveryStats() ([]DeliveryStats, error) {
+	var result []DeliveryStats
+	err := cg.runOnLoopSync(func() {
+		for _, client := range cg.clients {
+			result = append(result, client.GetDeliveryStats())
+		}
+		slices.SortFunc(result, func(lhs, rhs DeliveryStats) int { return cmp.Compare(lhs.ClientId, rhs.ClientId) })
+	})
+	return result, err
+}
+
+func (cg *clientGroupImpl) GetClientCounts() (int, int) {
+	return int(cg.clientCount.Load()), int(cg.connectedCount.Load())
+}
+
+func (cg *clientGroupImpl) GetHistory(id uint64) ([]TextEntry, error) {
+	var result []TextEntry
+	exists := false
+	err := cg.runOnLoopSync(func() {
+		var client Client
+		if client, exists = cg.clients[id]; exists {
+			result = client.GetClientData().Data.GetTextEntries()
+		}
+	})
+	if err != nil {
+		return nil, err
 	}
-	if _, exists := cg.clients[client.GetClientData().Id]; exists {
-		panic("Adding client with existing ID")
+	if !exists {
+		return nil, ErrUnknownClient
 	}
-	cg.clients[client.GetClientData().Id] = client
+	return result, nil
+}
+
+func (cg *clientGroupImpl) PushText(id uint64, entry TextEntry) error {
+	if err := validateTextFormats(entry.Formats); err != nil {
+		return err
+	}
+	var result error
+	err := cg.runOnLoopSync(func() {
+		client, exists := cg.clients[id]
+		if !exists {
+			result = ErrUnknownClient
+			return
+		}
+		limits := client.GetLimits()
+		if !limits.CheckEntrySize(entry.Size()) {
+			result = fmt.Errorf("entry is too large (%d bytes)", entry.Size())
+			return
+		}
+		data := client.GetClientData()
+		data.Data.PushText(entry)
+		data.Data.ApplyLimits(limits)
+		cg.OnTextAdded(client, entry)
+		event := OutboxEvent{Type: TextUpdate, HostId: id, Entry: &entry, Sequence: cg.sequence}
+		if !cg.queueToOutbox(client, event) {
+			client.NotifyTextAdded(id, entry, cg.sequence)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return result
 }
 
 func (cg *clientGroupImpl) RunAsync() {
@@ -49,25 +267,79 @@ func (cg *clientGroupImpl) RunAsync() {
 	go cg.mainLoop.Run()
 }
 
+// Disconnects all clients and stops accepting new connections. Event loop is kept running until
+// the last connection is closed, so events of connections which are being closed are still processed.
+func (cg *clientGroupImpl) Shutdown() {
+	cg.runOnLoop(func() {
+		cg.stopped = true
+		for _, client := range cg.clients {
+			client.Disconnect()
+		}
+		cg.quitIfIdle()
+	})
+}
+
+func (cg *clientGroupImpl) quitIfIdle() {
+	if !cg.stopped || !cg.started {
+		return
+	}
+	for _, client := range cg.clients {
+		if client.IsConnected() {
+			return
+		}
+	}
+	cg.mainLoop.Quit()
+}
+
 func (cg *clientGroupImpl) HandleConnection(id uint64, connection ClientConnection) {
-	cg.mainLoop.PostTask(
+	posted := cg.mainLoop.PostTask(
 		func() {
-			for clientId, client := range cg.clients {
-				if clientId == id {
-					if !client.IsConnected() {
-						client.HandleConnection(connection)
-						cg.notifyClientConnected(client.GetClientData().Id)
-					} else {
-						fmt.Printf("Unable to handle connection from: %s. Client '%s' it already connected.",
-							connection.GetAdressString(), client.GetClientData().Name)
-						connection.DisconnectAndStop()
-					}
-					return
-				}
+			client, exists := cg.clients[id]
+			if !exists || cg.stopped {
+				// Client may be removed by config reload after its connection was authenticated.
+				cg.logger.Info("Unable to handle connection, client was removed", LogKeyClientId, id,
+					LogKeyAddress, connection.GetAdressString())
+				cg.RecordAudit(AuditRecord{Event: AuditSessionRefused, ClientId: id,
+					Address: connection.GetAdressString(), Details: "client was removed"})
+				connection.DisconnectAndStop()
+				return
 			}
-			panic("Unable to find corresponding client inside Group")
+
+			// Other hosts are notified only about the first connection of the client.
+			logger := cg.clientLogger(client).With(LogKeyAddress, connection.GetAdressString())
+			record := AuditRecord{Event: AuditSessionStarted, ClientId: id, Client: client.GetClientData().Name,
+				Address: connection.GetAdressString()}
+			switch {
+			case !client.IsConnected():
+				client.HandleConnection(connection)
+				cg.replayOutbox(client)
+				cg.notifyClientConnected(client.GetClientData().Id)
+			case client.OwnsSession(connection.GetProtocol().SessionToken):
+				logger.Info("Client has reconnected, previous connection will be closed")
+				record.Details = "session was resumed"
+				client.HandleConnection(connection)
+			case cg.sessionPolicy == SessionPolicyMultiple:
+				logger.Info("Client has additional connection")
+				record.Details = "additional connection"
+				client.HandleConnection(connection)
+			case cg.sessionPolicy == SessionPolicyReplace:
+				logger.Info("Client has connected again, previous connections will be closed")
+				record.Details = "previous connections were replaced"
+				client.TakeOver(connection)
+			default:
+				logger.Warn("Unable to handle connection, client is already connected")
+				record.Event = AuditSessionRefused
+				record.Details = "client is already connected"
+				connection.DisconnectAndStop()
+			}
+			cg.updateClientCounts()
+			cg.RecordAudit(record)
 		},
 	)
+	if !posted {
+		// Group was stopped, so nobody else would close the connection.
+		connection.DisconnectAndStop()
+	}
 }
 
 // ClientDelegate implementations:
@@ -76,8 +348,19 @@ func (cg *clientGroupImpl) GetTaskRunner() EventLoop {
 	return cg.mainLoop
 }
 
+func (cg *clientGroupImpl) GetLogger() *slog.Logger {
+	return cg.logger
+}
+
+func (cg *clientGroupImpl) RecordAudit(record AuditRecord) {
+	record.Group = cg.name
+	cg.audit.Record(record)
+}
+
 func (cg *clientGroupImpl) OnClientDisconnected(client Client) {
+	cg.updateClientCounts()
 	cg.notifyClientDisconnected(client.GetClientData().Id)
+	cg.quitIfIdle()
 }
 
 func (cg *clientGroupImpl) GetFullSyncData(syncExcluded Client) []ClientData {
@@ -88,6 +371,7 @@ func (cg *clientGroupImpl) GetFullSyncData(syncExcluded Client) []ClientData {
 		}
 		resultData = append(resultData, *clientValue.GetClientData())
 	}
+	slices.SortFunc(resultData, func(lhs, rhs ClientData) int { return cmp.Compare(lhs.Id, rhs.Id) })
 	return resultData
 }
 
@@ -100,12 +384,218 @@ func (cg *clientGroupImpl) GetClientSyncData(id uint64) *ClientData {
 	return nil
 }
 
-func (cg *clientGroupImpl) OnTextAdded(client Client, text string) {
-	cg.notifyTextAdded(client.GetClientData().Id, text)
+func (cg *clientGroupImpl) GetChanges(epoch uint64, since uint64) ChangeSet {
+	result := ChangeSet{Epoch: cg.syncEpoch, Sequence: cg.sequence}
+	// Sequence of the last change which is not kept anymore.
+	dropped := cg.sequence - uint64(len(cg.changes))
+	if epoch != cg.syncEpoch || since > cg.sequence || since < dropped {
+		return result
+	}
+	index := int(since - dropped)
+	result.Changes = dropSupersededChanges(slices.Clone(cg.changes[index:]))
+	result.Complete = true
+	return result
+}
+
+// Undelivered notifications are sent when the client connects again, if outbox is enabled.
+func (cg *clientGroupImpl) OnNotificationsUndelivered(client Client, events []OutboxEvent) {
+	for _, event := range events {
+		cg.queueToOutbox(client, event)
+	}
+	cg.clientLogger(client).Info("Notifications were not acknowledged", "count", len(events))
+}
+
+func (cg *clientGroupImpl) OnTextAdded(client Client, entry TextEntry) {
+	if cg.storage != nil {
+		// Client has already applied its limits, so the stored history must be of the same length.
+		data := client.GetClientData()
+		err := cg.storage.AppendText(cg.storageKey, data.Id, entry, data.Data.Text.Len())
+		if err != nil {
+			cg.clientLogger(client).Error("Unable to persist text", LogKeyError, err)
+		}
+	}
+	id := client.GetClientData().Id
+	sequence := cg.recordChange(ClipboardChange{HostId: id, Type: TextUpdate, Entry: &entry})
+	cg.notifyTextAdded(id, entry, sequence)
+}
+
+func (cg *clientGroupImpl) OnImageAdded(client Client, image *ImageData) {
+	id := client.GetClientData().Id
+	header := *image
+	header.Data = nil
+	sequence := cg.recordChange(ClipboardChange{HostId: id, Type: ImageUpdate, Image: &header})
+	cg.notifyImageAdded(id, image, sequence)
 }
 
 func (cg *clientGroupImpl) OnClientSynced(client Client) {
-	cg.notifyClientSynced(client.GetClientData())
+	if cg.storage != nil {
+		data := client.GetClientData()
+		if err := cg.storage.ReplaceHistory(cg.storageKey, data.Id, data.Data.GetTextEntries()); err != nil {
+			cg.clientLogger(client).Error("Unable to persist history", LogKeyError, err)
+		}
+	}
+	sequence := cg.recordChange(ClipboardChange{HostId: client.GetClientData().Id, Type: HostSynced})
+	cg.notifyClientSynced(client.GetClientData(), sequence)
+}
+
+func (cg *clientGroupImpl) GetFileSpool() *FileSpool {
+	return cg.fileSpool
+}
+
+func (cg *clientGroupImpl) OnFileOffered(client Client, transfer *FileTransfer) {
+	cg.notifyFileOffered(transfer)
+}
+
+func (cg *clientGroupImpl) OnFileUploaded(client Client, transfer *FileTransfer) {
+	cg.notifyFileReady(transfer)
+}
+
+// Assigns the next sequence number to the change and returns it.
+func (cg *clientGroupImpl) recordChange(change ClipboardChange) uint64 {
+	cg.sequence++
+	change.Sequence = cg.sequence
+	cg.changes = append(cg.changes, change)
+	if len(cg.changes) > kMaxSyncChanges {
+		cg.changes = slices.Delete(cg.changes, 0, len(cg.changes)-kMaxSyncChanges)
+	}
+	return cg.sequence
+}
+
+// Runs task right away before the group is started, or posts it to the group event loop.
+// Returns ErrGroupStopped if the task was dropped, as the event loop was stopped.
+func (cg *clientGroupImpl) runOnLoop(task EventLoopTask) error {
+	if !cg.started {
+		task()
+		return nil
+	}
+	if !cg.mainLoop.PostTask(task) {
+		return ErrGroupStopped
+	}
+	return nil
+}
+
+// Runs the task and waits for it. Loop may be stopped after the task was posted, then the task is
+// dropped and ErrGroupStopped is returned instead of waiting forever.
+func (cg *clientGroupImpl) runOnLoopSync(task EventLoopTask) error {
+	done := make(chan struct{})
+	if err := cg.runOnLoop(func() {
+		task()
+		close(done)
+	}); err != nil {
+		return err
+	}
+	select {
+	case <-done:
+		return nil
+	case <-cg.mainLoop.Stopped():
+		// Task may be the last one the loop has run.
+		select {
+		case <-done:
+			return nil
+		default:
+			return ErrGroupStopped
+		}
+	}
+}
+
+func (cg *clientGroupImpl) restoreHistory(client Client) {
+	if cg.storage == nil {
+		return
+	}
+	data := client.GetClientData()
+	data.Data.SetTextEntries(cg.storage.GetHistory(cg.storageKey, data.Id))
+	data.Data.ApplyLimits(client.GetLimits())
+	if outbox := cg.storage.GetOutbox(cg.storageKey, data.Id); len(outbox) != 0 {
+		// Sequence numbers of the previous server run are meaningless.
+		for index := range outbox {
+			outbox[index].Sequence = 0
+		}
+		cg.outboxes[data.Id] = outbox
+	}
+}
+
+// Queues event for the client if it is disconnected. Returns false if the client must be notified
+// right away.
+func (cg *clientGroupImpl) queueToOutbox(client Client, event OutboxEvent) bool {
+	if client.IsConnected() || !cg.outbox.isEnabled() {
+		return false
+	}
+	id := client.GetClientData().Id
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	outbox, changed := addOutboxEvent(cg.outboxes[id], event, &cg.outbox)
+	cg.outboxes[id] = outbox
+	if changed {
+		cg.persistOutbox(id, outbox, nil)
+	} else {
+		cg.persistOutbox(id, nil, &event)
+	}
+	return true
+}
+
+// Either replaces the stored outbox with events, or appends the event to it.
+func (cg *clientGroupImpl) persistOutbox(id uint64, events []OutboxEvent, appended *OutboxEvent) {
+	if cg.storage == nil {
+		return
+	}
+	var err error
+	if appended != nil {
+		err = cg.storage.AppendOutbox(cg.storageKey, id, *appended)
+	} else {
+		err = cg.storage.ReplaceOutbox(cg.storageKey, id, events)
+	}
+	if err != nil {
+		cg.logger.Error("Unable to persist outbox", LogKeyClientId, id, LogKeyError, err)
+	}
+}
+
+// Sends events missed by the client in the order they have happened.
+func (cg *clientGroupImpl) replayOutbox(client Client) {
+	id := client.GetClientData().Id
+	outbox, exists := cg.outboxes[id]
+	if !exists {
+		return
+	}
+	delete(cg.outboxes, id)
+	cg.persistOutbox(id, nil, nil)
+
+	outbox = dropExpiredOutboxEvents(outbox, time.Now(), cg.outbox.Ttl)
+	for _, event := range outbox {
+		host := cg.GetClientSyncData(event.HostId)
+		if host == nil {
+			continue
+		}
+		switch event.Type {
+		case TextUpdate:
+			if event.Entry != nil {
+				client.NotifyTextAdded(event.HostId, *event.Entry, event.Sequence)
+			}
+		case HostSynced:
+			client.NotifyClientSynced(host, event.Sequence)
+		case HostConnected:
+			client.NotifyClientConnected(event.HostId)
+		case HostDisconnected:
+			client.NotifyClientDisconnected(event.HostId)
+		}
+	}
+	cg.clientLogger(client).Info("Missed events were sent", "count", len(outbox))
+}
+
+func (cg *clientGroupImpl) updateClientCounts() {
+	connected := 0
+	for _, client := range cg.clients {
+		if client.IsConnected() {
+			connected++
+		}
+	}
+	cg.clientCount.Store(int64(len(cg.clients)))
+	cg.connectedCount.Store(int64(connected))
+}
+
+func (cg *clientGroupImpl) clientLogger(client Client) *slog.Logger {
+	data := client.GetClientData()
+	return cg.logger.With(LogKeyClientId, data.Id, LogKeyClient, data.Name)
 }
 
 func (cg *clientGroupImpl) notifyClientConnected(id uint64) {
@@ -113,6 +603,9 @@ func (cg *clientGroupImpl) notifyClientConnected(id uint64) {
 		if clientId == id {
 			continue
 		}
+		if cg.queueToOutbox(clientValue, OutboxEvent{Type: HostConnected, HostId: id}) {
+			continue
+		}
 		clientValue.NotifyClientConnected(id)
 	}
 }
@@ -122,24 +615,60 @@ func (cg *clientGroupImpl) notifyClientDisconnected(id uint64) {
 		if clientId == id {
 			continue
 		}
+		if cg.queueToOutbox(clientValue, OutboxEvent{Type: HostDisconnected, HostId: id}) {
+			continue
+		}
 		clientValue.NotifyClientDisconnected(id)
 	}
 }
 
-func (cg *clientGroupImpl) notifyTextAdded(id uint64, text string) {
+func (cg *clientGroupImpl) notifyTextAdded(id uint64, entry TextEntry, sequence uint64) {
 	for clientId, clientValue := range cg.clients {
 		if clientId == id {
 			continue
 		}
-		clientValue.NotifyTextAdded(id, text)
+		if cg.queueToOutbox(clientValue, OutboxEvent{Type: TextUpdate, HostId: id, Entry: &entry, Sequence: sequence}) {
+			continue
+		}
+		clientValue.NotifyTextAdded(id, entry, sequence)
 	}
 }
 
-func (cg *clientGroupImpl) notifyClientSynced(data *ClientData) {
+func (cg *clientGroupImpl) notifyImageAdded(id uint64, image *ImageData, sequence uint64) {
+	for clientId, clientValue := range cg.clients {
+		if clientId == id {
+			continue
+		}
+		clientValue.NotifyImageAdded(id, image, sequence)
+	}
+}
+
+func (cg *clientGroupImpl) notifyClientSynced(data *ClientData, sequence uint64) {
 	for clientId, clientValue := range cg.clients {
 		if clientId == data.Id {
 			continue
 		}
-		clientValue.NotifyClientSynced(data)
+		if cg.queueToOutbox(clientValue, OutboxEvent{Type: HostSynced, HostId: data.Id, Sequence: sequence}) {
+			continue
+		}
+		clientValue.NotifyClientSynced(data, sequence)
+	}
+}
+
+func (cg *clientGroupImpl) notifyFileOffered(transfer *FileTransfer) {
+	for clientId, clientValue := range cg.clients {
+		if clientId == transfer.SenderId || (transfer.TargetId != 0 && clientId != transfer.TargetId) {
+			continue
+		}
+		clientValue.NotifyFileOffered(transfer)
+	}
+}
+
+func (cg *clientGroupImpl) notifyFileReady(transfer *FileTransfer) {
+	for clientId, clientValue := range cg.clients {
+		if clientId == transfer.SenderId || (transfer.TargetId != 0 && clientId != transfer.TargetId) {
+			continue
+		}
+		clientValue.NotifyFileReady(transfer)
 	}
 }
@@ -1,7 +1,10 @@
 package internal
 
 import (
+	"encoding/json"
+	"slices"
 	"testing"
+	"time"
 )
 
 type OthersTextData struct {
@@ -16,9 +19,19 @@ type MockClient struct {
 	notifyClientConnected    uint32
 	notifyClientDisconnected uint32
 	notifyClientSynced       uint32
+	notifyImageAdded         uint32
+	notifyFileOffered        uint32
+	notifyFileReady          uint32
+	disconnected             uint32
 }
 
-type MockClientConnection struct{}
+type MockClientConnection struct {
+	// Current protocol is used if it is not set.
+	protocol     *ProtocolInfo
+	delegate     ClientConnectionDelegate
+	disconnected bool
+	drained      bool
+}
 
 func (c *MockClient) IsConnected() bool {
 	return c.handleConnected != 0
@@ -28,10 +41,34 @@ func (c *MockClient) GetClientData() *ClientData {
 	return &c.data
 }
 
+func (c *MockClient) GetLimits() ClientLimits {
+	return DefaultClientLimits()
+}
+
 func (c *MockClient) HandleConnection(connection ClientConnection) {
 	c.handleConnected++
 }
 
+func (c *MockClient) TakeOver(connection ClientConnection) {
+	c.handleConnected++
+}
+
+func (c *MockClient) GetDeliveryStats() DeliveryStats {
+	return DeliveryStats{ClientId: c.data.Id, Name: c.data.Name}
+}
+
+func (c *MockClient) OwnsSession(token []byte) bool {
+	return false
+}
+
+func (c *MockClient) Update(name string, limits ClientLimits) {
+	c.data.Name = name
+}
+
+func (c *MockClient) Disconnect() {
+	c.disconnected++
+}
+
 func (c *MockClient) NotifyClientConnected(id uint64) {
 	c.notifyClientConnected++
 }
@@ -40,29 +77,58 @@ func (c *MockClient) NotifyClientDisconnected(id uint64) {
 	c.notifyClientDisconnected++
 }
 
-func (c *MockClient) NotifyTextAdded(id uint64, text string) {
+func (c *MockClient) NotifyTextAdded(id uint64, entry TextEntry, sequence uint64) {
 	if c.othersText == nil {
 		c.othersText = make([]OthersTextData, 0)
 	}
-	c.othersText = append(c.othersText, OthersTextData{id: id, text: text})
+	c.othersText = append(c.othersText, OthersTextData{id: id, text: entry.Text})
+}
+
+func (c *MockClient) NotifyImageAdded(id uint64, image *ImageData, sequence uint64) {
+	c.notifyImageAdded++
 }
 
-func (c *MockClient) NotifyClientSynced(data *ClientData) {
+func (c *MockClient) NotifyClientSynced(data *ClientData, sequence uint64) {
 	c.notifyClientSynced++
 }
 
+func (c *MockClient) NotifyFileOffered(transfer *FileTransfer) {
+	c.notifyFileOffered++
+}
+
+func (c *MockClient) NotifyFileReady(transfer *FileTransfer) {
+	c.notifyFileReady++
+}
+
 func (c *MockClientConnection) GetAdressString() string { return "" }
 
+func (c *MockClientConnection) GetStats() ConnectionStats { return ConnectionStats{} }
+
 func (c *MockClientConnection) ReadIntroduction() ([]byte, error) { return nil, nil }
 
-func (c *MockClientConnection) SetUp(delegate ClientConnectionDelegate, taskRunner EventLoop) {}
+func (c *MockClientConnection) GetProtocol() ProtocolInfo {
+	if c.protocol != nil {
+		return *c.protocol
+	}
+	return CurrentProtocol()
+}
+
+func (c *MockClientConnection) SetUp(delegate ClientConnectionDelegate, taskRunner EventLoop) {
+	c.delegate = delegate
+}
 
 func (c *MockClientConnection) StartHandlingAsync() {}
 
-func (c *MockClientConnection) DisconnectAndStop() {}
+func (c *MockClientConnection) DisconnectAndStop() { c.disconnected = true }
+
+func (c *MockClientConnection) DrainAndStop() { c.drained = true }
 
 func (c *MockClientConnection) SendMessage(id uint64, msgType ServerMessageType, data []byte) {}
 
+func (c *MockClientConnection) SendNotification(
+	id uint64, msgType ServerMessageType, hostId uint64, data []byte) {
+}
+
 func TestClientGroup(t *testing.T) {
 	client1 := MockClient{
 		data: ClientData{
@@ -83,7 +149,7 @@ func TestClientGroup(t *testing.T) {
 		},
 	}
 
-	testGroup := CreateClientGroup()
+	testGroup := CreateClientGroup(GroupSettings{})
 	testGroup.AddClient(&client1)
 	testGroup.AddClient(&client2)
 	testGroup.AddClient(&client3)
@@ -107,6 +173,9 @@ func TestClientGroup(t *testing.T) {
 		client3.notifyClientConnected != 2 {
 		t.Errorf("Notify connected is not called after 2 connected")
 	}
+	if clients, connected := testGroup.GetClientCounts(); clients != 3 || connected != 2 {
+		t.Errorf("Wrong client counts: %d, %d", clients, connected)
+	}
 
 	testGroup.HandleConnection(3, &MockClientConnection{})
 	testGroup.GetTaskRunner().RunUntilIdle()
@@ -126,12 +195,28 @@ func TestClientGroup(t *testing.T) {
 
 	sometText := "some added text"
 	client1.data.Data.Text.PushBack(sometText)
-	testGroup.OnTextAdded(&client1, sometText)
+	testGroup.OnTextAdded(&client1, TextEntry{Text: sometText})
 	if len(client2.othersText) != 1 || client2.othersText[0].id != client1.GetClientData().Id ||
 		client2.othersText[0].text != sometText {
 		t.Error("Wrong text added processing")
 	}
 
+	testGroup.OnImageAdded(&client2, &ImageData{Id: 1, MimeType: "image/png"})
+	if client1.notifyImageAdded != 1 || client2.notifyImageAdded != 0 ||
+		client3.notifyImageAdded != 1 {
+		t.Error("OnImageAdded processed incorrectly")
+	}
+
+	testGroup.OnFileOffered(&client1, &FileTransfer{Id: 1, SenderId: 1})
+	if client1.notifyFileOffered != 0 || client2.notifyFileOffered != 1 ||
+		client3.notifyFileOffered != 1 {
+		t.Error("OnFileOffered processed incorrectly")
+	}
+	testGroup.OnFileUploaded(&client1, &FileTransfer{Id: 2, SenderId: 1, TargetId: 3})
+	if client1.notifyFileReady != 0 || client2.notifyFileReady != 0 || client3.notifyFileReady != 1 {
+		t.Error("OnFileUploaded processed incorrectly")
+	}
+
 	syncData := testGroup.GetFullSyncData(&client3)
 	if !IsEqual(syncData[0], client1.data) {
 		t.Errorf("Bad full sync response, sync[0] data was: %v", syncData[0])
@@ -145,3 +230,179 @@ func TestClientGroup(t *testing.T) {
 		t.Error("OnClientDisconnected processed incorrectly")
 	}
 }
+
+func TestClientGroupSessionTakeover(t *testing.T) {
+	applicationVersionString = "v1.0.0"
+	testGroup := CreateClientGroup(GroupSettings{})
+	client := CreateClient(testGroup, 1, "name1", DefaultClientLimits())
+	testGroup.AddClient(client)
+
+	first := &RecordingClientConnection{}
+	testGroup.HandleConnection(1, first)
+	testGroup.GetTaskRunner().RunUntilIdle()
+	var introduction serverIntroductionJson
+	if len(first.sent) == 0 || json.Unmarshal(first.sent[0].data, &introduction) != nil ||
+		len(introduction.SessionToken) == 0 {
+		t.Fatal("Session token was not sent in the introduction")
+	}
+
+	second := &RecordingClientConnection{}
+	testGroup.HandleConnection(1, second)
+	testGroup.GetTaskRunner().RunUntilIdle()
+	if !second.disconnected || first.drained {
+		t.Error("Connection without session token has taken over the client")
+	}
+
+	third := &RecordingClientConnection{}
+	protocol := CurrentProtocol()
+	protocol.SessionToken = introduction.SessionToken
+	third.protocol = &protocol
+	testGroup.HandleConnection(1, third)
+	testGroup.GetTaskRunner().RunUntilIdle()
+	if third.disconnected || !first.drained || len(third.sent) == 0 {
+		t.Error("Connection with session token has not taken over the client")
+	}
+	first.delegate.OnDisconnected()
+	if !client.IsConnected() {
+		t.Error("Client was disconnected by the connection which was taken over")
+	}
+
+	testGroup.SetSessionPolicy(SessionPolicyReplace)
+	fourth := &RecordingClientConnection{}
+	testGroup.HandleConnection(1, fourth)
+	testGroup.GetTaskRunner().RunUntilIdle()
+	if fourth.disconnected || !third.drained {
+		t.Error("Connection was not replaced with replace policy")
+	}
+}
+
+func TestClientGroupOutbox(t *testing.T) {
+	applicationVersionString = "v1.0.0"
+	dir := t.TempDir()
+	storage, err := OpenJournalStorage(dir)
+	if err != nil {
+		t.Fatalf("Unable to open storage: %s", err.Error())
+	}
+	settings := GroupSettings{Storage: storage, Outbox: OutboxSettings{MaxEvents: 3, Ttl: time.Hour}}
+	testGroup := CreateClientGroup(settings)
+	sender := CreateClient(testGroup, 1, "name1", DefaultClientLimits())
+	testGroup.AddClient(sender)
+	testGroup.AddClient(CreateClient(testGroup, 2, "name2", DefaultClientLimits()))
+
+	senderConnection := &RecordingClientConnection{}
+	testGroup.HandleConnection(1, senderConnection)
+	testGroup.GetTaskRunner().RunUntilIdle()
+	for _, text := range []string{"text1", "text2", "text3"} {
+		sender.GetClientData().Data.PushText(TextEntry{Text: text})
+		testGroup.OnTextAdded(sender, TextEntry{Text: text})
+	}
+	storage.Close()
+
+	// Outbox is restored from the storage, connection event was dropped because of the limit.
+	storage, err = OpenJournalStorage(dir)
+	if err != nil {
+		t.Fatalf("Unable to reopen storage: %s", err.Error())
+	}
+	defer storage.Close()
+	settings.Storage = storage
+	testGroup = CreateClientGroup(settings)
+	testGroup.AddClient(CreateClient(testGroup, 1, "name1", DefaultClientLimits()))
+	testGroup.AddClient(CreateClient(testGroup, 2, "name2", DefaultClientLimits()))
+	connection := &RecordingClientConnection{}
+	testGroup.HandleConnection(2, connection)
+	testGroup.GetTaskRunner().RunUntilIdle()
+
+	var texts []string
+	for _, message := range connection.sent {
+		if message.msgType == HostConnected {
+			t.Error("Dropped event was replayed")
+		}
+		if message.msgType == TextUpdate {
+			var update textUpdateJson
+			json.Unmarshal(message.data, &update)
+			texts = append(texts, update.Text)
+		}
+	}
+	if !slices.Equal(texts, []string{"text1", "text2", "text3"}) {
+		t.Errorf("Wrong replayed events: %v", texts)
+	}
+	if len(storage.GetOutbox("", 2)) != 0 {
+		t.Error("Outbox was not cleared after replay")
+	}
+}
+
+func TestOutboxCoalescing(t *testing.T) {
+	settings := OutboxSettings{MaxEvents: 10, Ttl: time.Minute}
+	now := time.Now()
+	var outbox []OutboxEvent
+	outbox, _ = addOutboxEvent(outbox, OutboxEvent{Type: TextUpdate, HostId: 1, Time: now.Add(-time.Hour)}, &settings)
+	outbox, _ = addOutboxEvent(outbox, OutboxEvent{Type: HostDisconnected, HostId: 2, Time: now}, &settings)
+	outbox, _ = addOutboxEvent(outbox, OutboxEvent{Type: TextUpdate, HostId: 2, Time: now}, &settings)
+	outbox, changed := addOutboxEvent(outbox, OutboxEvent{Type: HostConnected, HostId: 2, Time: now}, &settings)
+	if !changed || len(outbox) != 2 || outbox[0].Type != TextUpdate || outbox[1].Type != HostConnected {
+		t.Errorf("Wrong outbox after presence change: %v", outbox)
+	}
+	outbox, _ = addOutboxEvent(outbox, OutboxEvent{Type: HostSynced, HostId: 2, Time: now}, &settings)
+	if len(outbox) != 2 || outbox[0].Type != HostConnected || outbox[1].Type != HostSynced {
+		t.Errorf("Wrong outbox after host sync: %v", outbox)
+	}
+}
+
+func TestGroupShutdown(t *testing.T) {
+	testGroup := CreateClientGroup(GroupSettings{})
+	if err := testGroup.AddClient(CreateClient(testGroup, 1, "name1", DefaultClientLimits())); err != nil {
+		t.Fatalf("Unable to add client: %s", err.Error())
+	}
+	if err := testGroup.AddClient(CreateClient(testGroup, 1, "name2", DefaultClientLimits())); err == nil {
+		t.Error("Client with existing ID was added")
+	}
+	entry := TextEntry{Text: "text", Formats: []TextFormat{{MimeType: "application/x-unknown"}}}
+	if err := testGroup.PushText(1, entry); err == nil {
+		t.Error("Text with unsupported format was pushed")
+	}
+	if history, err := testGroup.GetHistory(1); err != nil || len(history) != 0 {
+		t.Errorf("Rejected text was added to the history: %v", err)
+	}
+
+	testGroup.RunAsync()
+	testGroup.Shutdown()
+	loop := testGroup.GetTaskRunner().(*eventLoopImpl)
+	for deadline := time.Now().Add(time.Second); loop.running.Load(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Event loop of the stopped group is still running")
+		}
+	}
+
+	// Calls which wait for the loop return instead of blocking forever.
+	if _, err := testGroup.GetDeliveryStats(); err != ErrGroupStopped {
+		t.Errorf("Delivery stats of the stopped group were returned: %v", err)
+	}
+	if _, err := testGroup.GetHistory(1); err != ErrGroupStopped {
+		t.Errorf("History of the stopped group was returned: %v", err)
+	}
+	if err := testGroup.PushText(1, TextEntry{Text: "text"}); err != ErrGroupStopped {
+		t.Errorf("Text was pushed to the stopped group: %v", err)
+	}
+	if err := testGroup.AddClient(CreateClient(testGroup, 2, "name2", DefaultClientLimits())); err != ErrGroupStopped {
+		t.Errorf("Client was added to the stopped group: %v", err)
+	}
+}
+
+func TestEventLoopDropsTasksAfterStop(t *testing.T) {
+	loop := CreateEventLoop(10)
+	finished := make(chan struct{})
+	go func() {
+		loop.Run()
+		close(finished)
+	}()
+	loop.Quit()
+	<-finished
+	select {
+	case <-loop.Stopped():
+	default:
+		t.Error("Stopped loop was not reported")
+	}
+	if loop.PostTask(func() {}) {
+		t.Error("Task was posted to the stopped loop")
+	}
+}
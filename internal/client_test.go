@@ -0,0 +1,305 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+type SentMessage struct {
+	id      uint64
+	msgType ServerMessageType
+	data    []byte
+}
+
+type RecordingClientConnection struct {
+	MockClientConnection
+	sent []SentMessage
+}
+
+func (c *RecordingClientConnection) SendMessage(id uint64, msgType ServerMessageType, data []byte) {
+	c.sent = append(c.sent, SentMessage{id: id, msgType: msgType, data: data})
+}
+
+func (c *RecordingClientConnection) SendNotification(id uint64, msgType ServerMessageType, hostId uint64, data []byte) {
+	c.SendMessage(id, msgType, data)
+}
+
+func (c *RecordingClientConnection) lastMessage() SentMessage {
+	if len(c.sent) == 0 {
+		return SentMessage{}
+	}
+	return c.sent[len(c.sent)-1]
+}
+
+func createConnectedTestClient(limits ClientLimits) (*clientImpl, *RecordingClientConnection) {
+	applicationVersionString = "v1.0.0"
+	group := CreateClientGroup(GroupSettings{})
+	client := CreateClient(group, 1, "name1", limits).(*clientImpl)
+	group.AddClient(client)
+	connection := &RecordingClientConnection{}
+	client.HandleConnection(connection)
+	return client, connection
+}
+
+func serializeHostText(text string) []byte {
+	data, _ := json.Marshal(textJson{Text: text})
+	return data
+}
+
+func TestClientEntryLimits(t *testing.T) {
+	client, connection := createConnectedTestClient(ClientLimits{
+		MaxHistoryEntries: 3,
+		MaxEntryBytes:     8,
+		MaxHostBytes:      12,
+	})
+
+	connection.delegate.ProcessMessage(10, HostTextUpdate, serializeHostText("text"))
+	connection.delegate.ProcessMessage(11, HostTextUpdate, serializeHostText("too long text"))
+	if client.data.Data.Text.Len() != 1 {
+		t.Fatalf("Oversized entry was stored")
+	}
+	response := connection.lastMessage()
+	if response.id != 11 || response.msgType != ServerResponse {
+		t.Fatalf("Oversized entry was not reported")
+	}
+	var errorResponse errorJson
+	if json.Unmarshal(response.data, &errorResponse) != nil || len(errorResponse.ErrorText) == 0 {
+		t.Errorf("Wrong error response: %s", string(response.data))
+	}
+
+	// Host limit is 12 bytes, so only two entries of 6 bytes fit.
+	connection.delegate.ProcessMessage(12, HostTextUpdate, serializeHostText("text_2"))
+	connection.delegate.ProcessMessage(13, HostTextUpdate, serializeHostText("text_3"))
+	if client.data.Data.Text.Len() != 2 || client.data.Data.Text.At(0) != "text_3" ||
+		client.data.Data.Text.At(1) != "text_2" {
+		t.Errorf("Host limits were not applied: %v", client.data.Data.GetTextEntries())
+	}
+}
+
+func TestResolveClientLimits(t *testing.T) {
+	limits := ResolveClientLimits(
+		&LimitsConfig{MaxHistoryEntries: 5, MaxEntryBytes: 100},
+		nil,
+		&LimitsConfig{MaxEntryBytes: 10})
+	if limits.MaxHistoryEntries != 5 || limits.MaxEntryBytes != 10 ||
+		limits.MaxHostBytes != kDefaultMaxHostBytes {
+		t.Errorf("Wrong resolved limits: %v", limits)
+	}
+}
+
+func TestClientProtocolCapabilities(t *testing.T) {
+	applicationVersionString = "v1.0.0"
+	group := CreateClientGroup(GroupSettings{})
+	client := CreateClient(group, 1, "name1", DefaultClientLimits()).(*clientImpl)
+	group.AddClient(client)
+	connection := &RecordingClientConnection{}
+	connection.protocol = &ProtocolInfo{Version: 1}
+	client.HandleConnection(connection)
+
+	entry := TextEntry{Text: "text", Formats: []TextFormat{{MimeType: "text/html", Data: "<b>text</b>"}}}
+	client.NotifyTextAdded(2, entry, 1)
+	if entry, err := DeserializeText(connection.lastMessage().data); err != nil || len(entry.Formats) != 0 {
+		t.Error("Text formats were sent to the client without rich text support")
+	}
+
+	sentCount := len(connection.sent)
+	client.NotifyImageAdded(2, &ImageData{Id: 1, MimeType: "image/png"}, 2)
+	client.NotifyFileOffered(&FileTransfer{})
+	if len(connection.sent) != sentCount {
+		t.Error("Message types unknown to the client were sent")
+	}
+}
+
+func TestParseClientIntroduction(t *testing.T) {
+	secret := make([]byte, SecretSize)
+	parsedSecret, protocol, err := ParseClientIntroduction(secret)
+	if err != nil || len(parsedSecret) != SecretSize || protocol.Version != 1 {
+		t.Errorf("Legacy introduction was not parsed: %v", err)
+	}
+
+	introduction, _ := json.Marshal(clientIntroductionJson{Secret: secret, ProtocolVersion: ProtocolVersion + 1,
+		MinProtocolVersion: 1, Capabilities: []string{CapabilityImages, "unknown"}})
+	parsedSecret, protocol, err = ParseClientIntroduction(introduction)
+	if err != nil || len(parsedSecret) != SecretSize || protocol.Version != ProtocolVersion {
+		t.Errorf("Introduction was not parsed: %v", err)
+	}
+	if !protocol.HasCapability(CapabilityImages) || len(protocol.Capabilities) != 1 {
+		t.Errorf("Wrong capabilities were negotiated: %v", protocol.Capabilities)
+	}
+
+	introduction, _ = json.Marshal(clientIntroductionJson{Secret: secret, ProtocolVersion: ProtocolVersion + 2,
+		MinProtocolVersion: ProtocolVersion + 1})
+	if _, _, err = ParseClientIntroduction(introduction); !errors.Is(err, ErrIncompatibleProtocol) {
+		t.Errorf("Incompatible client was accepted: %v", err)
+	}
+}
+
+func countSentMessages(connection *RecordingClientConnection, msgType ServerMessageType) int {
+	count := 0
+	for _, message := range connection.sent {
+		if message.msgType == msgType {
+			count++
+		}
+	}
+	return count
+}
+
+func TestClientMultipleConnections(t *testing.T) {
+	applicationVersionString = "v1.0.0"
+	group := CreateClientGroup(GroupSettings{SessionPolicy: SessionPolicyMultiple})
+	client1 := CreateClient(group, 1, "name1", DefaultClientLimits())
+	client2 := CreateClient(group, 2, "name2", DefaultClientLimits())
+	group.AddClient(client1)
+	group.AddClient(client2)
+
+	observer := &RecordingClientConnection{}
+	group.HandleConnection(2, observer)
+	desktop := &RecordingClientConnection{}
+	vm := &RecordingClientConnection{}
+	group.HandleConnection(1, desktop)
+	group.HandleConnection(1, vm)
+	group.GetTaskRunner().RunUntilIdle()
+	if vm.disconnected || len(vm.sent) == 0 || vm.sent[0].id != 0 || desktop.sent[0].id != 0 {
+		t.Fatal("Second connection was not introduced with its own message IDs")
+	}
+	if countSentMessages(observer, HostConnected) != 1 {
+		t.Error("Other hosts were notified about every connection of the client")
+	}
+
+	group.OnTextAdded(client2, TextEntry{Text: "text"})
+	if desktop.lastMessage().msgType != TextUpdate || vm.lastMessage().msgType != TextUpdate {
+		t.Error("Text update was not sent to all connections of the client")
+	}
+	vm.delegate.ProcessMessage(5, FullSyncRequest, nil)
+	if vm.lastMessage().id != 5 || vm.lastMessage().msgType != ServerResponse ||
+		desktop.lastMessage().msgType == ServerResponse {
+		t.Error("Response was not sent to the connection which made the request")
+	}
+
+	desktop.delegate.OnDisconnected()
+	if !client1.IsConnected() || countSentMessages(observer, HostDisconnected) != 0 {
+		t.Error("Client was disconnected while it still has a connection")
+	}
+	vm.delegate.OnDisconnected()
+	if client1.IsConnected() || countSentMessages(observer, HostDisconnected) != 1 {
+		t.Error("Client was not disconnected after its last connection was closed")
+	}
+}
+
+func TestDeltaSync(t *testing.T) {
+	applicationVersionString = "v1.0.0"
+	group := CreateClientGroup(GroupSettings{})
+	host := CreateClient(group, 1, "name1", DefaultClientLimits()).(*clientImpl)
+	group.AddClient(host)
+	group.AddClient(CreateClient(group, 2, "name2", DefaultClientLimits()))
+	hostConnection := &RecordingClientConnection{}
+	connection := &RecordingClientConnection{}
+	group.HandleConnection(1, hostConnection)
+	group.HandleConnection(2, connection)
+	group.GetTaskRunner().RunUntilIdle()
+
+	hostConnection.delegate.ProcessMessage(1, HostTextUpdate, serializeHostText("a"))
+	hostConnection.delegate.ProcessMessage(2, HostTextUpdate, serializeHostText("b"))
+	requestChanges := func(epoch uint64, since uint64) changesJson {
+		request, _ := json.Marshal(changesRequestJson{Epoch: epoch, Since: since})
+		connection.delegate.ProcessMessage(10, ChangesRequest, request)
+		var response changesJson
+		if err := json.Unmarshal(connection.lastMessage().data, &response); err != nil {
+			t.Fatalf("Wrong changes response: %s", string(connection.lastMessage().data))
+		}
+		return response
+	}
+
+	snapshot := requestChanges(0, 0)
+	if snapshot.Snapshot == nil || snapshot.Sequence != 2 || len(snapshot.Snapshot.OtherData) != 1 ||
+		!slices.Equal(snapshot.Snapshot.OtherData[0].TextData, []string{"b", "a"}) {
+		t.Fatalf("Wrong snapshot for unknown epoch: %v", snapshot)
+	}
+
+	hostConnection.delegate.ProcessMessage(3, HostTextUpdate, serializeHostText("c"))
+	var update textUpdateJson
+	if json.Unmarshal(connection.lastMessage().data, &update) != nil || update.Sequence != 3 {
+		t.Errorf("Text update has wrong sequence: %s", string(connection.lastMessage().data))
+	}
+	delta := requestChanges(snapshot.Epoch, 2)
+	if delta.Snapshot != nil || len(delta.Changes) != 1 || delta.Changes[0].Type != "text" ||
+		delta.Changes[0].Text.Text != "c" || delta.Changes[0].Sequence != 3 {
+		t.Errorf("Wrong delta: %v", delta)
+	}
+
+	// Host has built its sync before it received its own text "c", so the text must be kept.
+	sync, _ := json.Marshal(clientJson{ClientId: 1, TextData: []string{"x"}, Epoch: snapshot.Epoch, Sequence: 2})
+	hostConnection.delegate.ProcessMessage(4, SyncThisHost, sync)
+	if !slices.Equal(historyTexts(host.data.Data.GetTextEntries()), []string{"c", "x"}) {
+		t.Errorf("Concurrent text was lost by host sync: %v", host.data.Data.GetTextEntries())
+	}
+	delta = requestChanges(snapshot.Epoch, 3)
+	if len(delta.Changes) != 1 || delta.Changes[0].Type != "host" || delta.Changes[0].Host == nil {
+		t.Errorf("Wrong delta after host sync: %v", delta)
+	}
+
+	// Host has received only one of two copies of "d", and its "e" has no formats.
+	html, _ := json.Marshal(textJson{Text: "e", Formats: []TextFormat{{MimeType: "text/html", Data: "<b>e</b>"}}})
+	hostConnection.delegate.ProcessMessage(5, HostTextUpdate, serializeHostText("d"))
+	hostConnection.delegate.ProcessMessage(6, HostTextUpdate, serializeHostText("d"))
+	hostConnection.delegate.ProcessMessage(7, HostTextUpdate, html)
+	sync, _ = json.Marshal(clientJson{ClientId: 1, TextData: []string{"e", "d", "c"}, Epoch: snapshot.Epoch, Sequence: 4})
+	hostConnection.delegate.ProcessMessage(8, SyncThisHost, sync)
+	entries := host.data.Data.GetTextEntries()
+	if !slices.Equal(historyTexts(entries), []string{"e", "d", "e", "d", "c"}) || len(entries[0].Formats) != 1 {
+		t.Errorf("Concurrent texts were lost by host sync: %v", entries)
+	}
+}
+
+func TestClientAcks(t *testing.T) {
+	applicationVersionString = "v1.0.0"
+	group := CreateClientGroup(GroupSettings{Outbox: OutboxSettings{MaxEvents: 10, Ttl: time.Hour}})
+	sender := CreateClient(group, 1, "name1", DefaultClientLimits())
+	receiver := CreateClient(group, 2, "name2", DefaultClientLimits())
+	group.AddClient(sender)
+	group.AddClient(receiver)
+	connection := &RecordingClientConnection{}
+	group.HandleConnection(2, connection)
+	group.HandleConnection(1, &RecordingClientConnection{})
+	group.GetTaskRunner().RunUntilIdle()
+
+	group.OnTextAdded(sender, TextEntry{Text: "text"})
+	if len(connection.sent) != 3 || connection.sent[1].msgType != HostConnected {
+		t.Fatalf("Unexpected notifications: %v", connection.sent)
+	}
+	connection.delegate.ProcessMessage(connection.sent[1].id, ClientResponse, nil)
+	if stats := receiver.GetDeliveryStats(); stats.Unacked != 1 || stats.Connections != 1 {
+		t.Errorf("Wrong delivery stats: %v", stats)
+	}
+	// Superseded notification is not waited for.
+	group.OnTextAdded(sender, TextEntry{Text: "dropped"})
+	connection.delegate.OnMessagesDropped([]uint64{connection.lastMessage().id})
+	if stats := receiver.GetDeliveryStats(); stats.Unacked != 1 {
+		t.Errorf("Dropped notification is still unacknowledged: %v", stats)
+	}
+
+	// Same device reconnects, so it gets unacknowledged text update again.
+	var introduction serverIntroductionJson
+	json.Unmarshal(connection.sent[0].data, &introduction)
+	reconnected := &RecordingClientConnection{}
+	protocol := CurrentProtocol()
+	protocol.SessionToken = introduction.SessionToken
+	reconnected.protocol = &protocol
+	group.HandleConnection(2, reconnected)
+	group.GetTaskRunner().RunUntilIdle()
+	if len(reconnected.sent) != 2 || reconnected.sent[1].msgType != TextUpdate {
+		t.Fatalf("Unacknowledged notification was not sent again: %v", reconnected.sent)
+	}
+
+	// Notification which is not acknowledged when the client disconnects goes to the outbox.
+	reconnected.delegate.OnDisconnected()
+	lastConnection := &RecordingClientConnection{}
+	group.HandleConnection(2, lastConnection)
+	group.GetTaskRunner().RunUntilIdle()
+	if countSentMessages(lastConnection, TextUpdate) != 1 {
+		t.Errorf("Unacknowledged notification was not replayed: %v", lastConnection.sent)
+	}
+}
@@ -1,11 +1,39 @@
 package internal
 
 import (
+	"bytes"
+	"slices"
+
 	"github.com/gammazero/deque"
 )
 
+type ImageData struct {
+	// Identifier of the image, it is assigned by the host which owns the image.
+	Id       uint64
+	MimeType string
+	Width    uint32
+	Height   uint32
+	Size     uint64
+	Data     []byte
+}
+
+// Additional representation of a text entry, e.g. HTML or RTF.
+type TextFormat struct {
+	MimeType string
+	Data     string
+}
+
+type TextEntry struct {
+	Text    string
+	Formats []TextFormat
+}
+
 type ClipboardData struct {
 	Text deque.Deque[string]
+	// Additional representations of Text entries, element i belongs to Text element i. It may be
+	// shorter than Text, missing elements mean that entries have plain text only.
+	TextFormats deque.Deque[[]TextFormat]
+	Images      deque.Deque[ImageData]
 }
 
 type ClientData struct {
@@ -24,10 +52,129 @@ func IsEqual(lhs ClientData, rhs ClientData) bool {
 	}
 
 	for i := 0; i < lhs.Data.Text.Len(); i++ {
-		if lhs.Data.Text.At(i) != rhs.Data.Text.At(i) {
+		if lhs.Data.Text.At(i) != rhs.Data.Text.At(i) ||
+			!slices.Equal(lhs.Data.GetTextFormats(i), rhs.Data.GetTextFormats(i)) {
+			return false
+		}
+	}
+
+	if lhs.Data.Images.Len() != rhs.Data.Images.Len() {
+		return false
+	}
+
+	for i := 0; i < lhs.Data.Images.Len(); i++ {
+		lhsImage, rhsImage := lhs.Data.Images.At(i), rhs.Data.Images.At(i)
+		if lhsImage.Id != rhsImage.Id || lhsImage.MimeType != rhsImage.MimeType ||
+			lhsImage.Width != rhsImage.Width || lhsImage.Height != rhsImage.Height ||
+			lhsImage.Size != rhsImage.Size || !bytes.Equal(lhsImage.Data, rhsImage.Data) {
 			return false
 		}
 	}
 
 	return true
 }
+
+func IsEqualTextEntry(lhs TextEntry, rhs TextEntry) bool {
+	return lhs.Text == rhs.Text && slices.Equal(lhs.Formats, rhs.Formats)
+}
+
+func (e *TextEntry) Size() uint64 {
+	size := uint64(len(e.Text))
+	for _, format := range e.Formats {
+		size += uint64(len(format.Data))
+	}
+	return size
+}
+
+// Total size of the host clipboard history in bytes.
+func (d *ClipboardData) Size() uint64 {
+	var size uint64
+	for i := 0; i < d.Text.Len(); i++ {
+		entry := d.GetTextEntry(i)
+		size += entry.Size()
+	}
+	for i := 0; i < d.Images.Len(); i++ {
+		size += d.Images.At(i).Size
+	}
+	return size
+}
+
+// Drops the oldest entries until history fits into limits. The newest text and image are
+// dropped last.
+func (d *ClipboardData) ApplyLimits(limits ClientLimits) {
+	if limits.MaxHistoryEntries > 0 {
+		d.TrimText(limits.MaxHistoryEntries)
+	}
+	if limits.MaxHostBytes == 0 {
+		return
+	}
+	for d.Size() > limits.MaxHostBytes {
+		if d.Images.Len() > 1 {
+			d.Images.PopBack()
+		} else if d.Text.Len() > 1 {
+			d.TrimText(d.Text.Len() - 1)
+		} else if d.Images.Len() > 0 {
+			d.Images.PopBack()
+		} else if d.Text.Len() > 0 {
+			d.TrimText(0)
+		} else {
+			return
+		}
+	}
+}
+
+func (d *ClipboardData) GetTextFormats(index int) []TextFormat {
+	if index >= d.TextFormats.Len() {
+		return nil
+	}
+	return d.TextFormats.At(index)
+}
+
+func (d *ClipboardData) GetTextEntry(index int) TextEntry {
+	return TextEntry{Text: d.Text.At(index), Formats: d.GetTextFormats(index)}
+}
+
+func (d *ClipboardData) GetTextEntries() []TextEntry {
+	entries := make([]TextEntry, d.Text.Len())
+	for i := range entries {
+		entries[i] = d.GetTextEntry(i)
+	}
+	return entries
+}
+
+// Adds entry to the front of the text history.
+func (d *ClipboardData) PushText(entry TextEntry) {
+	for d.TextFormats.Len() < d.Text.Len() {
+		d.TextFormats.PushBack(nil)
+	}
+	d.Text.PushFront(entry.Text)
+	d.TextFormats.PushFront(entry.Formats)
+}
+
+func (d *ClipboardData) SetTextEntries(entries []TextEntry) {
+	d.Text.Clear()
+	d.TextFormats.Clear()
+	for _, entry := range entries {
+		d.Text.PushBack(entry.Text)
+		d.TextFormats.PushBack(entry.Formats)
+	}
+}
+
+func (d *ClipboardData) TrimText(maxEntries int) {
+	for d.Text.Len() > maxEntries {
+		d.Text.PopBack()
+	}
+	for d.TextFormats.Len() > d.Text.Len() {
+		d.TextFormats.PopBack()
+	}
+}
+
+func (d *ClipboardData) FindImage(imageId uint64) *ImageData {
+	for i := 0; i < d.Images.Len(); i++ {
+		if d.Images.At(i).Id == imageId {
+			image := d.Images.At(i)
+			return &image
+		}
+	}
+	return nil
+}
@@ -0,0 +1,583 @@
+package internal
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const commandsHelp = "Commands: \n" +
+	"\tclient add --group=[GROUP] --name=[NAME] - add client and print its secret\n" +
+	"\tclient remove --group=[GROUP] --name=[NAME] - remove client\n" +
+	"\tclient rotate-secret --group=[GROUP] --name=[NAME] - generate new client secret\n" +
+	"\tclient enroll --group=[GROUP] [--ttl=[DURATION]] - create one-time code for adding new client\n" +
+	"\tgroup add --name=[NAME] - add empty group\n" +
+	"\tgroup list - list groups and their clients\n" +
+	"\tconfig validate - check config for errors\n" +
+	"\tconfig hash-secrets - replace plain client secrets in config with their hashes\n" +
+	"\tcert generate [--hosts=[HOSTS]] [--days=[DAYS]] [--force] - generate self-signed certificate\n" +
+	"\tcert fingerprint - print certificate fingerprints for pinning on clients\n" +
+	"\tcert issue-client --group=[GROUP] --name=[NAME] [--days=[DAYS]] [--out=[PATH]] - issue client certificate\n" +
+	"\tadmin token [--address=[ADDRESS]] - enable admin API and print its new token\n" +
+	"\taudit list [--since=[TIME]] [--until=[TIME]] [--client=[CLIENT]] - verify audit log and print its records\n" +
+	"\tstatus [--watch=[DURATION]] [--token=[TOKEN]] - show connected clients of the running server\n" +
+	"[GROUP] is a group name, or index for groups without name.\n" +
+	"[HOSTS] is a comma separated list of host names and IP addresses (default is this host name and loopback).\n" +
+	"[TIME] is 'YYYY-MM-DD HH:MM:SS' in UTC, RFC 3339 time, or duration before now, e.g. 24h.\n" +
+	"[CLIENT] is a client name or public ID.\n" +
+	"[ADDRESS] is a loopback address with port, or Unix socket path with 'unix:' prefix.\n" +
+	"[TOKEN] is the admin API token, " + AdminTokenEnv + " environment variable is used if it is not set.\n" +
+	"Running server applies config changes on SIGHUP, or right away if it runs with --watch-config.\n\n"
+
+type commandHandler func(appDataDir string, args []string, output io.Writer) error
+
+var commands = map[string]commandHandler{
+	"client add":           runClientAdd,
+	"client remove":        runClientRemove,
+	"client rotate-secret": runClientRotateSecret,
+	"client enroll":        runClientEnroll,
+	"group add":            runGroupAdd,
+	"group list":           runGroupList,
+	"config validate":      runConfigValidate,
+	"config hash-secrets":  runConfigHashSecrets,
+	"cert generate":        runCertGenerate,
+	"cert fingerprint":     runCertFingerprint,
+	"cert issue-client":    runCertIssueClient,
+	"admin token":          runAdminToken,
+	"audit list":           runAuditList,
+	"status":               runStatus,
+}
+
+// Commands which change server state are recorded in the audit log.
+var auditedCommands = map[string]string{
+	"client add":           AuditAdminCommand,
+	"client remove":        AuditAdminCommand,
+	"client rotate-secret": AuditSecretRotated,
+	"client enroll":        AuditAdminCommand,
+	"group add":            AuditAdminCommand,
+	"config hash-secrets":  AuditAdminCommand,
+	"cert generate":        AuditAdminCommand,
+	"cert issue-client":    AuditAdminCommand,
+	"admin token":          AuditAdminCommand,
+}
+
+// Runs administrative command, args are the command line arguments left after the server flags.
+func RunCommand(appDataDir string, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("command is empty")
+	}
+	// Most commands consist of two words, like 'client add'.
+	words := 1
+	if _, exists := commands[args[0]]; !exists && len(args) >= 2 {
+		words = 2
+	}
+	command := strings.Join(args[:words], " ")
+	handler, exists := commands[command]
+	if !exists {
+		return fmt.Errorf("unknown command '%s'", command)
+	}
+	// Commands which change server state hold the config lock, so they don't lose changes made by
+	// the running server or by another command at the same time.
+	if _, audited := auditedCommands[command]; audited {
+		unlock, err := LockServerConfig(appDataDir)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	err := handler(appDataDir, args[words:], os.Stdout)
+	if event, audited := auditedCommands[command]; audited {
+		record := AuditRecord{Event: event, Details: strings.Join(args, " ")}
+		if err != nil {
+			record.Details += ", failed: " + err.Error()
+		}
+		if auditErr := appendCommandAudit(appDataDir, record); auditErr != nil {
+			if err != nil {
+				return errors.Join(err, fmt.Errorf("command was not recorded: %w", auditErr))
+			}
+			return fmt.Errorf("command was done, but it was not recorded: %w", auditErr)
+		}
+	}
+	return err
+}
+
+func appendCommandAudit(appDataDir string, record AuditRecord) error {
+	serverKey, err := openAuditKey(appDataDir)
+	if err != nil {
+		return err
+	}
+	return OpenAuditLog(appDataDir, serverKey).Append(record)
+}
+
+// Audit log is chained with the server key, it is created if it doesn't exist yet, even if there
+// is no config.
+func openAuditKey(appDataDir string) ([]byte, error) {
+	config, err := ReadServerConfig(appDataDir)
+	if errors.Is(err, os.ErrNotExist) {
+		config, err = nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return OpenServerKey(appDataDir, config)
+}
+
+func runClientAdd(appDataDir string, args []string, output io.Writer) error {
+	flags := flag.NewFlagSet("client add", flag.ContinueOnError)
+	groupName := flags.String("group", "", "Group of the client")
+	name := flags.String("name", "", "Client name")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if len(*name) == 0 {
+		return fmt.Errorf("client name is required")
+	}
+
+	config, err := ReadServerConfig(appDataDir)
+	if err != nil {
+		return err
+	}
+	groupConfig, err := FindGroupConfig(config, *groupName)
+	if err != nil {
+		return err
+	}
+	for _, clientConfig := range groupConfig.Clients {
+		if clientConfig.Name == *name {
+			return fmt.Errorf("client '%s' already exists in the group", *name)
+		}
+	}
+
+	serverKey, err := OpenServerKey(appDataDir, config)
+	if err != nil {
+		return err
+	}
+	secret, err := GenerateSecret()
+	if err != nil {
+		return err
+	}
+	clientConfig := ClientConfig{PublicId: NextPublicId(config), Name: *name}
+	if err = SetClientSecret(serverKey, &clientConfig, secret); err != nil {
+		return err
+	}
+	groupConfig.Clients = append(groupConfig.Clients, clientConfig)
+	if err = saveEditedConfig(appDataDir, config); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(output, "Client '%s' was added with public ID %d.\nSecret: %s\n",
+		clientConfig.Name, clientConfig.PublicId, secret)
+	return nil
+}
+
+func runClientRemove(appDataDir string, args []string, output io.Writer) error {
+	flags := flag.NewFlagSet("client remove", flag.ContinueOnError)
+	groupName := flags.String("group", "", "Group of the client")
+	name := flags.String("name", "", "Client name")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	config, err := ReadServerConfig(appDataDir)
+	if err != nil {
+		return err
+	}
+	groupConfig, err := FindGroupConfig(config, *groupName)
+	if err != nil {
+		return err
+	}
+	index, err := findClientConfig(groupConfig, *name)
+	if err != nil {
+		return err
+	}
+	groupConfig.Clients = append(groupConfig.Clients[:index], groupConfig.Clients[index+1:]...)
+	if err = saveEditedConfig(appDataDir, config); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(output, "Client '%s' was removed.\n", *name)
+	return nil
+}
+
+func runClientRotateSecret(appDataDir string, args []string, output io.Writer) error {
+	flags := flag.NewFlagSet("client rotate-secret", flag.ContinueOnError)
+	groupName := flags.String("group", "", "Group of the client")
+	name := flags.String("name", "", "Client name")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	config, err := ReadServerConfig(appDataDir)
+	if err != nil {
+		return err
+	}
+	groupConfig, err := FindGroupConfig(config, *groupName)
+	if err != nil {
+		return err
+	}
+	index, err := findClientConfig(groupConfig, *name)
+	if err != nil {
+		return err
+	}
+	serverKey, err := OpenServerKey(appDataDir, config)
+	if err != nil {
+		return err
+	}
+	secret, err := GenerateSecret()
+	if err != nil {
+		return err
+	}
+	if err = SetClientSecret(serverKey, &groupConfig.Clients[index], secret); err != nil {
+		return err
+	}
+	if err = saveEditedConfig(appDataDir, config); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(output, "Secret of client '%s' was changed.\nSecret: %s\n", *name, secret)
+	return nil
+}
+
+func runClientEnroll(appDataDir string, args []string, output io.Writer) error {
+	flags := flag.NewFlagSet("client enroll", flag.ContinueOnError)
+	groupName := flags.String("group", "", "Group to enroll client into")
+	ttl := flags.Duration("ttl", DefaultEnrollmentTtl, "Time the code is valid for")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *ttl <= 0 {
+		return fmt.Errorf("code validity time must be positive")
+	}
+
+	config, err := ReadServerConfig(appDataDir)
+	if err != nil {
+		return err
+	}
+	if _, err = FindGroupConfig(config, *groupName); err != nil {
+		return err
+	}
+	if GetClientAuth(config) == ClientAuthCertificate {
+		return ErrEnrollmentDisabled
+	}
+	serverKey, err := OpenServerKey(appDataDir, config)
+	if err != nil {
+		return err
+	}
+	code, err := CreateEnrollmentCode(appDataDir, serverKey, *groupName, *ttl)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(output, "Enrollment code: %s\nIt may be used once until %s.\n",
+		code, time.Now().Add(*ttl).Format(time.DateTime))
+	return nil
+}
+
+func runGroupAdd(appDataDir string, args []string, output io.Writer) error {
+	flags := flag.NewFlagSet("group add", flag.ContinueOnError)
+	name := flags.String("name", "", "Group name")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if len(*name) == 0 {
+		return fmt.Errorf("group name is required")
+	}
+
+	config, err := ReadServerConfig(appDataDir)
+	if errors.Is(err, os.ErrNotExist) {
+		config, err = &Config{}, nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, err = FindGroupConfig(config, *name); err == nil {
+		return fmt.Errorf("group '%s' already exists", *name)
+	}
+
+	config.Groups = append(config.Groups, GroupConfig{Name: *name})
+	if err = saveEditedConfig(appDataDir, config); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(output, "Group '%s' was added.\n", *name)
+	return nil
+}
+
+func runGroupList(appDataDir string, args []string, output io.Writer) error {
+	config, err := ReadServerConfig(appDataDir)
+	if err != nil {
+		return err
+	}
+
+	for index := range config.Groups {
+		fmt.Fprintf(output, "Group %s:\n", groupDisplayName(config, index))
+		for _, clientConfig := range config.Groups[index].Clients {
+			fmt.Fprintf(output, "\t%d\t%s\n", clientConfig.PublicId, clientConfig.Name)
+		}
+	}
+	return nil
+}
+
+func runConfigValidate(appDataDir string, args []string, output io.Writer) error {
+	config, err := ReadServerConfig(appDataDir)
+	if err != nil {
+		return err
+	}
+	if err = ValidateConfig(config); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(output, "Config is valid.")
+	return nil
+}
+
+func runConfigHashSecrets(appDataDir string, args []string, output io.Writer) error {
+	config, err := ReadServerConfig(appDataDir)
+	if err != nil {
+		return err
+	}
+	serverKey, err := OpenServerKey(appDataDir, config)
+	if err != nil {
+		return err
+	}
+
+	hashed := 0
+	for groupIndex := range config.Groups {
+		for clientIndex := range config.Groups[groupIndex].Clients {
+			clientConfig := &config.Groups[groupIndex].Clients[clientIndex]
+			if len(clientConfig.Secret) == 0 {
+				continue
+			}
+			if err = SetClientSecret(serverKey, clientConfig, clientConfig.Secret); err != nil {
+				return fmt.Errorf("client '%s': %w", clientConfig.Name, err)
+			}
+			hashed++
+		}
+	}
+	if hashed == 0 {
+		fmt.Fprintln(output, "Config has no plain secrets.")
+		return nil
+	}
+	if err = saveEditedConfig(appDataDir, config); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(output, "Secrets of %d clients were hashed, keep '%s' to let them connect.\n",
+		hashed, ServerKeyFileName)
+	return nil
+}
+
+func runCertGenerate(appDataDir string, args []string, output io.Writer) error {
+	flags := flag.NewFlagSet("cert generate", flag.ContinueOnError)
+	hosts := flags.String("hosts", strings.Join(DefaultCertHosts(), ","), "Certificate host names and IPs")
+	days := flags.Int("days", int(DefaultCertValidity/(24*time.Hour)), "Certificate validity in days")
+	force := flags.Bool("force", false, "Overwrite existing certificate")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *days <= 0 {
+		return fmt.Errorf("certificate validity must be positive")
+	}
+	if _, err := os.Stat(CertFilePath(appDataDir)); err == nil && !*force {
+		return fmt.Errorf("certificate already exists, use --force to replace it")
+	}
+
+	err := GenerateCertificate(appDataDir, ParseCertHosts(*hosts), time.Duration(*days)*24*time.Hour)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(output, "Certificate was written to '%s'.\n", CertFilePath(appDataDir))
+	return runCertFingerprint(appDataDir, nil, output)
+}
+
+func runCertFingerprint(appDataDir string, args []string, output io.Writer) error {
+	cert, err := ReadCertificate(appDataDir)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(output, "Hosts: %s\n", strings.Join(certHosts(cert), ", "))
+	fmt.Fprintf(output, "Expires: %s\n", cert.NotAfter.Format(time.DateTime))
+	fmt.Fprintf(output, "Certificate SHA-256: %s\n", CertificateFingerprint(cert))
+	fmt.Fprintf(output, "Public key SHA-256: %s\n", PublicKeyFingerprint(cert))
+	return nil
+}
+
+func runCertIssueClient(appDataDir string, args []string, output io.Writer) error {
+	flags := flag.NewFlagSet("cert issue-client", flag.ContinueOnError)
+	groupName := flags.String("group", "", "Group of the client")
+	name := flags.String("name", "", "Client name")
+	days := flags.Int("days", int(DefaultCertValidity/(24*time.Hour)), "Certificate validity in days")
+	outDir := flags.String("out", ".", "Directory to write client certificate and key to")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *days <= 0 {
+		return fmt.Errorf("certificate validity must be positive")
+	}
+
+	config, err := ReadServerConfig(appDataDir)
+	if err != nil {
+		return err
+	}
+	groupConfig, err := FindGroupConfig(config, *groupName)
+	if err != nil {
+		return err
+	}
+	index, err := findClientConfig(groupConfig, *name)
+	if err != nil {
+		return err
+	}
+
+	certPem, keyPem, err := IssueClientCertificate(appDataDir, *name, time.Duration(*days)*24*time.Hour)
+	if err != nil {
+		return err
+	}
+	cert, err := parseCertificatePem(certPem)
+	if err != nil {
+		return err
+	}
+	certPath := filepath.Join(*outDir, *name+"-cert.pem")
+	keyPath := filepath.Join(*outDir, *name+"-key.pem")
+	if err = writeFileAtomic(keyPath, keyPem, 0600); err != nil {
+		return fmt.Errorf("unable to write client key: %w", err)
+	}
+	if err = writeFileAtomic(certPath, certPem, 0644); err != nil {
+		return fmt.Errorf("unable to write client certificate: %w", err)
+	}
+
+	groupConfig.Clients[index].CertFingerprint = CertificateFingerprint(cert)
+	if err = saveEditedConfig(appDataDir, config); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(output, "Certificate of client '%s' was written to '%s' and '%s'.\nFingerprint: %s\n",
+		*name, certPath, keyPath, groupConfig.Clients[index].CertFingerprint)
+	if GetClientAuth(config) == ClientAuthSecret {
+		fmt.Fprintf(output, "Set \"ClientAuth\" in config to \"%s\" or \"%s\" to use it.\n",
+			ClientAuthCertificate, ClientAuthAny)
+	}
+	return nil
+}
+
+func runAdminToken(appDataDir string, args []string, output io.Writer) error {
+	flags := flag.NewFlagSet("admin token", flag.ContinueOnError)
+	address := flags.String("address", "", "Admin API address, the current one is kept if it is empty")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	config, err := ReadServerConfig(appDataDir)
+	if err != nil {
+		return err
+	}
+	serverKey, err := OpenServerKey(appDataDir, config)
+	if err != nil {
+		return err
+	}
+	token, err := GenerateSecret()
+	if err != nil {
+		return err
+	}
+	decoded, err := DecodeSecret(token)
+	if err != nil {
+		return err
+	}
+	if config.Admin == nil {
+		config.Admin = &AdminConfig{}
+	}
+	if len(*address) != 0 {
+		config.Admin.Address = *address
+	}
+	config.Admin.TokenHash = EncodeSecretHash(HashSecret(serverKey, decoded))
+	if err = saveEditedConfig(appDataDir, config); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(output, "Admin API token was changed, API is served on %s.\nToken: %s\n",
+		GetAdminAddress(config.Admin), token)
+	return nil
+}
+
+func runAuditList(appDataDir string, args []string, output io.Writer) error {
+	flags := flag.NewFlagSet("audit list", flag.ContinueOnError)
+	since := flags.String("since", "", "Print records after this time")
+	until := flags.String("until", "", "Print records before this time")
+	client := flags.String("client", "", "Print records of the client with this name or public ID")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	filter := AuditFilter{Client: *client}
+	var err error
+	if filter.Since, err = parseAuditTime(*since); err != nil {
+		return err
+	}
+	if filter.Until, err = parseAuditTime(*until); err != nil {
+		return err
+	}
+	serverKey, err := openAuditKey(appDataDir)
+	if err != nil {
+		return err
+	}
+	records, verification, err := ReadAuditLog(appDataDir, serverKey, filter)
+	for _, record := range records {
+		fmt.Fprintf(output, "%s\t%s", record.Time.Format(time.DateTime), record.Event)
+		if len(record.Group) != 0 {
+			fmt.Fprintf(output, "\tgroup=%s", record.Group)
+		}
+		if record.ClientId != 0 || len(record.Client) != 0 {
+			fmt.Fprintf(output, "\tclient=%d '%s'", record.ClientId, record.Client)
+		}
+		if len(record.Address) != 0 {
+			fmt.Fprintf(output, "\taddress=%s", record.Address)
+		}
+		if len(record.Details) != 0 {
+			fmt.Fprintf(output, "\t%s", record.Details)
+		}
+		fmt.Fprintln(output)
+	}
+	fmt.Fprintf(output, "%d records were verified, the last hash: %s\n", verification.Records, verification.LastHash)
+	return err
+}
+
+// Empty value means no limit.
+func parseAuditTime(value string) (time.Time, error) {
+	if len(value) == 0 {
+		return time.Time{}, nil
+	}
+	if duration, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-duration), nil
+	}
+	if result, err := time.Parse(time.RFC3339, value); err == nil {
+		return result, nil
+	}
+	result, err := time.Parse(time.DateTime, value)
+	if err != nil {
+		return result, fmt.Errorf("wrong time '%s'", value)
+	}
+	return result, nil
+}
+
+func findClientConfig(groupConfig *GroupConfig, name string) (int, error) {
+	for index, clientConfig := range groupConfig.Clients {
+		if clientConfig.Name == name {
+			return index, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown client '%s'", name)
+}
+
+// Edited config is validated before it is written, so the running server is able to reload it.
+func saveEditedConfig(appDataDir string, config *Config) error {
+	if err := ValidateConfig(config); err != nil {
+		return fmt.Errorf("config is not valid, it was not changed: %w", err)
+	}
+	if err := WriteServerConfig(appDataDir, config); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+package internal
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+const SecretSize = 64
+
+func DecodeSecret(secretStr string) ([SecretSize]byte, error) {
+	var result [SecretSize]byte
+	decodedSecret, err := base64.StdEncoding.DecodeString(secretStr)
+	if err != nil {
+		return result, fmt.Errorf("unable to decode secret: %s", secretStr)
+	}
+	copy(result[:], decodedSecret)
+	return result, nil
+}
+
+func GenerateSecret() (string, error) {
+	var secret [SecretSize]byte
+	if _, err := rand.Read(secret[:]); err != nil {
+		return "", fmt.Errorf("unable to generate secret: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(secret[:]), nil
+}
+
+// Checks everything that server checks on start, and also things which are not fatal for the
+// server but are most likely mistakes.
+func ValidateConfig(config *Config) error {
+	var errs []error
+	knownSecrets := make(map[[SecretSize]byte]string)
+	knownHashes := make(map[string]string)
+	knownCerts := make(map[CertDigest]string)
+	switch config.ClientAuth {
+	case "", ClientAuthSecret, ClientAuthCertificate, ClientAuthAny:
+	default:
+		errs = append(errs, fmt.Errorf("unknown client authentication mode '%s'", config.ClientAuth))
+	}
+	if err := validateHeartbeatConfig(config.Heartbeat); err != nil {
+		errs = append(errs, err)
+	}
+	if err := validateSessionPolicy(config.SessionPolicy); err != nil {
+		errs = append(errs, err)
+	}
+	if err := validateOutboxConfig(config.Outbox); err != nil {
+		errs = append(errs, err)
+	}
+	if err := validateWriteQueueConfig(config.WriteQueue); err != nil {
+		errs = append(errs, err)
+	}
+	if err := validateMetricsAddress(config.MetricsAddress); err != nil {
+		errs = append(errs, err)
+	}
+	if err := validateAdminConfig(config.Admin); err != nil {
+		errs = append(errs, err)
+	}
+	if err := ValidateLimitsConfig(config.Limits); err != nil {
+		errs = append(errs, err)
+	}
+
+	knownGroupNames := make(map[string]bool)
+	for groupIndex, groupConfig := range config.Groups {
+		if len(groupConfig.Name) != 0 {
+			if knownGroupNames[groupConfig.Name] {
+				errs = append(errs, fmt.Errorf("group name '%s' is used multiple times", groupConfig.Name))
+			}
+			knownGroupNames[groupConfig.Name] = true
+		}
+		if err := ValidateLimitsConfig(groupConfig.Limits); err != nil {
+			errs = append(errs, fmt.Errorf("group %s: %w", groupDisplayName(config, groupIndex), err))
+		}
+
+		knownIds := make(map[uint64]bool)
+		for _, clientConfig := range groupConfig.Clients {
+			where := fmt.Sprintf("client '%s' of group %s", clientConfig.Name, groupDisplayName(config, groupIndex))
+			if len(clientConfig.Name) == 0 {
+				errs = append(errs, fmt.Errorf("%s has empty name", where))
+			}
+			if err := ValidateLimitsConfig(clientConfig.Limits); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", where, err))
+			}
+			if knownIds[clientConfig.PublicId] {
+				errs = append(errs, fmt.Errorf("%s has public ID %d which is already used in the group",
+					where, clientConfig.PublicId))
+			}
+			knownIds[clientConfig.PublicId] = true
+
+			if len(clientConfig.CertFingerprint) != 0 {
+				digest, err := DecodeFingerprint(clientConfig.CertFingerprint)
+				if err != nil {
+					errs = append(errs, fmt.Errorf("%s has certificate fingerprint which is not valid", where))
+				} else if other, exists := knownCerts[digest]; exists {
+					errs = append(errs, fmt.Errorf("%s has the same certificate as %s", where, other))
+				}
+				knownCerts[digest] = where
+			}
+			if len(clientConfig.Secret) == 0 && len(clientConfig.SecretHash) == 0 {
+				if len(clientConfig.CertFingerprint) == 0 {
+					errs = append(errs, fmt.Errorf("%s has neither secret nor certificate", where))
+				}
+				continue
+			}
+
+			if len(clientConfig.SecretHash) != 0 {
+				if len(clientConfig.Secret) != 0 {
+					errs = append(errs, fmt.Errorf("%s has both secret and secret hash", where))
+				}
+				if _, err := DecodeSecretHash(clientConfig.SecretHash); err != nil {
+					errs = append(errs, fmt.Errorf("%s has secret hash which is not valid", where))
+					continue
+				}
+				if other, exists := knownHashes[clientConfig.SecretHash]; exists {
+					errs = append(errs, fmt.Errorf("%s has the same secret as %s", where, other))
+				}
+				knownHashes[clientConfig.SecretHash] = where
+				continue
+			}
+
+			decoded, err := base64.StdEncoding.DecodeString(clientConfig.Secret)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s has secret which is not valid base64", where))
+				continue
+			}
+			if len(decoded) != SecretSize {
+				errs = append(errs, fmt.Errorf("%s has secret of %d bytes instead of %d", where,
+					len(decoded), SecretSize))
+			}
+			secret, _ := DecodeSecret(clientConfig.Secret)
+			if other, exists := knownSecrets[secret]; exists {
+				errs = append(errs, fmt.Errorf("%s has the same secret as %s", where, other))
+			}
+			knownSecrets[secret] = where
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Writes config to the temporary file and renames it, so config is never left partially written.
+func WriteServerConfig(appDataDir string, config *Config) error {
+	data, err := json.MarshalIndent(config, "", "    ")
+	if err != nil {
+		return fmt.Errorf("unable to serialize config: %w", err)
+	}
+	data = append(data, '\n')
+
+	if err = writeFileAtomic(filepath.Join(appDataDir, ConfigFileName), data, 0600); err != nil {
+		return fmt.Errorf("unable to write config: %w", err)
+	}
+	return nil
+}
+
+// Writes data to the temporary file in the same directory and renames it over the target path.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	tmpFile, err := os.CreateTemp(dir, filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmpFile.Name()
+
+	_, err = tmpFile.Write(data)
+	if err == nil {
+		err = tmpFile.Chmod(perm)
+	}
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	tmpFile.Close()
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	syncDir(dir)
+	return nil
+}
+
+// Picks an ID which is not used in any group.
+func NextPublicId(config *Config) uint64 {
+	var maxId uint64
+	for _, groupConfig := range config.Groups {
+		for _, clientConfig := range groupConfig.Clients {
+			maxId = max(maxId, clientConfig.PublicId)
+		}
+	}
+	return maxId + 1
+}
+
+// Finds group by name, or by index for groups without name. Empty name is accepted only when there is
+// a single group, otherwise it would silently pick the first unnamed one.
+func FindGroupConfig(config *Config, nameOrIndex string) (*GroupConfig, error) {
+	if len(nameOrIndex) == 0 {
+		if len(config.Groups) != 1 {
+			return nil, fmt.Errorf("group name or index is required, config has %d groups", len(config.Groups))
+		}
+		return &config.Groups[0], nil
+	}
+	for index := range config.Groups {
+		if config.Groups[index].Name == nameOrIndex {
+			return &config.Groups[index], nil
+		}
+	}
+	index, err := strconv.Atoi(nameOrIndex)
+	if err == nil && index >= 0 && index < len(config.Groups) {
+		return &config.Groups[index], nil
+	}
+	return nil, fmt.Errorf("unknown group '%s'", nameOrIndex)
+}
+
+func groupDisplayName(config *Config, index int) string {
+	if len(config.Groups[index].Name) != 0 {
+		return fmt.Sprintf("'%s'", config.Groups[index].Name)
+	}
+	return fmt.Sprintf("#%d", index)
+}
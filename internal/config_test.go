@@ -0,0 +1,185 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateConfig(t *testing.T) {
+	secret, _ := GenerateSecret()
+	config := Config{MetricsAddress: "0.0.0.0:9090", Groups: []GroupConfig{
+		{Clients: []ClientConfig{
+			{Secret: secret, PublicId: 1, Name: "name1"},
+			{Secret: secret, PublicId: 1, Name: "name2"},
+			{Secret: base64.StdEncoding.EncodeToString([]byte("short")), PublicId: 3, Name: "name3"},
+		}},
+		{Name: "second", Clients: []ClientConfig{
+			{CertFingerprint: strings.Repeat("00", 32), PublicId: 3, Name: "name4",
+				Limits: &LimitsConfig{MaxHistoryEntries: -1}},
+		}},
+	}}
+
+	err := ValidateConfig(&config)
+	if err == nil {
+		t.Fatal("Invalid config was accepted")
+	}
+	if strings.Contains(err.Error(), "public ID 3") {
+		t.Errorf("Public ID used in two groups was reported: %s", err.Error())
+	}
+	for _, expected := range []string{"same secret", "public ID 1", "secret of 5 bytes", "must not be negative",
+		"not a loopback one"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("Error '%s' was not reported: %s", expected, err.Error())
+		}
+	}
+}
+
+func TestClientCommands(t *testing.T) {
+	dir := t.TempDir()
+	var output bytes.Buffer
+	if err := runGroupAdd(dir, []string{"--name=home"}, &output); err != nil {
+		t.Fatalf("Unable to add group: %s", err.Error())
+	}
+	if err := runClientAdd(dir, []string{"--group=home", "--name=laptop"}, &output); err != nil {
+		t.Fatalf("Unable to add client: %s", err.Error())
+	}
+	if err := runClientAdd(dir, []string{"--group=home", "--name=desktop"}, &output); err != nil {
+		t.Fatalf("Unable to add client: %s", err.Error())
+	}
+
+	config, err := ReadServerConfig(dir)
+	if err != nil {
+		t.Fatalf("Unable to read written config: %s", err.Error())
+	}
+	clients := config.Groups[0].Clients
+	if len(clients) != 2 || clients[0].PublicId == clients[1].PublicId {
+		t.Fatalf("Wrong clients were added: %v", clients)
+	}
+	if err = ValidateConfig(config); err != nil {
+		t.Errorf("Written config is not valid: %s", err.Error())
+	}
+
+	if err = runClientRotateSecret(dir, []string{"--group=0", "--name=laptop"}, &output); err != nil {
+		t.Fatalf("Unable to rotate secret: %s", err.Error())
+	}
+	if err = runClientRemove(dir, []string{"--group=home", "--name=desktop"}, &output); err != nil {
+		t.Fatalf("Unable to remove client: %s", err.Error())
+	}
+
+	newConfig, err := ReadServerConfig(dir)
+	if err != nil {
+		t.Fatalf("Unable to read written config: %s", err.Error())
+	}
+	newClients := newConfig.Groups[0].Clients
+	if len(newClients) != 1 || newClients[0].Name != "laptop" {
+		t.Fatalf("Wrong clients after removal: %v", newClients)
+	}
+	if newClients[0].SecretHash == clients[0].SecretHash || newClients[0].PublicId != clients[0].PublicId {
+		t.Error("Secret was not rotated correctly")
+	}
+}
+
+func TestConfigHashSecrets(t *testing.T) {
+	dir := t.TempDir()
+	secret, _ := GenerateSecret()
+	config := &Config{Groups: []GroupConfig{
+		{Clients: []ClientConfig{{Secret: secret, PublicId: 1, Name: "name1"}}},
+	}}
+	if err := WriteServerConfig(dir, config); err != nil {
+		t.Fatalf("Unable to write config: %s", err.Error())
+	}
+	var output bytes.Buffer
+	if err := runConfigHashSecrets(dir, nil, &output); err != nil {
+		t.Fatalf("Unable to hash secrets: %s", err.Error())
+	}
+
+	newConfig, err := ReadServerConfig(dir)
+	if err != nil {
+		t.Fatalf("Unable to read written config: %s", err.Error())
+	}
+	clientConfig := &newConfig.Groups[0].Clients[0]
+	if len(clientConfig.Secret) != 0 || len(clientConfig.SecretHash) == 0 {
+		t.Fatal("Secret was not hashed")
+	}
+
+	serverKey, err := OpenServerKey(dir, newConfig)
+	if err != nil {
+		t.Fatalf("Unable to open server key: %s", err.Error())
+	}
+	decoded, _ := DecodeSecret(secret)
+	digest, _ := ClientSecretDigest(serverKey, clientConfig)
+	if digest != HashSecret(serverKey, decoded) {
+		t.Error("Hashed secret doesn't match the original secret")
+	}
+
+	if _, err = OpenServerKey(t.TempDir(), newConfig); err == nil {
+		t.Error("New server key was created for config with hashed secrets")
+	}
+}
+
+func TestClientCommandsRequireGroup(t *testing.T) {
+	dir := t.TempDir()
+	var output bytes.Buffer
+	if err := runGroupAdd(dir, []string{"--name=home"}, &output); err != nil {
+		t.Fatalf("Unable to add group: %s", err.Error())
+	}
+	if err := runClientAdd(dir, []string{"--name=laptop"}, &output); err != nil {
+		t.Errorf("Group was required with a single group: %s", err.Error())
+	}
+
+	if err := runGroupAdd(dir, []string{"--name=work"}, &output); err != nil {
+		t.Fatalf("Unable to add group: %s", err.Error())
+	}
+	if err := runClientAdd(dir, []string{"--name=desktop"}, &output); err == nil {
+		t.Error("Client was added without group when there are several groups")
+	}
+	if err := runClientEnroll(dir, []string{}, &output); err == nil {
+		t.Error("Enrollment code was created without group when there are several groups")
+	}
+	config, err := ReadServerConfig(dir)
+	if err != nil {
+		t.Fatalf("Unable to read written config: %s", err.Error())
+	}
+	if len(config.Groups[0].Clients) != 1 || len(config.Groups[1].Clients) != 0 {
+		t.Errorf("Wrong clients were added: %v", config.Groups)
+	}
+}
+
+func TestEnrollClient(t *testing.T) {
+	dir := t.TempDir()
+	var output bytes.Buffer
+	if err := runGroupAdd(dir, []string{"--name=home"}, &output); err != nil {
+		t.Fatalf("Unable to add group: %s", err.Error())
+	}
+	serverKey, err := OpenServerKey(dir, nil)
+	if err != nil {
+		t.Fatalf("Unable to open server key: %s", err.Error())
+	}
+	code, err := CreateEnrollmentCode(dir, serverKey, "home", time.Minute)
+	if err != nil {
+		t.Fatalf("Unable to create enrollment code: %s", err.Error())
+	}
+	expiredCode, _ := CreateEnrollmentCode(dir, serverKey, "home", -time.Minute)
+
+	typedCode := strings.ToLower(strings.ReplaceAll(code, "-", ""))
+	config, publicId, secret, err := EnrollClient(dir, serverKey, typedCode, "laptop")
+	if err != nil {
+		t.Fatalf("Unable to enroll client: %s", err.Error())
+	}
+	clientConfig := &config.Groups[0].Clients[0]
+	decoded, _ := DecodeSecret(secret)
+	digest, _ := ClientSecretDigest(serverKey, clientConfig)
+	if clientConfig.Name != "laptop" || clientConfig.PublicId != publicId || digest != HashSecret(serverKey, decoded) {
+		t.Errorf("Wrong client was enrolled: %v", clientConfig)
+	}
+
+	if _, _, _, err = EnrollClient(dir, serverKey, code, "desktop"); err != ErrUnknownEnrollmentCode {
+		t.Errorf("Enrollment code was used twice: %v", err)
+	}
+	if _, _, _, err = EnrollClient(dir, serverKey, expiredCode, "desktop"); err != ErrUnknownEnrollmentCode {
+		t.Errorf("Expired enrollment code was accepted: %v", err)
+	}
+}
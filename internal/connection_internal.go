@@ -1,17 +1,39 @@
 package internal
 
+import "time"
+
+// Counters of a single connection, they may be read from any goroutine.
+type ConnectionStats struct {
+	// Messages waiting in the write queue.
+	QueueDepth       int
+	MessagesReceived uint64
+	MessagesSent     uint64
+	// Time of the last message from the client, heartbeats are not counted.
+	LastActivity time.Time
+}
+
 type ClientConnectionDelegate interface {
 	OnDisconnected()
 	ProcessMessage(id uint64, msgType ClientMessageType, data []byte)
+	// Queued notifications which won't be sent, they were superseded by a later one.
+	OnMessagesDropped(ids []uint64)
 }
 
 type ClientConnection interface {
 	GetAdressString() string
 	ReadIntroduction() ([]byte, error)
+	// Protocol negotiated during introduction.
+	GetProtocol() ProtocolInfo
 	SetUp(delegate ClientConnectionDelegate, taskRunner EventLoop)
 
 	StartHandlingAsync()
 	DisconnectAndStop()
+	// Sends already queued messages and closes the connection, delegate is not used after that.
+	DrainAndStop()
 
 	SendMessage(id uint64, msgType ServerMessageType, data []byte)
+	// Same as SendMessage for notifications about the host, the connection may drop them when its
+	// write queue is full.
+	SendNotification(id uint64, msgType ServerMessageType, hostId uint64, data []byte)
+	GetStats() ConnectionStats
 }
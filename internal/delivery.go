@@ -0,0 +1,25 @@
+package internal
+
+import "time"
+
+// Client which doesn't acknowledge notifications must not make server keep them forever.
+const kMaxUnackedNotifications = 1000
+
+// Delivery state of the client notifications, it is used for debugging of slow or stuck clients.
+type DeliveryStats struct {
+	ClientId    uint64
+	Name        string
+	Connections int
+	// Notifications sent but not acknowledged yet, only clients which support acks are counted.
+	Unacked int
+	// Age of the oldest unacknowledged notification.
+	Lag            time.Duration
+	LastAckLatency time.Duration
+	Sessions       []SessionStats
+}
+
+type SessionStats struct {
+	Address string
+	Started time.Time
+	ConnectionStats
+}
@@ -0,0 +1,53 @@
+package internal
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"slices"
+)
+
+// Number of the latest changes kept by the group, older ones are available only as a snapshot.
+const kMaxSyncChanges = 1024
+
+// Clipboard mutation of the host. Type is one of TextUpdate, ImageUpdate and HostSynced, the last
+// one means that the host data was replaced, so it is sent as a whole.
+type ClipboardChange struct {
+	Sequence uint64
+	HostId   uint64
+	Type     ServerMessageType
+	Entry    *TextEntry
+	// Only image description, content is requested separately.
+	Image *ImageData
+	// Current host data of HostSynced change, it is filled when changes are sent.
+	Host *ClientData
+}
+
+// Changes after the requested sequence number. If they are not complete, because the requested
+// sequence is too old or belongs to another epoch, client must be sent the full snapshot.
+type ChangeSet struct {
+	// Sequence numbers are comparable only inside of the same epoch, it changes on server restart.
+	Epoch    uint64
+	Sequence uint64
+	Changes  []ClipboardChange
+	Complete bool
+}
+
+func generateSyncEpoch() uint64 {
+	var buffer [8]byte
+	rand.Read(buffer[:])
+	return binary.BigEndian.Uint64(buffer[:])
+}
+
+// Drops changes which are superseded by the later HostSynced change of the same host.
+func dropSupersededChanges(changes []ClipboardChange) []ClipboardChange {
+	lastSync := make(map[uint64]uint64)
+	for _, change := range changes {
+		if change.Type == HostSynced {
+			lastSync[change.HostId] = change.Sequence
+		}
+	}
+	return slices.DeleteFunc(changes, func(change ClipboardChange) bool {
+		syncSequence, exists := lastSync[change.HostId]
+		return exists && change.Sequence < syncSequence
+	})
+}
@@ -0,0 +1,189 @@
+package internal
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const EnrollmentsFileName = "enrollments.json"
+const DefaultEnrollmentTtl = 10 * time.Minute
+
+// Ambiguous characters like 0/O and 1/I are not used, so codes are easy to type.
+const enrollmentCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+const enrollmentCodeLength = 8
+
+var ErrUnknownEnrollmentCode = errors.New("enrollment code is unknown or expired")
+
+// Enrolled clients get secrets, which are not accepted if clients must present certificates.
+var ErrEnrollmentDisabled = errors.New("enrollment is not available when clients authenticate with certificates")
+
+// Only hash of the code is stored, so the file can't be used to enroll new clients.
+type enrollmentCode struct {
+	CodeHash string
+	Group    string
+	Expires  time.Time
+}
+
+// Creates one-time code which enrolls new client into the group until it expires.
+func CreateEnrollmentCode(appDataDir string, serverKey []byte, group string, ttl time.Duration) (string, error) {
+	var random [enrollmentCodeLength]byte
+	if _, err := rand.Read(random[:]); err != nil {
+		return "", fmt.Errorf("unable to generate enrollment code: %w", err)
+	}
+	var code strings.Builder
+	for index, value := range random {
+		if index == enrollmentCodeLength/2 {
+			code.WriteByte('-')
+		}
+		code.WriteByte(enrollmentCodeAlphabet[int(value)%len(enrollmentCodeAlphabet)])
+	}
+
+	unlock, err := lockSharedFile(enrollmentsPath(appDataDir))
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+	codes, err := loadEnrollmentCodes(appDataDir)
+	if err != nil {
+		return "", err
+	}
+	codes = append(codes, enrollmentCode{
+		CodeHash: hashEnrollmentCode(serverKey, code.String()),
+		Group:    group,
+		Expires:  time.Now().Add(ttl),
+	})
+	if err = saveEnrollmentCodes(appDataDir, codes); err != nil {
+		return "", err
+	}
+	return code.String(), nil
+}
+
+// Consumes enrollment code and adds new client to the config, config is written and returned, so
+// running server could apply it.
+func EnrollClient(appDataDir string, serverKey []byte, code string, name string) (
+	config *Config, publicId uint64, secret string, err error) {
+	if len(name) == 0 {
+		return nil, 0, "", fmt.Errorf("client name is required")
+	}
+	// Config is locked first, as commands which change it do.
+	unlockConfig, err := LockServerConfig(appDataDir)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	defer unlockConfig()
+	unlockCodes, err := lockSharedFile(enrollmentsPath(appDataDir))
+	if err != nil {
+		return nil, 0, "", err
+	}
+	defer unlockCodes()
+
+	config, err = ReadServerConfig(appDataDir)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	if GetClientAuth(config) == ClientAuthCertificate {
+		return nil, 0, "", ErrEnrollmentDisabled
+	}
+	codes, err := loadEnrollmentCodes(appDataDir)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	index := findEnrollmentCode(codes, hashEnrollmentCode(serverKey, code))
+	if index < 0 {
+		return nil, 0, "", ErrUnknownEnrollmentCode
+	}
+	groupConfig, err := FindGroupConfig(config, codes[index].Group)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	if _, err = findClientConfig(groupConfig, name); err == nil {
+		return nil, 0, "", fmt.Errorf("client '%s' already exists in the group", name)
+	}
+
+	// Code is consumed before config is written, so it is never used twice even if writing fails.
+	codes = append(codes[:index], codes[index+1:]...)
+	if err = saveEnrollmentCodes(appDataDir, codes); err != nil {
+		return nil, 0, "", err
+	}
+
+	if secret, err = GenerateSecret(); err != nil {
+		return nil, 0, "", err
+	}
+	clientConfig := ClientConfig{PublicId: NextPublicId(config), Name: name}
+	if err = SetClientSecret(serverKey, &clientConfig, secret); err != nil {
+		return nil, 0, "", err
+	}
+	groupConfig.Clients = append(groupConfig.Clients, clientConfig)
+	if err = saveEditedConfig(appDataDir, config); err != nil {
+		return nil, 0, "", err
+	}
+	return config, clientConfig.PublicId, secret, nil
+}
+
+// Codes are normalized, so they may be typed in lower case and without the dash.
+func hashEnrollmentCode(serverKey []byte, code string) string {
+	normalized := strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+	mac := hmac.New(sha256.New, serverKey)
+	mac.Write([]byte("enrollment:" + normalized))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Every unexpired code is compared, so the time doesn't depend on the position of the match.
+func findEnrollmentCode(codes []enrollmentCode, codeHash string) int {
+	result := -1
+	now := time.Now()
+	for index := range codes {
+		if hmac.Equal([]byte(codes[index].CodeHash), []byte(codeHash)) && now.Before(codes[index].Expires) {
+			result = index
+		}
+	}
+	return result
+}
+
+// Expired codes are dropped on load.
+func loadEnrollmentCodes(appDataDir string) ([]enrollmentCode, error) {
+	data, err := os.ReadFile(enrollmentsPath(appDataDir))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read enrollment codes: %w", err)
+	}
+	var codes []enrollmentCode
+	if err = json.Unmarshal(data, &codes); err != nil {
+		return nil, fmt.Errorf("unable to parse enrollment codes: %w", err)
+	}
+
+	now := time.Now()
+	result := codes[:0]
+	for _, code := range codes {
+		if now.Before(code.Expires) {
+			result = append(result, code)
+		}
+	}
+	return result, nil
+}
+
+func saveEnrollmentCodes(appDataDir string, codes []enrollmentCode) error {
+	data, err := json.MarshalIndent(codes, "", "    ")
+	if err != nil {
+		return fmt.Errorf("unable to serialize enrollment codes: %w", err)
+	}
+	if err = writeFileAtomic(enrollmentsPath(appDataDir), data, 0600); err != nil {
+		return fmt.Errorf("unable to write enrollment codes: %w", err)
+	}
+	return nil
+}
+
+func enrollmentsPath(appDataDir string) string {
+	return filepath.Join(appDataDir, EnrollmentsFileName)
+}
@@ -9,21 +9,25 @@ type EventLoopTask func()
 
 type EventLoop interface {
 	SetPostTimeout(timeout time.Duration)
-	PostTask(task EventLoopTask)
+	PostTask(task EventLoopTask) bool
 	Run()
 	RunUntilIdle()
 	Quit()
+	// Closed when Run returns, tasks which were not run by then are dropped.
+	Stopped() <-chan struct{}
 }
 
 type eventLoopImpl struct {
 	tasks   chan EventLoopTask
 	timeout time.Duration
 	running atomic.Bool
+	stopped chan struct{}
 }
 
 func CreateEventLoop(size int) *eventLoopImpl {
 	result := eventLoopImpl{
-		tasks: make(chan EventLoopTask, size),
+		tasks:   make(chan EventLoopTask, size),
+		stopped: make(chan struct{}),
 	}
 	result.running.Store(true)
 	result.timeout = time.Second * 10
@@ -34,9 +38,19 @@ func (el *eventLoopImpl) SetPostTimeout(timeout time.Duration) {
 	el.timeout = timeout
 }
 
-func (el *eventLoopImpl) PostTask(task EventLoopTask) {
+// Tasks posted after Quit are dropped, false is returned then.
+func (el *eventLoopImpl) PostTask(task EventLoopTask) bool {
+	if !el.running.Load() {
+		return false
+	}
+	posted := time.Now()
+	timedTask := func() {
+		GetMetrics().TaskStarted(time.Since(posted))
+		task()
+	}
 	select {
-	case el.tasks <- task:
+	case el.tasks <- timedTask:
+		return true
 	case <-time.After(el.timeout):
 		panic("Event loop was become irresponsible")
 	}
@@ -47,6 +61,7 @@ func (el *eventLoopImpl) Run() {
 		task := <-el.tasks
 		task()
 	}
+	close(el.stopped)
 }
 
 func (el *eventLoopImpl) RunUntilIdle() {
@@ -60,7 +75,16 @@ func (el *eventLoopImpl) RunUntilIdle() {
 	}
 }
 
+// May be called from a task of the loop itself.
 func (el *eventLoopImpl) Quit() {
 	el.running.Store(false)
-	el.tasks <- func() {}
+	// Wakes the loop up, it checks the flag after the current task anyway if the queue is full.
+	select {
+	case el.tasks <- func() {}:
+	default:
+	}
+}
+
+func (el *eventLoopImpl) Stopped() <-chan struct{} {
+	return el.stopped
 }
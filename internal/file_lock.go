@@ -0,0 +1,29 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Serializes read-modify-write of a file which is shared by the server and administrative
+// commands. Lock is held on a separate file, because data files are replaced on write.
+func lockSharedFile(path string) (func(), error) {
+	file, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open lock of %s: %w", filepath.Base(path), err)
+	}
+	if err = lockFile(file); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("unable to lock %s: %w", filepath.Base(path), err)
+	}
+	return func() {
+		unlockFile(file)
+		file.Close()
+	}, nil
+}
+
+// Locks config.json until the returned function is called.
+func LockServerConfig(appDataDir string) (func(), error) {
+	return lockSharedFile(filepath.Join(appDataDir, ConfigFileName))
+}
@@ -0,0 +1,14 @@
+//go:build !unix && !windows
+
+package internal
+
+import "os"
+
+// File locks are not supported, only one process may change the files at a time.
+func lockFile(file *os.File) error {
+	return nil
+}
+
+func unlockFile(file *os.File) error {
+	return nil
+}
@@ -0,0 +1,244 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const kDefaultFileQuota = 256 * 1024 * 1024
+const kFileChunkSize = 256 * 1024
+const kMaxFileNameLen = 255
+
+// Transfers which were not touched for this time are removed from the spool.
+const kFileTransferTtl = time.Hour
+
+type FileTransfer struct {
+	Id       uint64
+	SenderId uint64
+	// Zero target means that file is offered to every other host of the group.
+	TargetId uint64
+	FileName string
+	Size     uint64
+	Sha256   string
+	Uploaded uint64
+	Complete bool
+	touched  time.Time
+	// Hosts which have not downloaded the whole file yet, transfer is removed when it is empty.
+	pending map[uint64]bool
+}
+
+// FileSpool temporarily keeps files which are transferred between hosts of a single group.
+// It is not thread safe and must be used from the group event loop only.
+type FileSpool struct {
+	dir       string
+	quota     uint64
+	transfers map[uint64]*FileTransfer
+	idCounter uint64
+}
+
+// Creates spool inside of the given directory. Leftovers of previous runs are removed.
+func CreateFileSpool(dir string, quota uint64) (*FileSpool, error) {
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, fmt.Errorf("unable to clean file spool: %w", err)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("unable to create file spool: %w", err)
+	}
+	if quota == 0 {
+		quota = kDefaultFileQuota
+	}
+	return &FileSpool{
+		dir:       dir,
+		quota:     quota,
+		transfers: make(map[uint64]*FileTransfer),
+		idCounter: 1,
+	}, nil
+}
+
+// Registers new transfer, or returns the existing one if the same file was already offered by
+// the sender, so interrupted upload can be resumed from FileTransfer.Uploaded offset. Second
+// returned value is true if the transfer was created. File is kept until all receivers download it.
+func (s *FileSpool) Offer(senderId uint64, targetId uint64, fileName string, size uint64, sha256Hex string,
+	receivers []uint64) (*FileTransfer, bool, error) {
+	s.removeExpired()
+
+	if len(fileName) == 0 || len(fileName) > kMaxFileNameLen || filepath.Base(fileName) != fileName {
+		return nil, false, fmt.Errorf("wrong file name")
+	}
+	if size == 0 {
+		return nil, false, fmt.Errorf("file is empty")
+	}
+	if decoded, err := hex.DecodeString(sha256Hex); err != nil || len(decoded) != sha256.Size {
+		return nil, false, fmt.Errorf("wrong file checksum format")
+	}
+	sha256Hex = strings.ToLower(sha256Hex)
+
+	for _, transfer := range s.transfers {
+		if transfer.SenderId == senderId && transfer.TargetId == targetId &&
+			transfer.Size == size && transfer.Sha256 == sha256Hex && transfer.FileName == fileName {
+			transfer.touched = time.Now()
+			return transfer, false, nil
+		}
+	}
+
+	if used := s.usedSpace(); used > s.quota || size > s.quota-used {
+		return nil, false, fmt.Errorf("group file quota exceeded")
+	}
+
+	file, err := os.Create(s.transferPath(s.idCounter))
+	if err != nil {
+		return nil, false, fmt.Errorf("unable to create spool file: %w", err)
+	}
+	file.Close()
+
+	transfer := &FileTransfer{
+		Id:       s.idCounter,
+		SenderId: senderId,
+		TargetId: targetId,
+		FileName: fileName,
+		Size:     size,
+		Sha256:   sha256Hex,
+		touched:  time.Now(),
+		pending:  make(map[uint64]bool),
+	}
+	for _, receiverId := range receivers {
+		transfer.pending[receiverId] = true
+	}
+	s.transfers[transfer.Id] = transfer
+	s.idCounter++
+	return transfer, true, nil
+}
+
+// New quota is applied to the next offers, transfers which are already accepted are kept.
+func (s *FileSpool) SetQuota(quota uint64) {
+	if quota == 0 {
+		quota = kDefaultFileQuota
+	}
+	s.quota = quota
+}
+
+func (s *FileSpool) GetTransfer(transferId uint64) *FileTransfer {
+	return s.transfers[transferId]
+}
+
+// Returns true when the last chunk was written and file checksum was verified.
+func (s *FileSpool) WriteChunk(senderId uint64, transferId uint64, offset uint64, data []byte) (bool, error) {
+	s.removeExpired()
+	transfer, exists := s.transfers[transferId]
+	if !exists || transfer.SenderId != senderId {
+		return false, fmt.Errorf("unknown file transfer")
+	}
+	if transfer.Complete {
+		return false, fmt.Errorf("file was already uploaded")
+	}
+	if len(data) > kFileChunkSize {
+		return false, fmt.Errorf("file chunk is too large")
+	}
+	if offset != transfer.Uploaded || offset+uint64(len(data)) > transfer.Size {
+		return false, fmt.Errorf("unexpected file chunk offset, expected %d", transfer.Uploaded)
+	}
+
+	file, err := os.OpenFile(s.transferPath(transferId), os.O_WRONLY, 0600)
+	if err != nil {
+		return false, fmt.Errorf("unable to open spool file: %w", err)
+	}
+	_, err = file.WriteAt(data, int64(offset))
+	file.Close()
+	if err != nil {
+		return false, fmt.Errorf("unable to write spool file: %w", err)
+	}
+	transfer.Uploaded += uint64(len(data))
+	transfer.touched = time.Now()
+
+	if transfer.Uploaded < transfer.Size {
+		return false, nil
+	}
+	if err = s.verifyChecksum(transfer); err != nil {
+		s.remove(transferId)
+		return false, err
+	}
+	transfer.Complete = true
+	return true, nil
+}
+
+func (s *FileSpool) ReadChunk(receiverId uint64, transferId uint64, offset uint64) ([]byte, error) {
+	s.removeExpired()
+	transfer, exists := s.transfers[transferId]
+	if !exists || transfer.SenderId == receiverId ||
+		(transfer.TargetId != 0 && transfer.TargetId != receiverId) {
+		return nil, fmt.Errorf("unknown file transfer")
+	}
+	if !transfer.Complete {
+		return nil, fmt.Errorf("file is not uploaded yet")
+	}
+	if offset > transfer.Size {
+		return nil, fmt.Errorf("file offset is out of range")
+	}
+
+	file, err := os.Open(s.transferPath(transferId))
+	if err != nil {
+		return nil, fmt.Errorf("unable to open spool file: %w", err)
+	}
+	defer file.Close()
+
+	chunk := make([]byte, min(kFileChunkSize, transfer.Size-offset))
+	if _, err = file.ReadAt(chunk, int64(offset)); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("unable to read spool file: %w", err)
+	}
+	transfer.touched = time.Now()
+	if offset+uint64(len(chunk)) == transfer.Size {
+		delete(transfer.pending, receiverId)
+		if len(transfer.pending) == 0 {
+			s.remove(transferId)
+		}
+	}
+	return chunk, nil
+}
+
+func (s *FileSpool) verifyChecksum(transfer *FileTransfer) error {
+	file, err := os.Open(s.transferPath(transfer.Id))
+	if err != nil {
+		return fmt.Errorf("unable to open spool file: %w", err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err = io.Copy(hash, file); err != nil {
+		return fmt.Errorf("unable to read spool file: %w", err)
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != transfer.Sha256 {
+		return fmt.Errorf("file checksum mismatch")
+	}
+	return nil
+}
+
+func (s *FileSpool) usedSpace() uint64 {
+	var used uint64
+	for _, transfer := range s.transfers {
+		used += transfer.Size
+	}
+	return used
+}
+
+func (s *FileSpool) removeExpired() {
+	for id, transfer := range s.transfers {
+		if time.Since(transfer.touched) > kFileTransferTtl {
+			s.remove(id)
+		}
+	}
+}
+
+func (s *FileSpool) remove(transferId uint64) {
+	delete(s.transfers, transferId)
+	os.Remove(s.transferPath(transferId))
+}
+
+func (s *FileSpool) transferPath(transferId uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%d.part", transferId))
+}
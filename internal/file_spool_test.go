@@ -0,0 +1,146 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestFileSpool(t *testing.T) {
+	spool, err := CreateFileSpool(t.TempDir(), 16)
+	if err != nil {
+		t.Fatalf("Unable to create spool: %s", err.Error())
+	}
+
+	content := []byte("0123456789")
+	checksum := sha256.Sum256(content)
+	checksumHex := hex.EncodeToString(checksum[:])
+
+	transfer, created, err := spool.Offer(1, 2, "file.txt", uint64(len(content)), checksumHex, []uint64{2})
+	if err != nil || !created {
+		t.Fatalf("Unable to offer file: %v", err)
+	}
+	if _, _, err = spool.Offer(1, 2, "other.txt", 10, checksumHex, []uint64{2}); err == nil {
+		t.Error("Group quota was not respected")
+	}
+	if _, _, err = spool.Offer(1, 2, "../file.txt", 1, checksumHex, []uint64{2}); err == nil {
+		t.Error("Wrong file name was accepted")
+	}
+
+	complete, err := spool.WriteChunk(1, transfer.Id, 0, content[:4])
+	if err != nil || complete {
+		t.Fatalf("Unexpected first chunk result: %v", err)
+	}
+	if _, err = spool.ReadChunk(2, transfer.Id, 0); err == nil {
+		t.Error("Incomplete file was read")
+	}
+
+	// Repeated offer resumes the upload.
+	resumed, created, err := spool.Offer(1, 2, "file.txt", uint64(len(content)), checksumHex, []uint64{2})
+	if err != nil || created || resumed.Id != transfer.Id || resumed.Uploaded != 4 {
+		t.Fatalf("Upload was not resumed: %v", err)
+	}
+	if _, err = spool.WriteChunk(1, transfer.Id, 0, content[:4]); err == nil {
+		t.Error("Chunk with wrong offset was accepted")
+	}
+	complete, err = spool.WriteChunk(1, transfer.Id, 4, content[4:])
+	if err != nil || !complete {
+		t.Fatalf("Unexpected last chunk result: %v", err)
+	}
+
+	if _, err = spool.ReadChunk(3, transfer.Id, 0); err == nil {
+		t.Error("File was read by host it was not offered to")
+	}
+	chunk, err := spool.ReadChunk(2, transfer.Id, 2)
+	if err != nil || !bytes.Equal(chunk, content[2:]) {
+		t.Errorf("Wrong file chunk read: %v", err)
+	}
+
+	// Downloaded file doesn't hold the quota anymore.
+	if spool.GetTransfer(transfer.Id) != nil {
+		t.Error("Downloaded file was not removed")
+	}
+	if _, _, err = spool.Offer(1, 2, "other.txt", 10, checksumHex, []uint64{2}); err != nil {
+		t.Errorf("Quota was not released: %s", err.Error())
+	}
+}
+
+func TestFileSpoolKeepsFileForAllReceivers(t *testing.T) {
+	spool, err := CreateFileSpool(t.TempDir(), 16)
+	if err != nil {
+		t.Fatalf("Unable to create spool: %s", err.Error())
+	}
+	content := []byte("01234567")
+	checksum := sha256.Sum256(content)
+	transfer, _, err := spool.Offer(1, 0, "file.txt", 8, hex.EncodeToString(checksum[:]), []uint64{2, 3})
+	if err != nil {
+		t.Fatalf("Unable to offer file: %s", err.Error())
+	}
+	if _, err = spool.WriteChunk(1, transfer.Id, 0, content); err != nil {
+		t.Fatalf("Unable to upload file: %s", err.Error())
+	}
+	if _, err = spool.ReadChunk(2, transfer.Id, 0); err != nil || spool.GetTransfer(transfer.Id) == nil {
+		t.Fatalf("File was removed before all receivers downloaded it: %v", err)
+	}
+	if _, err = spool.ReadChunk(3, transfer.Id, 0); err != nil || spool.GetTransfer(transfer.Id) != nil {
+		t.Errorf("File was not removed after all receivers downloaded it: %v", err)
+	}
+}
+
+func TestFileSpoolChecksumMismatch(t *testing.T) {
+	spool, err := CreateFileSpool(t.TempDir(), 0)
+	if err != nil {
+		t.Fatalf("Unable to create spool: %s", err.Error())
+	}
+
+	checksum := sha256.Sum256([]byte("expected"))
+	transfer, _, err := spool.Offer(1, 0, "file.txt", 8, hex.EncodeToString(checksum[:]), []uint64{2})
+	if err != nil {
+		t.Fatalf("Unable to offer file: %s", err.Error())
+	}
+	if _, err = spool.WriteChunk(1, transfer.Id, 0, []byte("received")); err == nil {
+		t.Fatal("File with wrong checksum was accepted")
+	}
+	if spool.GetTransfer(transfer.Id) != nil {
+		t.Error("Broken transfer was not removed")
+	}
+}
+
+func TestFileSpoolRemovesExpiredOnChunks(t *testing.T) {
+	spool, err := CreateFileSpool(t.TempDir(), 0)
+	if err != nil {
+		t.Fatalf("Unable to create spool: %s", err.Error())
+	}
+	checksum := sha256.Sum256([]byte("01234567"))
+	checksumHex := hex.EncodeToString(checksum[:])
+	abandoned, _, err := spool.Offer(1, 0, "old.txt", 8, checksumHex, []uint64{2})
+	if err != nil {
+		t.Fatalf("Unable to offer file: %s", err.Error())
+	}
+	active, _, err := spool.Offer(1, 0, "new.txt", 8, checksumHex, []uint64{2})
+	if err != nil {
+		t.Fatalf("Unable to offer file: %s", err.Error())
+	}
+
+	abandoned.touched = time.Now().Add(-kFileTransferTtl - time.Minute)
+	if _, err = spool.WriteChunk(1, active.Id, 0, []byte("0123")); err != nil {
+		t.Fatalf("Unable to write chunk: %s", err.Error())
+	}
+	if spool.GetTransfer(abandoned.Id) != nil {
+		t.Error("Expired transfer was not removed on write")
+	}
+	if _, err = os.Stat(spool.transferPath(abandoned.Id)); !os.IsNotExist(err) {
+		t.Error("Expired spool file was not deleted")
+	}
+
+	active.touched = time.Now().Add(-kFileTransferTtl - time.Minute)
+	if _, err = spool.ReadChunk(2, active.Id, 0); err == nil {
+		t.Error("Expired transfer was read")
+	}
+	if spool.GetTransfer(active.Id) != nil {
+		t.Error("Expired transfer was not removed on read")
+	}
+}
@@ -0,0 +1,60 @@
+package internal
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+const DefaultHeartbeatInterval = 30 * time.Second
+const DefaultHeartbeatMissedBeats = 3
+
+// Heartbeat settings as they are written in the config, zero values are replaced by the defaults.
+type HeartbeatConfig struct {
+	IntervalSeconds int `json:",omitempty"`
+	// Client is disconnected if nothing was received from it during this number of intervals.
+	MissedBeats int `json:",omitempty"`
+}
+
+type HeartbeatSettings struct {
+	Interval    time.Duration
+	MissedBeats int
+}
+
+func ResolveHeartbeatSettings(config *HeartbeatConfig) HeartbeatSettings {
+	result := HeartbeatSettings{Interval: DefaultHeartbeatInterval, MissedBeats: DefaultHeartbeatMissedBeats}
+	if config == nil {
+		return result
+	}
+	if config.IntervalSeconds != 0 {
+		result.Interval = time.Duration(config.IntervalSeconds) * time.Second
+	}
+	if config.MissedBeats != 0 {
+		result.MissedBeats = config.MissedBeats
+	}
+	return result
+}
+
+// Time after which silent peer is considered dead.
+func (s *HeartbeatSettings) Timeout() time.Duration {
+	return s.Interval * time.Duration(s.MissedBeats)
+}
+
+// TCP keepalive detects dead peers which don't support heartbeats, it gives up after about the same
+// number of missed intervals.
+func (s *HeartbeatSettings) KeepAliveConfig() net.KeepAliveConfig {
+	return net.KeepAliveConfig{Enable: true, Idle: s.Interval, Interval: s.Interval, Count: s.MissedBeats}
+}
+
+func validateHeartbeatConfig(config *HeartbeatConfig) error {
+	if config == nil {
+		return nil
+	}
+	if config.IntervalSeconds < 0 {
+		return fmt.Errorf("heartbeat interval must not be negative: %d", config.IntervalSeconds)
+	}
+	if config.MissedBeats < 0 {
+		return fmt.Errorf("heartbeat missed beats must not be negative: %d", config.MissedBeats)
+	}
+	return nil
+}
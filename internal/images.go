@@ -0,0 +1,51 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+)
+
+const kMaxImageEntries = 5
+const kMaxImageSize = 64 * 1024 * 1024
+
+// Images are transferred by chunks, so they never occupy a single huge network message.
+const kImageChunkSize = 256 * 1024
+
+// Maps supported MIME type to the format name reported by image package.
+var supportedImageTypes = map[string]string{
+	"image/png":  "png",
+	"image/jpeg": "jpeg",
+}
+
+func validateImageHeader(img *ImageData) error {
+	if _, supported := supportedImageTypes[img.MimeType]; !supported {
+		return fmt.Errorf("unsupported image type '%s'", img.MimeType)
+	}
+	if img.Size == 0 {
+		return fmt.Errorf("image is empty")
+	}
+	if img.Size > kMaxImageSize {
+		return fmt.Errorf("image is too large (%d bytes)", img.Size)
+	}
+	return nil
+}
+
+func validateImageContent(img *ImageData) error {
+	if uint64(len(img.Data)) != img.Size {
+		return fmt.Errorf("image size mismatch")
+	}
+	config, format, err := image.DecodeConfig(bytes.NewReader(img.Data))
+	if err != nil {
+		return fmt.Errorf("unable to decode image: %w", err)
+	}
+	if supportedImageTypes[img.MimeType] != format {
+		return fmt.Errorf("image content does not match '%s' type", img.MimeType)
+	}
+	if uint32(config.Width) != img.Width || uint32(config.Height) != img.Height {
+		return fmt.Errorf("image dimensions mismatch")
+	}
+	return nil
+}
@@ -7,43 +7,101 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 const AppName = "reclip-server"
+const ConfigFileName = "config.json"
 const DefaultServerPort = 41286
 const help = "\nServer side part of 'Reclip' software. \n" +
+	"Usage: reclip-server [ARGUMENTS] [COMMAND]\n" +
 	"Arguments: \n" +
 	"\t--port=[PORT] (-p [PORT]) - run server on port [PORT] (default value is 8880)\n" +
 	"\t--app-data-dir=[PATH] - override application data directory\n" +
-	"\t--help (-h) - show this help\n\n"
+	"\t--watch-config - reload config when config.json is changed (it is always reloaded on SIGHUP)\n" +
+	"\t--manage-cert - generate self-signed certificate if it is missing and renew it before expiry\n" +
+	"\t--cert-hosts=[HOSTS] - hosts of the certificate generated with --manage-cert\n" +
+	"\t--log-level=[LEVEL] - one of debug, info, warn and error (default value is info)\n" +
+	"\t--log-format=[FORMAT] - text or json (default value is text)\n" +
+	"\t--log-file - write log to the rotated file in 'logs' of the application data directory\n" +
+	"\t--log-clipboard - don't redact clipboard content in the log\n" +
+	"\t--help (-h) - show this help\n\n" + commandsHelp
 
 type AppSettings struct {
-	Port       uint16
-	AppDataDir string
+	Port        uint16
+	AppDataDir  string
+	WatchConfig bool
+	ManageCert  bool
+	CertHosts   []string
+	Log         LogSettings
+	// Administrative command to run instead of the server, empty if server must be started.
+	Command []string
 }
 
 type ClientConfig struct {
-	Secret   string
-	PublicId uint64
-	Name     string
+	// Plain base64 secret, it is replaced by SecretHash with 'config hash-secrets' command.
+	Secret string `json:",omitempty"`
+	// Base64 HMAC-SHA256 of the secret with the server key.
+	SecretHash string `json:",omitempty"`
+	// SHA-256 fingerprint of the client certificate, used if server authenticates clients by certificates.
+	CertFingerprint string `json:",omitempty"`
+	PublicId        uint64
+	Name            string
+	Limits          *LimitsConfig `json:",omitempty"`
 }
 
 type GroupConfig struct {
+	// Optional, named groups are matched by name on config reload.
+	Name    string `json:",omitempty"`
 	Clients []ClientConfig
+	// Maximum total size of files spooled for transfer inside of the group, in bytes.
+	FileQuota uint64        `json:",omitempty"`
+	Limits    *LimitsConfig `json:",omitempty"`
 }
 
 type Config struct {
 	Groups []GroupConfig
+	Limits *LimitsConfig `json:",omitempty"`
+	// One of ClientAuth* values, secret authentication is used if it is empty.
+	ClientAuth string `json:",omitempty"`
+	// Used for clients which support heartbeats, it is applied to new connections on reload.
+	Heartbeat *HeartbeatConfig `json:",omitempty"`
+	// One of SessionPolicy* values, it defines what happens when connected client connects again.
+	SessionPolicy string `json:",omitempty"`
+	// Notifications missed by disconnected clients, they are sent when the client connects.
+	Outbox *OutboxConfig `json:",omitempty"`
+	// Per-connection queue of messages which were not written to the socket yet.
+	WriteQueue *WriteQueueConfig `json:",omitempty"`
+	// Address of HTTP listener exporting metrics in Prometheus format, e.g. "127.0.0.1:9090".
+	// Metrics are not exported if it is empty, it is not changed on reload.
+	MetricsAddress string `json:",omitempty"`
+	// Local HTTP API for scripting, it is not served if it is not set. Address is not changed on
+	// reload, token is.
+	Admin *AdminConfig `json:",omitempty"`
 }
 
 func ParseCmdArgs() (AppSettings, error) {
 	var port int
 	var app_data_dir string
 	var version bool
+	var watchConfig bool
+	var manageCert bool
+	var certHosts string
+	var logLevel string
+	var logFormat string
+	var logFile bool
+	var logClipboard bool
 
 	flag.IntVar(&port, "port", DefaultServerPort, "Run server on port [PORT] (default value is 8880)")
 	flag.IntVar(&port, "p", DefaultServerPort, "Run server on port [PORT] (default value is 8880)")
 	flag.StringVar(&app_data_dir, "app-data-dir", "", "Override application data directory")
+	flag.BoolVar(&watchConfig, "watch-config", false, "Reload config when config.json is changed")
+	flag.BoolVar(&manageCert, "manage-cert", false, "Generate certificate if it is missing and renew it")
+	flag.StringVar(&certHosts, "cert-hosts", strings.Join(DefaultCertHosts(), ","), "Generated certificate hosts")
+	flag.StringVar(&logLevel, "log-level", "info", "Log level: debug, info, warn or error")
+	flag.StringVar(&logFormat, "log-format", LogFormatText, "Log format: text or json")
+	flag.BoolVar(&logFile, "log-file", false, "Write log to the rotated file in the application data directory")
+	flag.BoolVar(&logClipboard, "log-clipboard", false, "Don't redact clipboard content in the log")
 	flag.BoolVar(&version, "version", false, "Show version")
 	flag.BoolVar(&version, "v", false, "Show version")
 	flag.Usage = func() {
@@ -56,7 +114,22 @@ func ParseCmdArgs() (AppSettings, error) {
 		os.Exit(0)
 	}
 
-	return AppSettings{Port: uint16(port), AppDataDir: app_data_dir}, nil
+	logSettings, err := parseLogSettings(logLevel, logFormat)
+	if err != nil {
+		return AppSettings{}, err
+	}
+	logSettings.ToFile = logFile
+	logSettings.ShowClipboard = logClipboard
+
+	return AppSettings{
+		Port:        uint16(port),
+		AppDataDir:  app_data_dir,
+		WatchConfig: watchConfig,
+		ManageCert:  manageCert,
+		CertHosts:   ParseCertHosts(certHosts),
+		Log:         logSettings,
+		Command:     flag.Args(),
+	}, nil
 }
 
 func InitAppDataDir(argsPath string) (string, error) {
@@ -83,9 +156,9 @@ func InitAppDataDir(argsPath string) (string, error) {
 }
 
 func ReadServerConfig(appDataDir string) (*Config, error) {
-	configPath := fmt.Sprintf("%s/config.json", appDataDir)
+	configPath := filepath.Join(appDataDir, ConfigFileName)
 	if _, err := os.Stat(configPath); errors.Is(err, os.ErrNotExist) {
-		return nil, fmt.Errorf("config is not exists")
+		return nil, fmt.Errorf("config is not exists: %w", err)
 	}
 
 	config_data, err := os.ReadFile(configPath)
@@ -96,7 +169,7 @@ func ReadServerConfig(appDataDir string) (*Config, error) {
 	var config Config
 	err = json.Unmarshal(config_data, &config)
 	if err != nil {
-		return nil, fmt.Errorf("unable to parse config")
+		return nil, fmt.Errorf("unable to parse config: %w", err)
 	}
 	return &config, nil
 }
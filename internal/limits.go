@@ -0,0 +1,73 @@
+package internal
+
+import "fmt"
+
+const kDefaultMaxHistoryEntries = 10
+const kDefaultMaxEntryBytes = 16 * 1024 * 1024
+const kDefaultMaxHostBytes = 256 * 1024 * 1024
+
+// Limits as they are written in the config. Zero values are inherited from the upper level
+// (client -> group -> global), or from the defaults.
+type LimitsConfig struct {
+	MaxHistoryEntries int    `json:",omitempty"`
+	MaxEntryBytes     uint64 `json:",omitempty"`
+	MaxHostBytes      uint64 `json:",omitempty"`
+}
+
+// Effective limits of a single client. Zero value means that there is no limit.
+type ClientLimits struct {
+	MaxHistoryEntries int
+	MaxEntryBytes     uint64
+	MaxHostBytes      uint64
+}
+
+func DefaultClientLimits() ClientLimits {
+	return ClientLimits{
+		MaxHistoryEntries: kDefaultMaxHistoryEntries,
+		MaxEntryBytes:     kDefaultMaxEntryBytes,
+		MaxHostBytes:      kDefaultMaxHostBytes,
+	}
+}
+
+// Zero limit means that the less specific one is used, so negative values are rejected instead of
+// being silently treated as no limit.
+func ValidateLimitsConfig(config *LimitsConfig) error {
+	if config == nil {
+		return nil
+	}
+	if config.MaxHistoryEntries < 0 {
+		return fmt.Errorf("max history entries must not be negative: %d", config.MaxHistoryEntries)
+	}
+	return nil
+}
+
+// Resolves limits from the most generic config to the most specific one. Nil configs are skipped.
+func ResolveClientLimits(configs ...*LimitsConfig) ClientLimits {
+	result := DefaultClientLimits()
+	for _, config := range configs {
+		if config == nil {
+			continue
+		}
+		if config.MaxHistoryEntries != 0 {
+			result.MaxHistoryEntries = config.MaxHistoryEntries
+		}
+		if config.MaxEntryBytes != 0 {
+			result.MaxEntryBytes = config.MaxEntryBytes
+		}
+		if config.MaxHostBytes != 0 {
+			result.MaxHostBytes = config.MaxHostBytes
+		}
+	}
+	return result
+}
+
+// Checks that a single new entry of the given size may be stored at all.
+func (l *ClientLimits) CheckEntrySize(size uint64) bool {
+	if l.MaxEntryBytes != 0 && size > l.MaxEntryBytes {
+		return false
+	}
+	if l.MaxHostBytes != 0 && size > l.MaxHostBytes {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,148 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	LogFormatText = "text"
+	LogFormatJson = "json"
+)
+
+const logDirName = "logs"
+const logFileName = AppName + ".log"
+
+// Log file is rotated when it reaches this size, only a few previous files are kept.
+const maxLogFileSize = 10 * 1024 * 1024
+const keptLogFiles = 5
+
+// Keys of log record attributes, they are the same in all records.
+const (
+	LogKeyGroup     = "group"
+	LogKeyClientId  = "client_id"
+	LogKeyClient    = "client"
+	LogKeyAddress   = "address"
+	LogKeyMessageId = "message_id"
+	LogKeyError     = "error"
+	// Clipboard content, it is redacted unless logging of clipboard is enabled explicitly.
+	LogKeyClipboard = "clipboard"
+)
+
+type LogSettings struct {
+	Level  slog.Level
+	Format string
+	// Log is written to the rotated file in the application data directory instead of stderr.
+	ToFile        bool
+	ShowClipboard bool
+}
+
+func parseLogSettings(level string, format string) (LogSettings, error) {
+	var result LogSettings
+	if err := result.Level.UnmarshalText([]byte(level)); err != nil {
+		return result, fmt.Errorf("unknown log level '%s'", level)
+	}
+	switch format {
+	case LogFormatText, LogFormatJson:
+		result.Format = format
+	default:
+		return result, fmt.Errorf("unknown log format '%s'", format)
+	}
+	return result, nil
+}
+
+// Replaces default logger, records of the log package are written through it as well.
+func SetUpLogging(appDataDir string, settings LogSettings) error {
+	var output io.Writer = os.Stderr
+	if settings.ToFile {
+		file, err := openRotatedFile(filepath.Join(appDataDir, logDirName, logFileName))
+		if err != nil {
+			return fmt.Errorf("unable to open log file: %w", err)
+		}
+		output = file
+	}
+
+	options := &slog.HandlerOptions{
+		Level: settings.Level,
+		ReplaceAttr: func(groups []string, attr slog.Attr) slog.Attr {
+			if attr.Key == LogKeyClipboard && !settings.ShowClipboard {
+				return slog.String(LogKeyClipboard, fmt.Sprintf("<%d bytes>", len(attr.Value.String())))
+			}
+			return attr
+		},
+	}
+	var handler slog.Handler
+	if settings.Format == LogFormatJson {
+		handler = slog.NewJSONHandler(output, options)
+	} else {
+		handler = slog.NewTextHandler(output, options)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// File which is renamed to path.1 when it gets too large, older files are shifted the same way.
+type rotatedFile struct {
+	mutex sync.Mutex
+	path  string
+	file  *os.File
+	size  int64
+}
+
+func openRotatedFile(path string) (*rotatedFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	result := &rotatedFile{path: path}
+	if err := result.open(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (f *rotatedFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = stat.Size()
+	return nil
+}
+
+func (f *rotatedFile) Write(data []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.size+int64(len(data)) > maxLogFileSize && f.size != 0 {
+		if err := f.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to rotate log file: %s\n", err.Error())
+		}
+	}
+	size, err := f.file.Write(data)
+	f.size += int64(size)
+	return size, err
+}
+
+func (f *rotatedFile) rotate() error {
+	f.file.Close()
+	for index := keptLogFiles - 1; index > 0; index-- {
+		os.Rename(fmt.Sprintf("%s.%d", f.path, index), fmt.Sprintf("%s.%d", f.path, index+1))
+	}
+	if err := os.Rename(f.path, f.path+".1"); err != nil {
+		// Log is still written to the same file, so nothing is lost.
+		if openErr := f.open(); openErr != nil {
+			return openErr
+		}
+		return err
+	}
+	return f.open()
+}
@@ -0,0 +1,95 @@
+package internal
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseLogSettings(t *testing.T) {
+	settings, err := parseLogSettings("debug", LogFormatJson)
+	if err != nil || settings.Level != slog.LevelDebug || settings.Format != LogFormatJson {
+		t.Errorf("Wrong settings were parsed: %v, %v", settings, err)
+	}
+	if _, err = parseLogSettings("verbose", LogFormatText); err == nil {
+		t.Error("Unknown level was accepted")
+	}
+	if _, err = parseLogSettings("info", "xml"); err == nil {
+		t.Error("Unknown format was accepted")
+	}
+}
+
+func readLogRecords(t *testing.T, path string) []map[string]any {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Unable to read log: %s", err.Error())
+	}
+	var result []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var record map[string]any
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("Log record is not JSON: %s", line)
+		}
+		result = append(result, record)
+	}
+	return result
+}
+
+func TestLoggingRedactsClipboard(t *testing.T) {
+	defaultLogger := slog.Default()
+	defer slog.SetDefault(defaultLogger)
+	dir := t.TempDir()
+	path := filepath.Join(dir, logDirName, logFileName)
+
+	settings := LogSettings{Level: slog.LevelDebug, Format: LogFormatJson, ToFile: true}
+	if err := SetUpLogging(dir, settings); err != nil {
+		t.Fatalf("Unable to set up logging: %s", err.Error())
+	}
+	slog.Debug("Text received", LogKeyClientId, 7, LogKeyClipboard, "secret password")
+	settings.ShowClipboard = true
+	if err := SetUpLogging(dir, settings); err != nil {
+		t.Fatalf("Unable to set up logging: %s", err.Error())
+	}
+	slog.Debug("Text received", LogKeyClipboard, "visible")
+
+	records := readLogRecords(t, path)
+	if len(records) != 2 {
+		t.Fatalf("Wrong number of log records: %d", len(records))
+	}
+	if records[0][LogKeyClipboard] != "<15 bytes>" || records[0][LogKeyClientId] != float64(7) {
+		t.Errorf("Clipboard was not redacted: %v", records[0])
+	}
+	if records[1][LogKeyClipboard] != "visible" {
+		t.Errorf("Clipboard was redacted: %v", records[1])
+	}
+}
+
+func TestLogFileRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), logFileName)
+	file, err := openRotatedFile(path)
+	if err != nil {
+		t.Fatalf("Unable to open log file: %s", err.Error())
+	}
+	record := []byte(strings.Repeat("x", maxLogFileSize/2) + "\n")
+	for i := 0; i < keptLogFiles+4; i++ {
+		if _, err := file.Write(record); err != nil {
+			t.Fatalf("Unable to write log: %s", err.Error())
+		}
+	}
+	file.file.Close()
+
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatalf("Unable to read log directory: %s", err.Error())
+	}
+	if len(entries) != keptLogFiles+1 {
+		t.Errorf("Wrong number of log files: %d", len(entries))
+	}
+	stat, err := os.Stat(path)
+	if err != nil || stat.Size() != int64(len(record)) {
+		t.Errorf("Current log file was not rotated: %v", err)
+	}
+}
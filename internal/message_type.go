@@ -4,6 +4,8 @@ type ClientMessageType uint16
 type ServerMessageType uint16
 
 // WARNING! This values must be kept in sync with client ones.
+// Message types added after protocol version 1 are sent only to clients which have advertised the
+// corresponding capability in the introduction, see protocol.go.
 
 // Client message types.
 const (
@@ -13,7 +15,17 @@ const (
 	HostSyncRequest      ClientMessageType = 3
 	HostTextUpdate       ClientMessageType = 4
 	SyncThisHost         ClientMessageType = 5
-	ClientMessageTypeMax ClientMessageType = SyncThisHost
+	HostImageUpdate      ClientMessageType = 6
+	HostImageChunk       ClientMessageType = 7
+	ImageRequest         ClientMessageType = 8
+	HostFileOffer        ClientMessageType = 9
+	HostFileChunk        ClientMessageType = 10
+	FileAccept           ClientMessageType = 11
+	ClientEnrollment     ClientMessageType = 12 // Sent instead of ClientIntroduction by a new client.
+	ClientPing           ClientMessageType = 13
+	ClientPong           ClientMessageType = 14
+	ChangesRequest       ClientMessageType = 15
+	ClientMessageTypeMax ClientMessageType = ChangesRequest
 )
 
 // Server message types.
@@ -24,5 +36,10 @@ const (
 	HostDisconnected     ServerMessageType = 259
 	TextUpdate           ServerMessageType = 260
 	HostSynced           ServerMessageType = 261
-	ServerMessageTypeMax ServerMessageType = HostSynced
+	ImageUpdate          ServerMessageType = 262
+	FileOffered          ServerMessageType = 263
+	FileReady            ServerMessageType = 264
+	ServerPing           ServerMessageType = 265
+	ServerPong           ServerMessageType = 266
+	ServerMessageTypeMax ServerMessageType = ServerPong
 )
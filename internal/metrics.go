@@ -0,0 +1,211 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Upper bounds of event loop task latency buckets, in seconds.
+var taskLatencyBuckets = [...]float64{0.0001, 0.001, 0.01, 0.1, 1, 10}
+
+var clientMessageNames = map[ClientMessageType]string{
+	ClientResponse:     "ClientResponse",
+	ClientIntroduction: "ClientIntroduction",
+	FullSyncRequest:    "FullSyncRequest",
+	HostSyncRequest:    "HostSyncRequest",
+	HostTextUpdate:     "HostTextUpdate",
+	SyncThisHost:       "SyncThisHost",
+	HostImageUpdate:    "HostImageUpdate",
+	HostImageChunk:     "HostImageChunk",
+	ImageRequest:       "ImageRequest",
+	HostFileOffer:      "HostFileOffer",
+	HostFileChunk:      "HostFileChunk",
+	FileAccept:         "FileAccept",
+	ClientEnrollment:   "ClientEnrollment",
+	ClientPing:         "ClientPing",
+	ClientPong:         "ClientPong",
+	ChangesRequest:     "ChangesRequest",
+}
+
+var serverMessageNames = map[ServerMessageType]string{
+	ServerResponse:     "ServerResponse",
+	ServerIntroduction: "ServerIntroduction",
+	HostConnected:      "HostConnected",
+	HostDisconnected:   "HostDisconnected",
+	TextUpdate:         "TextUpdate",
+	HostSynced:         "HostSynced",
+	ImageUpdate:        "ImageUpdate",
+	FileOffered:        "FileOffered",
+	FileReady:          "FileReady",
+	ServerPing:         "ServerPing",
+	ServerPong:         "ServerPong",
+}
+
+// Process-wide counters and gauges, they are exported in Prometheus text format.
+type Metrics struct {
+	// Last element counts messages of unknown types.
+	messagesReceived [ClientMessageTypeMax + 2]atomic.Uint64
+	messagesSent     [ServerMessageTypeMax - ServerResponse + 2]atomic.Uint64
+	bytesIn          atomic.Uint64
+	bytesOut         atomic.Uint64
+	writeQueueDepth  atomic.Int64
+	authFailures     atomic.Uint64
+	brokenMessages   atomic.Uint64
+
+	taskLatencyCounts [len(taskLatencyBuckets)]atomic.Uint64
+	taskLatencySum    atomic.Uint64
+	taskLatencyCount  atomic.Uint64
+}
+
+// State of the client group at the moment metrics are collected.
+type GroupMetrics struct {
+	Name             string
+	Clients          int
+	ConnectedClients int
+}
+
+var processMetrics Metrics
+
+func GetMetrics() *Metrics {
+	return &processMetrics
+}
+
+func validateMetricsAddress(address string) error {
+	if len(address) == 0 {
+		return nil
+	}
+	return checkLoopbackAddress("metrics", address)
+}
+
+// Metrics and admin API are not protected by TLS, so they are served on loopback addresses only.
+func checkLoopbackAddress(name string, address string) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("wrong %s address '%s': %v", name, address, err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("%s address '%s' is not a loopback one", name, address)
+	}
+	return nil
+}
+
+func (m *Metrics) MessageReceived(msgType ClientMessageType) {
+	index := min(int(msgType), len(m.messagesReceived)-1)
+	m.messagesReceived[index].Add(1)
+}
+
+func (m *Metrics) MessageSent(msgType ServerMessageType) {
+	index := len(m.messagesSent) - 1
+	if msgType >= ServerResponse && msgType <= ServerMessageTypeMax {
+		index = int(msgType - ServerResponse)
+	}
+	m.messagesSent[index].Add(1)
+}
+
+func (m *Metrics) BytesReceived(size int) {
+	m.bytesIn.Add(uint64(size))
+}
+
+func (m *Metrics) BytesSent(size int) {
+	m.bytesOut.Add(uint64(size))
+}
+
+// Delta is added to the total number of messages queued for all connections.
+func (m *Metrics) WriteQueueChanged(delta int) {
+	m.writeQueueDepth.Add(int64(delta))
+}
+
+func (m *Metrics) AuthenticationFailed() {
+	m.authFailures.Add(1)
+}
+
+func (m *Metrics) MessageBroken() {
+	m.brokenMessages.Add(1)
+}
+
+// Time between posting the task to the event loop and its start.
+func (m *Metrics) TaskStarted(latency time.Duration) {
+	for index, bound := range taskLatencyBuckets {
+		if latency.Seconds() <= bound {
+			m.taskLatencyCounts[index].Add(1)
+		}
+	}
+	m.taskLatencySum.Add(uint64(latency.Nanoseconds()))
+	m.taskLatencyCount.Add(1)
+}
+
+func (m *Metrics) WritePrometheus(writer io.Writer, groups []GroupMetrics) error {
+	w := &metricsWriter{writer: writer}
+	w.header("reclip_group_clients", "gauge", "Number of clients configured in the group.")
+	for _, group := range groups {
+		w.sample("reclip_group_clients", fmt.Sprintf("{group=%q}", group.Name), group.Clients)
+	}
+	w.header("reclip_group_connected_clients", "gauge", "Number of connected clients of the group.")
+	for _, group := range groups {
+		w.sample("reclip_group_connected_clients", fmt.Sprintf("{group=%q}", group.Name), group.ConnectedClients)
+	}
+
+	w.header("reclip_messages_received_total", "counter", "Messages received from clients by type.")
+	for index := range m.messagesReceived {
+		name, exists := clientMessageNames[ClientMessageType(index)]
+		if !exists {
+			name = "unknown"
+		}
+		w.sample("reclip_messages_received_total", fmt.Sprintf(`{type="%s"}`, name),
+			m.messagesReceived[index].Load())
+	}
+	w.header("reclip_messages_sent_total", "counter", "Messages sent to clients by type.")
+	for index := range m.messagesSent {
+		name, exists := serverMessageNames[ServerResponse+ServerMessageType(index)]
+		if !exists {
+			name = "unknown"
+		}
+		w.sample("reclip_messages_sent_total", fmt.Sprintf(`{type="%s"}`, name), m.messagesSent[index].Load())
+	}
+
+	w.header("reclip_received_bytes_total", "counter", "Bytes received from clients.")
+	w.sample("reclip_received_bytes_total", "", m.bytesIn.Load())
+	w.header("reclip_sent_bytes_total", "counter", "Bytes sent to clients.")
+	w.sample("reclip_sent_bytes_total", "", m.bytesOut.Load())
+	w.header("reclip_write_queue_messages", "gauge", "Messages queued for all connections.")
+	w.sample("reclip_write_queue_messages", "", m.writeQueueDepth.Load())
+	w.header("reclip_authentication_failures_total", "counter", "Connections refused because of wrong credentials.")
+	w.sample("reclip_authentication_failures_total", "", m.authFailures.Load())
+	w.header("reclip_broken_messages_total", "counter", "Connections closed because of broken message frames.")
+	w.sample("reclip_broken_messages_total", "", m.brokenMessages.Load())
+
+	w.header("reclip_task_latency_seconds", "histogram", "Time tasks wait in the group event loop queue.")
+	for index, bound := range taskLatencyBuckets {
+		w.sample("reclip_task_latency_seconds_bucket", fmt.Sprintf(`{le="%g"}`, bound),
+			m.taskLatencyCounts[index].Load())
+	}
+	count := m.taskLatencyCount.Load()
+	w.sample("reclip_task_latency_seconds_bucket", `{le="+Inf"}`, count)
+	w.sample("reclip_task_latency_seconds_sum", "",
+		time.Duration(m.taskLatencySum.Load()).Seconds())
+	w.sample("reclip_task_latency_seconds_count", "", count)
+	return w.err
+}
+
+// Keeps the first write error, so it is checked once.
+type metricsWriter struct {
+	writer io.Writer
+	err    error
+}
+
+func (w *metricsWriter) header(name string, metricType string, help string) {
+	w.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+func (w *metricsWriter) sample(name string, labels string, value any) {
+	w.printf("%s%s %v\n", name, labels, value)
+}
+
+func (w *metricsWriter) printf(format string, args ...any) {
+	if w.err == nil {
+		_, w.err = fmt.Fprintf(w.writer, format, args...)
+	}
+}
@@ -0,0 +1,55 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsPrometheusFormat(t *testing.T) {
+	var metrics Metrics
+	metrics.MessageReceived(HostTextUpdate)
+	metrics.MessageReceived(HostTextUpdate)
+	metrics.MessageReceived(ClientMessageType(1000))
+	metrics.MessageSent(TextUpdate)
+	metrics.MessageSent(ServerMessageType(5))
+	metrics.BytesReceived(100)
+	metrics.WriteQueueChanged(3)
+	metrics.WriteQueueChanged(-1)
+	metrics.AuthenticationFailed()
+	metrics.TaskStarted(5 * time.Millisecond)
+	metrics.TaskStarted(time.Minute)
+
+	var output strings.Builder
+	err := metrics.WritePrometheus(&output, []GroupMetrics{{Name: `home "main"`, Clients: 3, ConnectedClients: 2}})
+	if err != nil {
+		t.Fatalf("Unable to write metrics: %s", err.Error())
+	}
+	lines := strings.Split(output.String(), "\n")
+	for _, expected := range []string{
+		`reclip_group_clients{group="home \"main\""} 3`,
+		`reclip_group_connected_clients{group="home \"main\""} 2`,
+		`reclip_messages_received_total{type="HostTextUpdate"} 2`,
+		`reclip_messages_received_total{type="unknown"} 1`,
+		`reclip_messages_sent_total{type="TextUpdate"} 1`,
+		`reclip_messages_sent_total{type="unknown"} 1`,
+		`reclip_received_bytes_total 100`,
+		`reclip_write_queue_messages 2`,
+		`reclip_authentication_failures_total 1`,
+		`reclip_broken_messages_total 0`,
+		`reclip_task_latency_seconds_bucket{le="0.001"} 0`,
+		`reclip_task_latency_seconds_bucket{le="0.01"} 1`,
+		`reclip_task_latency_seconds_bucket{le="10"} 1`,
+		`reclip_task_latency_seconds_bucket{le="+Inf"} 2`,
+		`reclip_task_latency_seconds_count 2`,
+		`# TYPE reclip_task_latency_seconds histogram`,
+	} {
+		found := false
+		for _, line := range lines {
+			found = found || line == expected
+		}
+		if !found {
+			t.Errorf("Metrics don't contain '%s'", expected)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package internal
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+)
+
+const DefaultOutboxMaxEvents = 100
+const DefaultOutboxTtl = 24 * time.Hour
+
+// Outbox settings as they are written in the config, zero values are replaced by the defaults.
+type OutboxConfig struct {
+	MaxEvents  int `json:",omitempty"`
+	TtlSeconds int `json:",omitempty"`
+}
+
+// Zero value disables the outbox, so notifications for disconnected clients are dropped.
+type OutboxSettings struct {
+	MaxEvents int
+	Ttl       time.Duration
+}
+
+// Notification missed by the disconnected client, it is replayed when the client connects.
+// Type is one of TextUpdate, HostSynced, HostConnected and HostDisconnected.
+type OutboxEvent struct {
+	Type   ServerMessageType
+	HostId uint64
+	// Only for TextUpdate, HostSynced is replayed with the current host data.
+	Entry *TextEntry `json:",omitempty"`
+	// Sequence number of the clipboard change, zero for presence events.
+	Sequence uint64 `json:",omitempty"`
+	Time     time.Time
+}
+
+func ResolveOutboxSettings(config *OutboxConfig) OutboxSettings {
+	result := OutboxSettings{MaxEvents: DefaultOutboxMaxEvents, Ttl: DefaultOutboxTtl}
+	if config == nil {
+		return result
+	}
+	if config.MaxEvents != 0 {
+		result.MaxEvents = config.MaxEvents
+	}
+	if config.TtlSeconds != 0 {
+		result.Ttl = time.Duration(config.TtlSeconds) * time.Second
+	}
+	return result
+}
+
+func validateOutboxConfig(config *OutboxConfig) error {
+	if config == nil {
+		return nil
+	}
+	if config.MaxEvents < 0 {
+		return fmt.Errorf("outbox max events must not be negative: %d", config.MaxEvents)
+	}
+	if config.TtlSeconds < 0 {
+		return fmt.Errorf("outbox TTL must not be negative: %d", config.TtlSeconds)
+	}
+	return nil
+}
+
+func (s *OutboxSettings) isEnabled() bool {
+	return s.MaxEvents > 0
+}
+
+func isPresenceEvent(msgType ServerMessageType) bool {
+	return msgType == HostConnected || msgType == HostDisconnected
+}
+
+// Adds event to the outbox, events it supersedes and expired events are dropped. Returns true if
+// events which were already in the outbox were changed, otherwise event was only appended.
+func addOutboxEvent(outbox []OutboxEvent, event OutboxEvent, settings *OutboxSettings) ([]OutboxEvent, bool) {
+	length := len(outbox)
+	outbox = slices.DeleteFunc(outbox, func(queued OutboxEvent) bool {
+		if event.Time.Sub(queued.Time) > settings.Ttl {
+			return true
+		}
+		if queued.HostId != event.HostId {
+			return false
+		}
+		// Host sync carries the whole host data, and only the last presence change matters.
+		if event.Type == HostSynced {
+			return !isPresenceEvent(queued.Type)
+		}
+		return isPresenceEvent(event.Type) && isPresenceEvent(queued.Type)
+	})
+	changed := len(outbox) != length
+
+	outbox = append(outbox, event)
+	if len(outbox) > settings.MaxEvents {
+		slog.Warn("Outbox is full, the oldest events were dropped", "count", len(outbox)-settings.MaxEvents)
+		outbox = slices.Delete(outbox, 0, len(outbox)-settings.MaxEvents)
+		changed = true
+	}
+	return outbox, changed
+}
+
+func dropExpiredOutboxEvents(outbox []OutboxEvent, now time.Time, ttl time.Duration) []OutboxEvent {
+	return slices.DeleteFunc(outbox, func(event OutboxEvent) bool {
+		return now.Sub(event.Time) > ttl
+	})
+}
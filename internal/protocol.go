@@ -0,0 +1,108 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// Version 1 is the original protocol, where introduction contains only the raw secret.
+// Version 2 adds JSON introduction with capabilities.
+const ProtocolVersion = 2
+const MinProtocolVersion = 1
+
+// Optional protocol features, server uses them only if client has advertised them.
+const (
+	// Additional text representations in text updates and syncs.
+	CapabilityRichText = "rich-text"
+	// ImageUpdate messages and images in syncs.
+	CapabilityImages = "images"
+	// FileOffered and FileReady messages.
+	CapabilityFiles = "files"
+	// Frame payload may be compressed with deflate.
+	CapabilityCompression = "deflate"
+	// Frame header contains CRC32C of the payload.
+	CapabilityChecksum = "crc32c"
+	// Large messages are split into several frames.
+	CapabilityChunking = "chunking"
+	// Ping and Pong messages, silent client is disconnected.
+	CapabilityHeartbeat = "heartbeat"
+	// ChangesRequest message and sequence numbers in updates.
+	CapabilityDeltaSync = "delta-sync"
+	// Client acknowledges applied notifications with ClientResponse of the same ID.
+	CapabilityAcks = "acks"
+)
+
+var serverCapabilities = []string{CapabilityRichText, CapabilityImages, CapabilityFiles,
+	CapabilityCompression, CapabilityChecksum, CapabilityChunking, CapabilityHeartbeat,
+	CapabilityDeltaSync, CapabilityAcks}
+
+var ErrIncompatibleProtocol = errors.New("incompatible protocol version")
+
+// Protocol negotiated with the client, it defines which messages and fields client understands.
+type ProtocolInfo struct {
+	Version      uint32
+	Capabilities []string
+	// Interval of server pings, set by server if heartbeats are negotiated.
+	HeartbeatInterval time.Duration
+	// Token of the previous session presented by the reconnecting client, nil if there is none.
+	SessionToken []byte
+}
+
+type clientIntroductionJson struct {
+	Secret             []byte `json:",omitempty"`
+	ProtocolVersion    uint32
+	MinProtocolVersion uint32   `json:",omitempty"`
+	Capabilities       []string `json:",omitempty"`
+	SessionToken       []byte   `json:",omitempty"`
+}
+
+// Protocol used for clients created in tests and by the current client version.
+func CurrentProtocol() ProtocolInfo {
+	return ProtocolInfo{Version: ProtocolVersion, Capabilities: serverCapabilities}
+}
+
+func (p *ProtocolInfo) HasCapability(capability string) bool {
+	return slices.Contains(p.Capabilities, capability)
+}
+
+// Parses client introduction, which is either the raw secret of protocol version 1, or JSON with
+// protocol version, capabilities and secret. Returns the secret and negotiated protocol.
+func ParseClientIntroduction(data []byte) ([]byte, ProtocolInfo, error) {
+	var introduction clientIntroductionJson
+	if len(data) == SecretSize && json.Unmarshal(data, &introduction) != nil {
+		return data, ProtocolInfo{Version: 1}, nil
+	}
+	if err := json.Unmarshal(data, &introduction); err != nil {
+		return nil, ProtocolInfo{}, fmt.Errorf("unable to parse introduction: %w", err)
+	}
+
+	protocol, err := negotiateProtocol(&introduction)
+	if err != nil {
+		return nil, protocol, err
+	}
+	protocol.SessionToken = introduction.SessionToken
+	return introduction.Secret, protocol, nil
+}
+
+func negotiateProtocol(introduction *clientIntroductionJson) (ProtocolInfo, error) {
+	minVersion := introduction.MinProtocolVersion
+	if minVersion == 0 {
+		minVersion = introduction.ProtocolVersion
+	}
+	if introduction.ProtocolVersion < MinProtocolVersion || minVersion > ProtocolVersion ||
+		minVersion > introduction.ProtocolVersion {
+		return ProtocolInfo{}, fmt.Errorf("%w: client supports versions %d-%d, server supports %d-%d",
+			ErrIncompatibleProtocol, minVersion, introduction.ProtocolVersion, MinProtocolVersion, ProtocolVersion)
+	}
+
+	result := ProtocolInfo{Version: min(introduction.ProtocolVersion, ProtocolVersion)}
+	for _, capability := range serverCapabilities {
+		if slices.Contains(introduction.Capabilities, capability) {
+			result.Capabilities = append(result.Capabilities, capability)
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,106 @@
+package internal
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Client secrets are stored in config as HMAC-SHA256 with this key, so config alone is not
+// enough to impersonate a client.
+const ServerKeyFileName = "server.key"
+const serverKeySize = 32
+
+type SecretDigest [sha256.Size]byte
+
+// Loads the server key, it is created if it doesn't exist yet. Config is checked to not contain
+// hashed secrets if key was just created, because they could not be verified with a new key.
+func OpenServerKey(appDataDir string, config *Config) ([]byte, error) {
+	keyPath := filepath.Join(appDataDir, ServerKeyFileName)
+	key, err := os.ReadFile(keyPath)
+	if err == nil {
+		if len(key) != serverKeySize {
+			return nil, fmt.Errorf("server key has wrong size %d", len(key))
+		}
+		return key, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("unable to read server key: %w", err)
+	}
+
+	if config != nil && hasHashedSecrets(config) {
+		return nil, fmt.Errorf("server key '%s' is missing, hashed client secrets can't be verified", keyPath)
+	}
+	key = make([]byte, serverKeySize)
+	if _, err = rand.Read(key); err != nil {
+		return nil, fmt.Errorf("unable to generate server key: %w", err)
+	}
+	if err = writeFileAtomic(keyPath, key, 0600); err != nil {
+		return nil, fmt.Errorf("unable to write server key: %w", err)
+	}
+	return key, nil
+}
+
+func HashSecret(serverKey []byte, secret [SecretSize]byte) SecretDigest {
+	mac := hmac.New(sha256.New, serverKey)
+	mac.Write(secret[:])
+	var digest SecretDigest
+	copy(digest[:], mac.Sum(nil))
+	return digest
+}
+
+func EncodeSecretHash(digest SecretDigest) string {
+	return base64.StdEncoding.EncodeToString(digest[:])
+}
+
+func DecodeSecretHash(hashStr string) (SecretDigest, error) {
+	var digest SecretDigest
+	decoded, err := base64.StdEncoding.DecodeString(hashStr)
+	if err != nil || len(decoded) != len(digest) {
+		return digest, fmt.Errorf("unable to decode secret hash: %s", hashStr)
+	}
+	copy(digest[:], decoded)
+	return digest, nil
+}
+
+// Returns digest of the client secret, which is either hashed already or stored in plain text.
+func ClientSecretDigest(serverKey []byte, clientConfig *ClientConfig) (SecretDigest, error) {
+	if len(clientConfig.SecretHash) != 0 {
+		return DecodeSecretHash(clientConfig.SecretHash)
+	}
+	secret, err := DecodeSecret(clientConfig.Secret)
+	if err != nil {
+		return SecretDigest{}, err
+	}
+	return HashSecret(serverKey, secret), nil
+}
+
+// Sets new secret of the client, only its hash is kept in config.
+func SetClientSecret(serverKey []byte, clientConfig *ClientConfig, secret string) error {
+	decoded, err := DecodeSecret(secret)
+	if err != nil {
+		return err
+	}
+	clientConfig.Secret = ""
+	clientConfig.SecretHash = EncodeSecretHash(HashSecret(serverKey, decoded))
+	return nil
+}
+
+func hasHashedSecrets(config *Config) bool {
+	if config.Admin != nil && len(config.Admin.TokenHash) != 0 {
+		return true
+	}
+	for _, groupConfig := range config.Groups {
+		for _, clientConfig := range groupConfig.Clients {
+			if len(clientConfig.SecretHash) != 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
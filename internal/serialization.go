@@ -3,10 +3,17 @@ package internal
 import (
 	"encoding/json"
 	"fmt"
+	"time"
 )
 
 type serverIntroductionJson struct {
-	Version string
+	Version         string
+	ProtocolVersion uint32
+	Capabilities    []string `json:",omitempty"`
+	// Interval of server pings, client may use it to detect dead connection.
+	HeartbeatSeconds uint32 `json:",omitempty"`
+	// Presented in the next introduction, it allows client to take over its stale connection.
+	SessionToken []byte `json:",omitempty"`
 }
 
 type syncJson struct {
@@ -18,6 +25,40 @@ type clientJson struct {
 	ClientId   uint64
 	ClientName string
 	TextData   []string
+	// Element i contains additional representations of TextData element i.
+	TextFormats [][]TextFormat `json:",omitempty"`
+	ImageData   []imageJson    `json:",omitempty"`
+	// Sequence number of the last change included into the data, it is set only for clients which
+	// support delta sync. In SyncThisHost it is the last change the host has received.
+	Epoch    uint64 `json:",omitempty"`
+	Sequence uint64 `json:",omitempty"`
+}
+
+type imageJson struct {
+	ImageId  uint64
+	MimeType string
+	Width    uint32
+	Height   uint32
+	Size     uint64
+}
+
+type imageUpdateJson struct {
+	ClientId uint64
+	Image    imageJson
+	Sequence uint64 `json:",omitempty"`
+}
+
+type imageRequestJson struct {
+	ClientId uint64
+	ImageId  uint64
+	Offset   uint64
+}
+
+type imageChunkJson struct {
+	ClientId uint64
+	ImageId  uint64
+	Offset   uint64
+	Data     []byte
 }
 
 type clientIdJson struct {
@@ -27,19 +68,85 @@ type clientIdJson struct {
 type textUpdateJson struct {
 	ClientId uint64
 	Text     string
+	Formats  []TextFormat `json:",omitempty"`
+	Sequence uint64       `json:",omitempty"`
 }
 
 type textJson struct {
-	Text string
+	Text    string
+	Formats []TextFormat `json:",omitempty"`
+}
+
+type changesRequestJson struct {
+	Epoch uint64
+	Since uint64
+}
+
+type changeJson struct {
+	Sequence uint64
+	ClientId uint64
+	// One of "text", "image" and "host", the last one means that the whole host data was replaced.
+	Type  string
+	Text  *textJson   `json:",omitempty"`
+	Image *imageJson  `json:",omitempty"`
+	Host  *clientJson `json:",omitempty"`
+}
+
+type changesJson struct {
+	Epoch    uint64
+	Sequence uint64
+	Changes  []changeJson `json:",omitempty"`
+	// Sent instead of changes if they are not available anymore.
+	Snapshot *syncJson `json:",omitempty"`
+}
+
+type fileOfferJson struct {
+	TargetId uint64
+	FileName string
+	Size     uint64
+	Sha256   string
+}
+
+type enrollmentJson struct {
+	Code string
+	Name string
+}
+
+type enrollmentResultJson struct {
+	PublicId uint64
+	Secret   string
+}
+
+type fileTransferJson struct {
+	TransferId uint64
+	SenderId   uint64
+	FileName   string
+	Size       uint64
+	Sha256     string
+}
+
+type fileOffsetJson struct {
+	TransferId uint64
+	Offset     uint64
+}
+
+type fileChunkJson struct {
+	TransferId uint64
+	Offset     uint64
+	Data       []byte
 }
 
 type errorJson struct {
 	ErrorText string
 }
 
-func SerializeIntroduction(ver Version) []byte {
+func SerializeIntroduction(ver Version, protocol ProtocolInfo, sessionToken []byte) []byte {
 	data, err := json.Marshal(serverIntroductionJson{
-		Version: fmt.Sprintf("%d.%d.%d", ver.major, ver.minor, ver.patch),
+		Version:          fmt.Sprintf("%d.%d.%d", ver.major, ver.minor, ver.patch),
+		ProtocolVersion:  protocol.Version,
+		Capabilities:     protocol.Capabilities,
+		HeartbeatSeconds: uint32(protocol.HeartbeatInterval / time.Second),
+		SessionToken:     sessionToken,
 	})
 	if err != nil {
 		return nil
@@ -71,6 +178,51 @@ func SerializeClientData(clientData *ClientData) []byte {
 	return data
 }
 
+func SerializeHostSynced(clientData *ClientData, sequence uint64) []byte {
+	client := clientDataToJsonData(clientData)
+	client.Sequence = sequence
+	data, err := json.Marshal(client)
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// Changes of the complete change set, or the snapshot if it is not complete. Host changes must
+// have host data set.
+func SerializeChanges(changes *ChangeSet, thisData *ClientData, otherData []ClientData) []byte {
+	result := changesJson{Epoch: changes.Epoch, Sequence: changes.Sequence}
+	if !changes.Complete {
+		result.Snapshot = &syncJson{ThisHostData: clientDataToJsonData(thisData)}
+		for index := range otherData {
+			result.Snapshot.OtherData = append(result.Snapshot.OtherData, clientDataToJsonData(&otherData[index]))
+		}
+	}
+	for _, change := range changes.Changes {
+		converted := changeJson{Sequence: change.Sequence, ClientId: change.HostId}
+		switch change.Type {
+		case TextUpdate:
+			converted.Type = "text"
+			converted.Text = &textJson{Text: change.Entry.Text, Formats: change.Entry.Formats}
+		case ImageUpdate:
+			converted.Type = "image"
+			image := imageDataToJsonData(change.Image)
+			converted.Image = &image
+		case HostSynced:
+			converted.Type = "host"
+			host := clientDataToJsonData(change.Host)
+			converted.Host = &host
+		}
+		result.Changes = append(result.Changes, converted)
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
 func SerializeClientId(id uint64) []byte {
 	data, err := json.Marshal(clientIdJson{ClientId: id})
 	if err != nil {
@@ -79,8 +231,67 @@ func SerializeClientId(id uint64) []byte {
 	return data
 }
 
-func SerializeTextUpdate(id uint64, text string) []byte {
-	data, err := json.Marshal(textUpdateJson{ClientId: id, Text: text})
+func SerializeTextUpdate(id uint64, entry TextEntry, sequence uint64) []byte {
+	data, err := json.Marshal(textUpdateJson{ClientId: id, Text: entry.Text, Formats: entry.Formats, Sequence: sequence})
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+func SerializeImageUpdate(id uint64, image *ImageData, sequence uint64) []byte {
+	data, err := json.Marshal(imageUpdateJson{ClientId: id, Image: imageDataToJsonData(image), Sequence: sequence})
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+func SerializeImageChunk(id uint64, imageId uint64, offset uint64, chunk []byte) []byte {
+	data, err := json.Marshal(imageChunkJson{
+		ClientId: id,
+		ImageId:  imageId,
+		Offset:   offset,
+		Data:     chunk,
+	})
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+func SerializeFileTransfer(transfer *FileTransfer) []byte {
+	data, err := json.Marshal(fileTransferJson{
+		TransferId: transfer.Id,
+		SenderId:   transfer.SenderId,
+		FileName:   transfer.FileName,
+		Size:       transfer.Size,
+		Sha256:     transfer.Sha256,
+	})
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+func SerializeFileOffset(transferId uint64, offset uint64) []byte {
+	data, err := json.Marshal(fileOffsetJson{TransferId: transferId, Offset: offset})
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+func SerializeFileChunk(transferId uint64, offset uint64, chunk []byte) []byte {
+	data, err := json.Marshal(fileChunkJson{TransferId: transferId, Offset: offset, Data: chunk})
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+func SerializeEnrollmentResult(publicId uint64, secret string) []byte {
+	data, err := json.Marshal(enrollmentResultJson{PublicId: publicId, Secret: secret})
 	if err != nil {
 		return nil
 	}
@@ -101,10 +312,69 @@ func DeserializeClientId(data []byte) (uint64, error) {
 	return clientId.ClientId, err
 }
 
-func DeserializeText(data []byte) (string, error) {
+func DeserializeText(data []byte) (TextEntry, error) {
 	var text textJson
 	err := json.Unmarshal(data, &text)
-	return text.Text, err
+	return TextEntry{Text: text.Text, Formats: text.Formats}, err
+}
+
+// Deserializes image description, which starts image upload. Image content is not set.
+func DeserializeImageHeader(data []byte) (ImageData, error) {
+	var image imageJson
+	err := json.Unmarshal(data, &image)
+	return jsonDataToImageData(&image), err
+}
+
+func DeserializeImageChunk(data []byte) (imageId uint64, offset uint64, chunk []byte, err error) {
+	var imageChunk imageChunkJson
+	err = json.Unmarshal(data, &imageChunk)
+	return imageChunk.ImageId, imageChunk.Offset, imageChunk.Data, err
+}
+
+func DeserializeImageRequest(data []byte) (clientId uint64, imageId uint64, offset uint64, err error) {
+	var request imageRequestJson
+	err = json.Unmarshal(data, &request)
+	return request.ClientId, request.ImageId, request.Offset, err
+}
+
+func DeserializeFileOffer(data []byte) (targetId uint64, fileName string, size uint64, sha256 string, err error) {
+	var offer fileOfferJson
+	err = json.Unmarshal(data, &offer)
+	return offer.TargetId, offer.FileName, offer.Size, offer.Sha256, err
+}
+
+func DeserializeEnrollment(data []byte) (code string, name string, err error) {
+	var enrollment enrollmentJson
+	err = json.Unmarshal(data, &enrollment)
+	return enrollment.Code, enrollment.Name, err
+}
+
+func DeserializeFileOffset(data []byte) (transferId uint64, offset uint64, err error) {
+	var fileOffset fileOffsetJson
+	err = json.Unmarshal(data, &fileOffset)
+	return fileOffset.TransferId, fileOffset.Offset, err
+}
+
+func DeserializeFileChunk(data []byte) (transferId uint64, offset uint64, chunk []byte, err error) {
+	var fileChunk fileChunkJson
+	err = json.Unmarshal(data, &fileChunk)
+	return fileChunk.TransferId, fileChunk.Offset, fileChunk.Data, err
+}
+
+func DeserializeChangesRequest(data []byte) (epoch uint64, since uint64, err error) {
+	var request changesRequestJson
+	err = json.Unmarshal(data, &request)
+	return request.Epoch, request.Since, err
+}
+
+// Returns host data with epoch and sequence number of the last change the host has received.
+func DeserializeHostSync(data []byte) (clientData ClientData, epoch uint64, sequence uint64, err error) {
+	var client clientJson
+	if err = json.Unmarshal(data, &client); err != nil {
+		return clientData, 0, 0, err
+	}
+	clientData, err = DeserializeClientData(data)
+	return clientData, client.Epoch, client.Sequence, err
 }
 
 func DeserializeClientData(data []byte) (ClientData, error) {
@@ -114,8 +384,14 @@ func DeserializeClientData(data []byte) (ClientData, error) {
 		Id:   client.ClientId,
 		Name: client.ClientName,
 	}
-	for _, val := range client.TextData {
+	for index, val := range client.TextData {
 		clientData.Data.Text.PushBack(val)
+		if index < len(client.TextFormats) {
+			clientData.Data.TextFormats.PushBack(client.TextFormats[index])
+		}
+	}
+	for _, val := range client.ImageData {
+		clientData.Data.Images.PushBack(jsonDataToImageData(&val))
 	}
 	return clientData, err
 }
@@ -126,8 +402,41 @@ func clientDataToJsonData(clientData *ClientData) clientJson {
 		ClientName: clientData.Name,
 		TextData:   make([]string, clientData.Data.Text.Len()),
 	}
+	hasFormats := false
 	for i := 0; i < clientData.Data.Text.Len(); i++ {
 		client.TextData[i] = clientData.Data.Text.At(i)
+		hasFormats = hasFormats || len(clientData.Data.GetTextFormats(i)) != 0
+	}
+	if hasFormats {
+		client.TextFormats = make([][]TextFormat, clientData.Data.Text.Len())
+		for i := range client.TextFormats {
+			client.TextFormats[i] = clientData.Data.GetTextFormats(i)
+		}
+	}
+	for i := 0; i < clientData.Data.Images.Len(); i++ {
+		image := clientData.Data.Images.At(i)
+		client.ImageData = append(client.ImageData, imageDataToJsonData(&image))
 	}
 	return client
 }
+
+// Only image description is serialized, content is transferred by chunks on request.
+func imageDataToJsonData(image *ImageData) imageJson {
+	return imageJson{
+		ImageId:  image.Id,
+		MimeType: image.MimeType,
+		Width:    image.Width,
+		Height:   image.Height,
+		Size:     image.Size,
+	}
+}
+
+func jsonDataToImageData(image *imageJson) ImageData {
+	return ImageData{
+		Id:       image.ImageId,
+		MimeType: image.MimeType,
+		Width:    image.Width,
+		Height:   image.Height,
+		Size:     image.Size,
+	}
+}
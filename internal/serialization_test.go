@@ -29,3 +29,63 @@ func TestSerialization(t *testing.T) {
 		t.Error("Deserialized data is not equeal to serialized one")
 	}
 }
+
+func TestImageSerialization(t *testing.T) {
+	var dataToSerialize ClientData
+	dataToSerialize.Id = 1
+	dataToSerialize.Name = "name_value"
+	dataToSerialize.Data.Images.PushBack(ImageData{
+		Id: 7, MimeType: "image/png", Width: 2, Height: 3, Size: 4, Data: []byte{1, 2, 3, 4}})
+	buf := SerializeClientData(&dataToSerialize)
+	if buf == nil {
+		t.Fatal("Unable to serialize client data")
+	}
+
+	deserialized, err := DeserializeClientData(buf)
+	if err != nil {
+		t.Fatal("Deserialization error")
+	}
+	if deserialized.Data.Images.Len() != 1 {
+		t.Fatalf("Unexpected images count: %d", deserialized.Data.Images.Len())
+	}
+	image := deserialized.Data.Images.At(0)
+	if image.Id != 7 || image.MimeType != "image/png" || image.Width != 2 || image.Height != 3 ||
+		image.Size != 4 {
+		t.Errorf("Wrong deserialized image description: %v", image)
+	}
+	if image.Data != nil {
+		t.Error("Image content must not be serialized with client data")
+	}
+
+	imageId, offset, chunk, err := DeserializeImageChunk(SerializeImageChunk(1, 7, 2, []byte{3, 4}))
+	if err != nil || imageId != 7 || offset != 2 || len(chunk) != 2 || chunk[0] != 3 {
+		t.Error("Wrong image chunk round trip")
+	}
+}
+
+func TestTextFormatsSerialization(t *testing.T) {
+	var dataToSerialize ClientData
+	dataToSerialize.Id = 1
+	dataToSerialize.Name = "name_value"
+	dataToSerialize.Data.PushText(TextEntry{Text: "text2"})
+	dataToSerialize.Data.PushText(TextEntry{
+		Text:    "text1",
+		Formats: []TextFormat{{MimeType: "text/html", Data: "<i>text1</i>"}},
+	})
+
+	deserialized, err := DeserializeClientData(SerializeClientData(&dataToSerialize))
+	if err != nil {
+		t.Fatal("Deserialization error")
+	}
+	if !IsEqual(dataToSerialize, deserialized) {
+		t.Error("Deserialized data is not equeal to serialized one")
+	}
+
+	// Clients which are not aware of text formats must still get plain text.
+	const expectedUpdate = "{\"ClientId\":1,\"Text\":\"text1\",\"Formats\":" +
+		"[{\"MimeType\":\"text/html\",\"Data\":\"\\u003ci\\u003etext1\\u003c/i\\u003e\"}]}"
+	update := SerializeTextUpdate(1, dataToSerialize.Data.GetTextEntry(0), 0)
+	if string(update) != expectedUpdate {
+		t.Errorf("Unexpected serialized text update: %s", string(update))
+	}
+}
@@ -0,0 +1,51 @@
+package internal
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"fmt"
+)
+
+// What happens when already connected client connects again.
+const (
+	// New connection is refused, unless it presents the token of the current session.
+	SessionPolicyReject = "reject"
+	// Old connection is closed and replaced by the new one.
+	SessionPolicyReplace = "replace"
+	// Client may have several connections at the same time, e.g. on a desktop and in a VM.
+	SessionPolicyMultiple = "multiple"
+)
+
+const sessionTokenSize = 32
+
+func GetSessionPolicy(config *Config) string {
+	if len(config.SessionPolicy) == 0 {
+		return SessionPolicyReject
+	}
+	return config.SessionPolicy
+}
+
+func validateSessionPolicy(policy string) error {
+	switch policy {
+	case "", SessionPolicyReject, SessionPolicyReplace, SessionPolicyMultiple:
+		return nil
+	}
+	return fmt.Errorf("unknown session policy '%s'", policy)
+}
+
+// Session token is sent to the client in the introduction, so reconnecting client could prove that
+// it is the same device. Protocol version 1 clients don't receive it.
+func generateSessionToken(protocol *ProtocolInfo) []byte {
+	if protocol.Version < 2 {
+		return nil
+	}
+	token := make([]byte, sessionTokenSize)
+	if _, err := rand.Read(token); err != nil {
+		return nil
+	}
+	return token
+}
+
+func isSameSessionToken(current, presented []byte) bool {
+	return len(current) != 0 && subtle.ConstantTimeCompare(current, presented) == 1
+}
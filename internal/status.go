@@ -0,0 +1,203 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Environment variable with the admin API token, it is safer than the command line flag.
+const AdminTokenEnv = "RECLIP_ADMIN_TOKEN"
+
+// Clears the terminal and moves the cursor to its top left corner.
+const clearScreen = "\x1b[H\x1b[2J"
+
+// Groups received from the running server at some moment.
+type statusSample struct {
+	time   time.Time
+	groups []AdminGroup
+}
+
+type adminApiClient struct {
+	client  http.Client
+	baseUrl string
+	token   string
+}
+
+func runStatus(appDataDir string, args []string, output io.Writer) error {
+	flags := flag.NewFlagSet("status", flag.ContinueOnError)
+	watch := flags.Duration("watch", 0, "Refresh interval, status is printed once if it is not set")
+	token := flags.String("token", "", "Admin API token")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *watch < 0 {
+		return fmt.Errorf("refresh interval must not be negative")
+	}
+	if len(*token) == 0 {
+		*token = os.Getenv(AdminTokenEnv)
+	}
+	if len(*token) == 0 {
+		return fmt.Errorf("admin token is required, set it with --token or %s", AdminTokenEnv)
+	}
+
+	config, err := ReadServerConfig(appDataDir)
+	if err != nil {
+		return err
+	}
+	if config.Admin == nil {
+		return fmt.Errorf("admin API is disabled, enable it with 'admin token' command")
+	}
+	client := createAdminApiClient(GetAdminAddress(config.Admin), *token)
+
+	var previous *statusSample
+	for {
+		groups, err := client.getGroups()
+		if err != nil {
+			return err
+		}
+		sample := &statusSample{time: time.Now(), groups: groups}
+		if *watch == 0 {
+			return writeStatus(output, sample, nil)
+		}
+		fmt.Fprint(output, clearScreen)
+		if err = writeStatus(output, sample, previous); err != nil {
+			return err
+		}
+		previous = sample
+		time.Sleep(*watch)
+	}
+}
+
+func createAdminApiClient(address string, token string) *adminApiClient {
+	result := &adminApiClient{baseUrl: "http://" + address, token: token}
+	result.client.Timeout = 10 * time.Second
+	if path, isUnix := strings.CutPrefix(address, AdminUnixPrefix); isUnix {
+		// Host is not used, requests are sent to the socket.
+		result.baseUrl = "http://admin"
+		result.client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", path)
+			},
+		}
+	}
+	return result
+}
+
+func (c *adminApiClient) getGroups() ([]AdminGroup, error) {
+	request, err := http.NewRequest(http.MethodGet, c.baseUrl+"/groups", nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Authorization", "Bearer "+c.token)
+	response, err := c.client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to the server, is it running? %w", err)
+	}
+	defer response.Body.Close()
+
+	decoder := json.NewDecoder(response.Body)
+	if response.StatusCode != http.StatusOK {
+		var apiError AdminError
+		if err = decoder.Decode(&apiError); err != nil || len(apiError.Error) == 0 {
+			return nil, fmt.Errorf("admin API has failed: %s", response.Status)
+		}
+		return nil, fmt.Errorf("admin API has failed: %s", apiError.Error)
+	}
+	var result []AdminGroup
+	if err = decoder.Decode(&result); err != nil {
+		return nil, fmt.Errorf("unable to parse admin API response: %w", err)
+	}
+	return result, nil
+}
+
+// Prints a row per connection, or per client if it is not connected. Message rates are averaged
+// since the previous sample, or since the connection start if there is no previous sample.
+func writeStatus(output io.Writer, current *statusSample, previous *statusSample) error {
+	clients, connected := 0, 0
+	for _, group := range current.groups {
+		clients += len(group.Clients)
+		for _, client := range group.Clients {
+			if client.Connected {
+				connected++
+			}
+		}
+	}
+	fmt.Fprintf(output, "%s: %d groups, %d of %d clients are connected\n\n",
+		current.time.Format(time.DateTime), len(current.groups), connected, clients)
+
+	writer := tabwriter.NewWriter(output, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "GROUP\tID\tCLIENT\tADDRESS\tUPTIME\tLAST ACTIVITY\tQUEUE\tRECV/S\tSENT/S")
+	for _, group := range current.groups {
+		for _, client := range group.Clients {
+			if len(client.Sessions) == 0 {
+				fmt.Fprintf(writer, "%s\t%d\t%s\toffline\t-\t-\t-\t-\t-\n", group.Name, client.Id, client.Name)
+				continue
+			}
+			for _, session := range client.Sessions {
+				received, sent := sessionRates(current, previous, group.Name, client.Id, &session)
+				fmt.Fprintf(writer, "%s\t%d\t%s\t%s\t%s\t%s\t%d\t%.1f\t%.1f\n", group.Name, client.Id, client.Name,
+					session.Address, formatStatusDuration(current.time.Sub(session.Started)),
+					formatLastActivity(current.time, session.LastActivity), session.QueueDepth, received, sent)
+			}
+		}
+	}
+	return writer.Flush()
+}
+
+func sessionRates(current *statusSample, previous *statusSample, group string, id uint64, session *SessionStats) (float64, float64) {
+	since := session.Started
+	var received, sent uint64
+	if old := previous.findSession(group, id, session); old != nil {
+		since = previous.time
+		received, sent = old.MessagesReceived, old.MessagesSent
+	}
+	elapsed := current.time.Sub(since).Seconds()
+	if elapsed <= 0 {
+		return 0, 0
+	}
+	return float64(session.MessagesReceived-received) / elapsed, float64(session.MessagesSent-sent) / elapsed
+}
+
+// Session is the same if it has the same address and start time, nil sample has no sessions.
+func (s *statusSample) findSession(group string, id uint64, session *SessionStats) *SessionStats {
+	if s == nil {
+		return nil
+	}
+	for _, groupStatus := range s.groups {
+		if groupStatus.Name != group {
+			continue
+		}
+		for _, client := range groupStatus.Clients {
+			if client.Id != id {
+				continue
+			}
+			for index := range client.Sessions {
+				if client.Sessions[index].Address == session.Address && client.Sessions[index].Started.Equal(session.Started) {
+					return &client.Sessions[index]
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func formatStatusDuration(duration time.Duration) string {
+	return max(duration, 0).Round(time.Second).String()
+}
+
+func formatLastActivity(now time.Time, lastActivity time.Time) string {
+	if lastActivity.IsZero() {
+		return "-"
+	}
+	return formatStatusDuration(now.Sub(lastActivity)) + " ago"
+}
@@ -0,0 +1,85 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatusCommand(t *testing.T) {
+	now := time.Now()
+	groups := []AdminGroup{{Name: "home", Clients: []AdminClient{
+		{Id: 1, Name: "laptop", Connected: true, Connections: 1, Sessions: []SessionStats{{
+			Address: "10.0.0.2:5000",
+			Started: now.Add(-time.Minute),
+			ConnectionStats: ConnectionStats{
+				QueueDepth: 3, MessagesReceived: 60, MessagesSent: 120, LastActivity: now.Add(-5 * time.Second)},
+		}}},
+		{Id: 2, Name: "phone"},
+	}}}
+	api := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.Header.Get("Authorization") != "Bearer token" {
+			writer.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(writer).Encode(AdminError{Error: "wrong admin token"})
+			return
+		}
+		json.NewEncoder(writer).Encode(groups)
+	}))
+	defer api.Close()
+
+	dir := t.TempDir()
+	config := &Config{Admin: &AdminConfig{
+		Address:   strings.TrimPrefix(api.URL, "http://"),
+		TokenHash: EncodeSecretHash(SecretDigest{}),
+	}}
+	if err := WriteServerConfig(dir, config); err != nil {
+		t.Fatalf("Unable to write config: %s", err.Error())
+	}
+
+	var output bytes.Buffer
+	if err := runStatus(dir, []string{"--token=wrong"}, &output); err == nil || !strings.Contains(err.Error(), "wrong admin token") {
+		t.Errorf("Wrong token error was not reported: %v", err)
+	}
+	if err := runStatus(dir, []string{"--token=token"}, &output); err != nil {
+		t.Fatalf("Status command has failed: %s", err.Error())
+	}
+	lines := strings.Split(output.String(), "\n")
+	if !strings.Contains(lines[0], "1 groups, 1 of 2 clients are connected") {
+		t.Errorf("Wrong summary: %s", lines[0])
+	}
+	if fields := strings.Fields(lines[3]); len(fields) != 10 || fields[3] != "10.0.0.2:5000" || fields[4] != "1m0s" ||
+		fields[5] != "5s" || fields[7] != "3" || fields[8] != "1.0" || fields[9] != "2.0" {
+		t.Errorf("Wrong connection row: %s", lines[3])
+	}
+	if fields := strings.Fields(lines[4]); len(fields) != 9 || fields[3] != "offline" {
+		t.Errorf("Wrong offline client row: %s", lines[4])
+	}
+}
+
+func TestStatusRatesSincePreviousSample(t *testing.T) {
+	start := time.Date(2026, 1, 2, 10, 0, 0, 0, time.UTC)
+	sample := func(at time.Duration, received, sent uint64) *statusSample {
+		session := SessionStats{Address: "10.0.0.2:5000", Started: start,
+			ConnectionStats: ConnectionStats{MessagesReceived: received, MessagesSent: sent}}
+		return &statusSample{time: start.Add(at), groups: []AdminGroup{{Name: "home", Clients: []AdminClient{
+			{Id: 1, Name: "laptop", Connected: true, Connections: 1, Sessions: []SessionStats{session}},
+		}}}}
+	}
+	previous := sample(time.Minute, 600, 0)
+	current := sample(time.Minute+2*time.Second, 610, 4)
+
+	session := &current.groups[0].Clients[0].Sessions[0]
+	if received, sent := sessionRates(current, previous, "home", 1, session); received != 5 || sent != 2 {
+		t.Errorf("Wrong rates since previous sample: %v, %v", received, sent)
+	}
+	if received, _ := sessionRates(current, nil, "home", 1, session); received != 610/62.0 {
+		t.Errorf("Wrong rate since connection start: %v", received)
+	}
+	if received, _ := sessionRates(current, previous, "work", 1, session); received != 610/62.0 {
+		t.Errorf("Session of other group was used: %v", received)
+	}
+}
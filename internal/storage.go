@@ -0,0 +1,332 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+// Storage persists clipboard history and outboxes of the clients, so they survive server restarts.
+// Public IDs are unique only inside of a group, so clients are identified by the group key too.
+// Implementations must be safe to use from several groups event loops at once.
+type Storage interface {
+	GetHistory(group string, clientId uint64) []TextEntry
+	AppendText(group string, clientId uint64, entry TextEntry, limit int) error
+	ReplaceHistory(group string, clientId uint64, entries []TextEntry) error
+	GetOutbox(group string, clientId uint64) []OutboxEvent
+	AppendOutbox(group string, clientId uint64, event OutboxEvent) error
+	ReplaceOutbox(group string, clientId uint64, events []OutboxEvent) error
+	Close() error
+}
+
+const journalFileName = "history.journal"
+const kMinCompactionRecords = 1024
+
+const (
+	journalOpAppend        = "append"
+	journalOpReplace       = "replace"
+	journalOpOutboxAppend  = "outbox-append"
+	journalOpOutboxReplace = "outbox-replace"
+)
+
+type journalRecord struct {
+	Op          string
+	Group       string `json:",omitempty"`
+	ClientId    uint64
+	Text        string         `json:",omitempty"`
+	Formats     []TextFormat   `json:",omitempty"`
+	Texts       []string       `json:",omitempty"`
+	TextFormats [][]TextFormat `json:",omitempty"`
+	Limit       int            `json:",omitempty"`
+	Event       *OutboxEvent   `json:",omitempty"`
+	Events      []OutboxEvent  `json:",omitempty"`
+}
+
+// Journal storage is an append-only file of checksummed records. Every record is a single
+// line: "<crc32 in hex> <json record>\n". Torn or corrupted tail (e.g. after power loss) is
+// dropped on load. The journal is periodically compacted into one replace record per client.
+type journalStorage struct {
+	mutex       sync.Mutex
+	path        string
+	file        *os.File
+	history     map[journalKey][]TextEntry
+	outboxes    map[journalKey][]OutboxEvent
+	recordCount int
+}
+
+type journalKey struct {
+	group    string
+	clientId uint64
+}
+
+func OpenJournalStorage(dir string) (Storage, error) {
+	storage := &journalStorage{
+		path:     filepath.Join(dir, journalFileName),
+		history:  make(map[journalKey][]TextEntry),
+		outboxes: make(map[journalKey][]OutboxEvent),
+	}
+
+	if err := storage.load(); err != nil {
+		return nil, err
+	}
+	if err := storage.compact(); err != nil {
+		return nil, err
+	}
+	return storage, nil
+}
+
+func (s *journalStorage) GetHistory(group string, clientId uint64) []TextEntry {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return slices.Clone(s.history[journalKey{group, clientId}])
+}
+
+func (s *journalStorage) AppendText(group string, clientId uint64, entry TextEntry, limit int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	record := journalRecord{
+		Op:       journalOpAppend,
+		Group:    group,
+		ClientId: clientId,
+		Text:     entry.Text,
+		Formats:  entry.Formats,
+		Limit:    limit,
+	}
+	s.applyRecord(&record)
+	return s.writeRecord(&record)
+}
+
+func (s *journalStorage) ReplaceHistory(group string, clientId uint64, entries []TextEntry) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	record := createReplaceRecord(journalKey{group, clientId}, entries)
+	s.applyRecord(&record)
+	return s.writeRecord(&record)
+}
+
+func (s *journalStorage) GetOutbox(group string, clientId uint64) []OutboxEvent {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return slices.Clone(s.outboxes[journalKey{group, clientId}])
+}
+
+func (s *journalStorage) AppendOutbox(group string, clientId uint64, event OutboxEvent) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	record := journalRecord{Op: journalOpOutboxAppend, Group: group, ClientId: clientId, Event: &event}
+	s.applyRecord(&record)
+	return s.writeRecord(&record)
+}
+
+func (s *journalStorage) ReplaceOutbox(group string, clientId uint64, events []OutboxEvent) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	record := journalRecord{Op: journalOpOutboxReplace, Group: group, ClientId: clientId, Events: events}
+	s.applyRecord(&record)
+	return s.writeRecord(&record)
+}
+
+func (s *journalStorage) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+func (s *journalStorage) applyRecord(record *journalRecord) {
+	key := journalKey{record.Group, record.ClientId}
+	switch record.Op {
+	case journalOpAppend:
+		entry := TextEntry{Text: record.Text, Formats: record.Formats}
+		entries := append([]TextEntry{entry}, s.history[key]...)
+		if record.Limit > 0 && len(entries) > record.Limit {
+			entries = entries[:record.Limit]
+		}
+		s.history[key] = entries
+	case journalOpReplace:
+		entries := make([]TextEntry, len(record.Texts))
+		for index, text := range record.Texts {
+			entries[index].Text = text
+			if index < len(record.TextFormats) {
+				entries[index].Formats = record.TextFormats[index]
+			}
+		}
+		s.history[key] = entries
+	case journalOpOutboxAppend:
+		if record.Event != nil {
+			s.outboxes[key] = append(s.outboxes[key], *record.Event)
+		}
+	case journalOpOutboxReplace:
+		if len(record.Events) == 0 {
+			delete(s.outboxes, key)
+		} else {
+			s.outboxes[key] = slices.Clone(record.Events)
+		}
+	}
+}
+
+func (s *journalStorage) writeRecord(record *journalRecord) error {
+	if s.file == nil {
+		return fmt.Errorf("history journal is closed")
+	}
+	if _, err := s.file.Write(encodeJournalRecord(record)); err != nil {
+		return fmt.Errorf("unable to write history journal: %w", err)
+	}
+	if err := s.file.Sync(); err != nil {
+		return fmt.Errorf("unable to sync history journal: %w", err)
+	}
+	s.recordCount++
+
+	if s.recordCount >= kMinCompactionRecords && s.recordCount > 2*(len(s.history)+len(s.outboxes)) {
+		return s.compact()
+	}
+	return nil
+}
+
+func (s *journalStorage) load() error {
+	file, err := os.Open(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to open history journal: %w", err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) != 0 {
+				slog.Warn("History journal has incomplete last record, it will be dropped")
+			}
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("unable to read history journal: %w", err)
+		}
+
+		record, err := decodeJournalRecord(line)
+		if err != nil {
+			// Everything after the first broken record is not trusted.
+			slog.Error("History journal is damaged, the rest of it will be dropped", LogKeyError, err)
+			return nil
+		}
+		s.applyRecord(&record)
+		s.recordCount++
+	}
+}
+
+// Rewrites the journal so it contains only the current state. New journal is written to
+// temporary file first and atomically renamed, so the crash at any point leaves a valid journal.
+func (s *journalStorage) compact() error {
+	tmpPath := s.path + ".tmp"
+	tmpFile, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to create history journal: %w", err)
+	}
+
+	writer := bufio.NewWriter(tmpFile)
+	for key, entries := range s.history {
+		record := createReplaceRecord(key, entries)
+		writer.Write(encodeJournalRecord(&record))
+	}
+	for key, events := range s.outboxes {
+		record := journalRecord{Op: journalOpOutboxReplace, Group: key.group, ClientId: key.clientId, Events: events}
+		writer.Write(encodeJournalRecord(&record))
+	}
+	err = writer.Flush()
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	tmpFile.Close()
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("unable to write history journal: %w", err)
+	}
+
+	if err = os.Rename(tmpPath, s.path); err != nil {
+		return fmt.Errorf("unable to replace history journal: %w", err)
+	}
+	syncDir(filepath.Dir(s.path))
+
+	if s.file != nil {
+		s.file.Close()
+	}
+	s.file, err = os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to open history journal: %w", err)
+	}
+	s.recordCount = len(s.history) + len(s.outboxes)
+	return nil
+}
+
+func createReplaceRecord(key journalKey, entries []TextEntry) journalRecord {
+	record := journalRecord{
+		Op:          journalOpReplace,
+		Group:       key.group,
+		ClientId:    key.clientId,
+		Texts:       make([]string, len(entries)),
+		TextFormats: make([][]TextFormat, len(entries)),
+	}
+	hasFormats := false
+	for index, entry := range entries {
+		record.Texts[index] = entry.Text
+		record.TextFormats[index] = entry.Formats
+		hasFormats = hasFormats || len(entry.Formats) != 0
+	}
+	if !hasFormats {
+		record.TextFormats = nil
+	}
+	return record
+}
+
+func encodeJournalRecord(record *journalRecord) []byte {
+	data, err := json.Marshal(record)
+	if err != nil {
+		panic("Unable to serialize journal record")
+	}
+	return []byte(fmt.Sprintf("%08x %s\n", crc32.ChecksumIEEE(data), data))
+}
+
+func decodeJournalRecord(line []byte) (journalRecord, error) {
+	var record journalRecord
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	checksumStr, data, found := bytes.Cut(line, []byte(" "))
+	if !found {
+		return record, fmt.Errorf("wrong record format")
+	}
+
+	var checksum uint32
+	if _, err := fmt.Sscanf(string(checksumStr), "%08x", &checksum); err != nil {
+		return record, fmt.Errorf("wrong record checksum format")
+	}
+	if crc32.ChecksumIEEE(data) != checksum {
+		return record, fmt.Errorf("record checksum mismatch")
+	}
+
+	err := json.Unmarshal(data, &record)
+	return record, err
+}
+
+func syncDir(path string) {
+	dir, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	dir.Sync()
+	dir.Close()
+}
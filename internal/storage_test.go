@@ -0,0 +1,92 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestJournalStorage(t *testing.T) {
+	dir := t.TempDir()
+	storage, err := OpenJournalStorage(dir)
+	if err != nil {
+		t.Fatalf("Unable to open storage: %s", err.Error())
+	}
+
+	htmlFormat := []TextFormat{{MimeType: "text/html", Data: "<b>text3</b>"}}
+	storage.AppendText("home", 1, TextEntry{Text: "text1"}, 2)
+	storage.AppendText("home", 1, TextEntry{Text: "text2"}, 2)
+	storage.AppendText("home", 1, TextEntry{Text: "text3", Formats: htmlFormat}, 2)
+	storage.ReplaceHistory("home", 2, []TextEntry{{Text: "a"}, {Text: "b"}})
+	storage.Close()
+
+	storage, err = OpenJournalStorage(dir)
+	if err != nil {
+		t.Fatalf("Unable to reopen storage: %s", err.Error())
+	}
+	history := storage.GetHistory("home", 1)
+	if len(history) != 2 || history[0].Text != "text3" || history[1].Text != "text2" {
+		t.Errorf("Wrong restored history of client 1: %v", history)
+	}
+	if len(history) == 2 && !slices.Equal(history[0].Formats, htmlFormat) {
+		t.Errorf("Wrong restored text formats: %v", history[0].Formats)
+	}
+	if history := storage.GetHistory("home", 2); !slices.Equal(historyTexts(history), []string{"a", "b"}) {
+		t.Errorf("Wrong restored history of client 2: %v", history)
+	}
+	if history := storage.GetHistory("home", 3); len(history) != 0 {
+		t.Errorf("Unexpected history of unknown client: %v", history)
+	}
+	if history := storage.GetHistory("#1", 1); len(history) != 0 {
+		t.Errorf("History of the client with the same ID in another group was returned: %v", history)
+	}
+	storage.Close()
+}
+
+func TestJournalStorageTornTail(t *testing.T) {
+	dir := t.TempDir()
+	storage, err := OpenJournalStorage(dir)
+	if err != nil {
+		t.Fatalf("Unable to open storage: %s", err.Error())
+	}
+	storage.AppendText("home", 1, TextEntry{Text: "text1"}, 10)
+	storage.Close()
+
+	// Simulate crash in the middle of the record writing.
+	path := filepath.Join(dir, journalFileName)
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := encodeJournalRecord(&journalRecord{Op: journalOpAppend, Group: "home", ClientId: 1, Text: "text2"})
+	file.Write(record[:len(record)/2])
+	file.Close()
+
+	storage, err = OpenJournalStorage(dir)
+	if err != nil {
+		t.Fatalf("Unable to reopen storage: %s", err.Error())
+	}
+	if history := storage.GetHistory("home", 1); !slices.Equal(historyTexts(history), []string{"text1"}) {
+		t.Errorf("Wrong restored history: %v", history)
+	}
+
+	storage.AppendText("home", 1, TextEntry{Text: "text3"}, 10)
+	storage.Close()
+	storage, err = OpenJournalStorage(dir)
+	if err != nil {
+		t.Fatalf("Unable to reopen storage: %s", err.Error())
+	}
+	if history := storage.GetHistory("home", 1); !slices.Equal(historyTexts(history), []string{"text3", "text1"}) {
+		t.Errorf("Wrong history after torn tail recovery: %v", history)
+	}
+	storage.Close()
+}
+
+func historyTexts(history []TextEntry) []string {
+	texts := make([]string, len(history))
+	for index, entry := range history {
+		texts[index] = entry.Text
+	}
+	return texts
+}
@@ -0,0 +1,27 @@
+package internal
+
+import "fmt"
+
+const kMaxTextFormatSize = 1024 * 1024
+
+var supportedTextFormats = map[string]bool{
+	"text/html": true,
+	"text/rtf":  true,
+}
+
+func validateTextFormats(formats []TextFormat) error {
+	for index, format := range formats {
+		if !supportedTextFormats[format.MimeType] {
+			return fmt.Errorf("unsupported text format '%s'", format.MimeType)
+		}
+		if len(format.Data) > kMaxTextFormatSize {
+			return fmt.Errorf("'%s' representation is too large (%d bytes)", format.MimeType, len(format.Data))
+		}
+		for _, other := range formats[:index] {
+			if other.MimeType == format.MimeType {
+				return fmt.Errorf("duplicated text format '%s'", format.MimeType)
+			}
+		}
+	}
+	return nil
+}
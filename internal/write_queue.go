@@ -0,0 +1,66 @@
+package internal
+
+import "fmt"
+
+// What happens when the write queue of a slow client is full.
+const (
+	// Connection is closed, client reconnects and catches up with sync.
+	OverflowDisconnect = "disconnect"
+	// Queued text updates and host syncs superseded by a later host sync of the same host are dropped.
+	OverflowCoalesce = "coalesce"
+	// Queue grows above its size until it takes SpillBytes of memory.
+	OverflowSpill = "spill"
+)
+
+const DefaultWriteQueueSize = 100
+const DefaultSpillBytes = 64 * 1024 * 1024
+
+// Write queue settings as they are written in the config, zero values are replaced by the defaults.
+type WriteQueueConfig struct {
+	Size           int    `json:",omitempty"`
+	OverflowPolicy string `json:",omitempty"`
+	SpillBytes     uint64 `json:",omitempty"`
+}
+
+type WriteQueueSettings struct {
+	// Number of queued messages after which overflow policy is applied.
+	Size           int
+	OverflowPolicy string
+	SpillBytes     uint64
+}
+
+func ResolveWriteQueueSettings(config *WriteQueueConfig) WriteQueueSettings {
+	result := WriteQueueSettings{
+		Size:           DefaultWriteQueueSize,
+		OverflowPolicy: OverflowDisconnect,
+		SpillBytes:     DefaultSpillBytes,
+	}
+	if config == nil {
+		return result
+	}
+	if config.Size != 0 {
+		result.Size = config.Size
+	}
+	if len(config.OverflowPolicy) != 0 {
+		result.OverflowPolicy = config.OverflowPolicy
+	}
+	if config.SpillBytes != 0 {
+		result.SpillBytes = config.SpillBytes
+	}
+	return result
+}
+
+func validateWriteQueueConfig(config *WriteQueueConfig) error {
+	if config == nil {
+		return nil
+	}
+	if config.Size < 0 {
+		return fmt.Errorf("write queue size must not be negative: %d", config.Size)
+	}
+	switch config.OverflowPolicy {
+	case "", OverflowDisconnect, OverflowCoalesce, OverflowSpill:
+	default:
+		return fmt.Errorf("unknown write queue overflow policy '%s'", config.OverflowPolicy)
+	}
+	return nil
+}
@@ -3,29 +3,62 @@ package main
 import (
 	"communication"
 	"internal"
-	"log"
+	"log/slog"
+	"os"
+	"time"
 )
 
+func fatal(message string, err error) {
+	slog.Error(message, internal.LogKeyError, err)
+	os.Exit(1)
+}
+
 func main() {
 	settings, err := internal.ParseCmdArgs()
 	if err != nil {
-		log.Fatalf("Error parsing command line arguments: %s", err.Error())
+		fatal("Error parsing command line arguments", err)
 	}
 
 	appDataDir, err := internal.InitAppDataDir(settings.AppDataDir)
 	if err != nil {
-		log.Fatalf("Unable to initialize application data directory: '%s'", err.Error())
+		fatal("Unable to initialize application data directory", err)
+	}
+
+	if len(settings.Command) != 0 {
+		if err = internal.RunCommand(appDataDir, settings.Command); err != nil {
+			fatal("Command failed", err)
+		}
+		return
+	}
+	if err = internal.SetUpLogging(appDataDir, settings.Log); err != nil {
+		fatal("Unable to set up logging", err)
 	}
-	log.Printf("Server application data directory is: '%s'", appDataDir)
+	slog.Info("Server application data directory", "path", appDataDir)
 
 	config, err := internal.ReadServerConfig(appDataDir)
 	if err != nil {
-		log.Fatalf("Error parsing server config: '%s'", err.Error())
+		fatal("Error parsing server config", err)
 	}
 
-	server, err := communication.CreateServer(settings.AppDataDir, settings.Port, config)
+	if settings.ManageCert {
+		generated, err := internal.EnsureCertificate(appDataDir, settings.CertHosts)
+		if err != nil {
+			fatal("Unable to generate certificate", err)
+		}
+		if generated {
+			slog.Info("Self-signed certificate was generated", "hosts", settings.CertHosts)
+		}
+	}
+
+	server, err := communication.CreateServer(appDataDir, settings.Port, config)
 	if err != nil {
-		log.Fatalf("Unable to initialize the server: '%s'", err.Error())
+		fatal("Unable to initialize the server", err)
+	}
+	if settings.WatchConfig {
+		server.WatchConfigFile(time.Second * 2)
+	}
+	if settings.ManageCert {
+		server.ManageCertificate(time.Hour)
 	}
 	server.Run()
 }